@@ -0,0 +1,535 @@
+// Package bencode implements the encoding used by .torrent files, tracker
+// responses and the peer protocol's extension messages.
+//
+// Decoding is strict: dictionary keys must be unique and sorted, integers
+// may not have leading zeros or be negative zero, and nothing may follow
+// the top level value. Any document Decode accepts is the canonical
+// encoding of its value, so hashing a RawMessage gives the same result as
+// hashing the re-encoded value.
+//
+// Values are mapped to Go types as follows:
+//
+//	integer     int64, any integer kind, or bool from i0e and i1e
+//	string      string, []byte or a byte array of the same length
+//	list        []interface{}, or any slice
+//	dictionary  map[string]interface{}, a map with string keys or a struct
+//
+// Struct fields are named by their `bencode:"name"` tag, or the field name
+// without one. The tag option omitempty leaves zero values out when
+// encoding and the name "-" skips a field. Dictionary keys without a
+// matching field are ignored.
+package bencode
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// maxDepth bounds the nesting of lists and dictionaries
+const maxDepth = 256
+
+// RawMessage is an encoded value. Decoding stores the value's bytes as
+// they appear in the input, encoding writes them unchanged.
+type RawMessage []byte
+
+// SyntaxError describes malformed or non-canonical input
+type SyntaxError struct {
+	// Offset is the position in the input the error was found at
+	Offset int
+	msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("bencode: %s at offset %d", e.msg, e.Offset)
+}
+
+// UnmarshalTypeError describes a value that doesn't fit the Go value it is
+// decoded into
+type UnmarshalTypeError struct {
+	// Value is the kind of bencoded value: integer, string, list or
+	// dictionary
+	Value string
+	Type  reflect.Type
+	// Field is the path of dictionary keys leading to the value
+	Field string
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("bencode: cannot decode %s into %v", e.Value, e.Type)
+	}
+	return fmt.Sprintf("bencode: cannot decode %s into %v at %s", e.Value, e.Type, e.Field)
+}
+
+// Decode parses data into a tree of int64, string, []interface{} and
+// map[string]interface{} values
+func Decode(data []byte) (interface{}, error) {
+	d := decoder{data: data}
+	v, err := d.value()
+	if err == nil {
+		err = d.end()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Unmarshal parses data into the value pointed to by v
+func Unmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("bencode: Unmarshal needs a non-nil pointer, got %T", v)
+	}
+	d := decoder{data: data}
+	err := d.decode(rv.Elem(), "")
+	if err != nil {
+		return err
+	}
+	return d.end()
+}
+
+// Valid reports whether data is a single canonical bencoded value
+func Valid(data []byte) bool {
+	d := decoder{data: data}
+	return d.skip() == nil && d.end() == nil
+}
+
+type decoder struct {
+	data  []byte
+	off   int
+	depth int
+}
+
+func (d *decoder) errorf(format string, args ...interface{}) error {
+	return &SyntaxError{Offset: d.off, msg: fmt.Sprintf(format, args...)}
+}
+
+func (d *decoder) end() error {
+	if d.off != len(d.data) {
+		return d.errorf("trailing data")
+	}
+	return nil
+}
+
+// peek returns the next byte without consuming it
+func (d *decoder) peek() (byte, error) {
+	if d.off >= len(d.data) {
+		return 0, d.errorf("unexpected end of input")
+	}
+	return d.data[d.off], nil
+}
+
+// kind names the value starting with b for error messages
+func kind(b byte) string {
+	switch {
+	case b == 'i':
+		return "integer"
+	case b == 'l':
+		return "list"
+	case b == 'd':
+		return "dictionary"
+	}
+	return "string"
+}
+
+// number reads the digits up to the terminator, rejecting leading zeros
+// and, unless signed, a minus sign
+func (d *decoder) number(terminator byte, signed bool) (int64, error) {
+	start := d.off
+	end := bytes.IndexByte(d.data[start:], terminator)
+	if end < 0 {
+		return 0, d.errorf("unterminated number")
+	}
+	digits := d.data[start : start+end]
+	unsigned := digits
+	if signed && len(digits) > 0 && digits[0] == '-' {
+		unsigned = digits[1:]
+	}
+	switch {
+	case len(unsigned) == 0:
+		return 0, d.errorf("empty number")
+	case unsigned[0] == '0' && len(digits) > 1:
+		return 0, d.errorf("number with leading zero or negative zero")
+	}
+	for _, b := range unsigned {
+		if b < '0' || b > '9' {
+			return 0, d.errorf("invalid digit %q", b)
+		}
+	}
+	n, err := strconv.ParseInt(string(digits), 10, 64)
+	if err != nil {
+		return 0, d.errorf("number out of range")
+	}
+	d.off += end + 1
+	return n, nil
+}
+
+func (d *decoder) integer() (int64, error) {
+	d.off++ // i
+	return d.number('e', true)
+}
+
+func (d *decoder) bytes() ([]byte, error) {
+	n, err := d.number(':', false)
+	if err != nil {
+		return nil, err
+	}
+	if n > int64(len(d.data)-d.off) {
+		return nil, d.errorf("string of %d bytes exceeds the input", n)
+	}
+	b := d.data[d.off : d.off+int(n)]
+	d.off += int(n)
+	return b, nil
+}
+
+// enter opens a list or dictionary
+func (d *decoder) enter() error {
+	d.depth++
+	if d.depth > maxDepth {
+		return d.errorf("nesting too deep")
+	}
+	d.off++ // l or d
+	return nil
+}
+
+// more reports whether the open list or dictionary has another element,
+// consuming its end otherwise
+func (d *decoder) more() (bool, error) {
+	b, err := d.peek()
+	if err != nil {
+		return false, err
+	}
+	if b == 'e' {
+		d.off++
+		d.depth--
+		return false, nil
+	}
+	return true, nil
+}
+
+// key reads a dictionary key and checks it sorts after the previous one
+func (d *decoder) key(prev []byte, first bool) ([]byte, error) {
+	b, err := d.peek()
+	if err != nil {
+		return nil, err
+	}
+	if b < '0' || b > '9' {
+		return nil, d.errorf("dictionary key is not a string")
+	}
+	start := d.off
+	key, err := d.bytes()
+	if err != nil {
+		return nil, err
+	}
+	if !first && bytes.Compare(prev, key) >= 0 {
+		d.off = start
+		return nil, d.errorf("dictionary key %q is duplicate or out of order", key)
+	}
+	return key, nil
+}
+
+// skip consumes and validates a value
+func (d *decoder) skip() error {
+	b, err := d.peek()
+	if err != nil {
+		return err
+	}
+	switch b {
+	case 'i':
+		_, err = d.integer()
+		return err
+	case 'l':
+		if err = d.enter(); err != nil {
+			return err
+		}
+		for {
+			more, err := d.more()
+			if err != nil || !more {
+				return err
+			}
+			if err = d.skip(); err != nil {
+				return err
+			}
+		}
+	case 'd':
+		if err = d.enter(); err != nil {
+			return err
+		}
+		var prev []byte
+		for first := true; ; first = false {
+			more, err := d.more()
+			if err != nil || !more {
+				return err
+			}
+			prev, err = d.key(prev, first)
+			if err != nil {
+				return err
+			}
+			if err = d.skip(); err != nil {
+				return err
+			}
+		}
+	}
+	if b < '0' || b > '9' {
+		return d.errorf("invalid value starting with %q", b)
+	}
+	_, err = d.bytes()
+	return err
+}
+
+// value decodes the next value into its generic form
+func (d *decoder) value() (interface{}, error) {
+	b, err := d.peek()
+	if err != nil {
+		return nil, err
+	}
+	switch b {
+	case 'i':
+		return d.integer()
+	case 'l':
+		if err = d.enter(); err != nil {
+			return nil, err
+		}
+		list := []interface{}{}
+		for {
+			more, err := d.more()
+			if err != nil {
+				return nil, err
+			}
+			if !more {
+				return list, nil
+			}
+			v, err := d.value()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+	case 'd':
+		if err = d.enter(); err != nil {
+			return nil, err
+		}
+		dict := make(map[string]interface{})
+		var prev []byte
+		for first := true; ; first = false {
+			more, err := d.more()
+			if err != nil {
+				return nil, err
+			}
+			if !more {
+				return dict, nil
+			}
+			prev, err = d.key(prev, first)
+			if err != nil {
+				return nil, err
+			}
+			v, err := d.value()
+			if err != nil {
+				return nil, err
+			}
+			dict[string(prev)] = v
+		}
+	}
+	if b < '0' || b > '9' {
+		return nil, d.errorf("invalid value starting with %q", b)
+	}
+	s, err := d.bytes()
+	return string(s), err
+}
+
+var rawMessageType = reflect.TypeOf(RawMessage(nil))
+
+// decode decodes the next value into v, field is the path to it
+func (d *decoder) decode(v reflect.Value, field string) error {
+	if v.Type() == rawMessageType {
+		start := d.off
+		if err := d.skip(); err != nil {
+			return err
+		}
+		v.SetBytes(append(RawMessage(nil), d.data[start:d.off]...))
+		return nil
+	}
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.decode(v.Elem(), field)
+	}
+	if v.Kind() == reflect.Interface && v.NumMethod() == 0 {
+		value, err := d.value()
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(value))
+		return nil
+	}
+
+	b, err := d.peek()
+	if err != nil {
+		return err
+	}
+	mismatch := &UnmarshalTypeError{Value: kind(b), Type: v.Type(), Field: field}
+	switch b {
+	case 'i':
+		return d.decodeInt(v, mismatch)
+	case 'l':
+		if v.Kind() != reflect.Slice {
+			return mismatch
+		}
+		return d.decodeList(v, field)
+	case 'd':
+		switch {
+		case v.Kind() == reflect.Struct:
+			return d.decodeStruct(v, field)
+		case v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String:
+			return d.decodeMap(v, field)
+		}
+		return mismatch
+	}
+	if b < '0' || b > '9' {
+		return d.errorf("invalid value starting with %q", b)
+	}
+	return d.decodeString(v, mismatch)
+}
+
+func (d *decoder) decodeInt(v reflect.Value, mismatch *UnmarshalTypeError) error {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Bool:
+	default:
+		return mismatch
+	}
+	n, err := d.integer()
+	if err != nil {
+		return err
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		if n != 0 && n != 1 {
+			return mismatch
+		}
+		v.SetBool(n == 1)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if n < 0 || v.OverflowUint(uint64(n)) {
+			return mismatch
+		}
+		v.SetUint(uint64(n))
+	default:
+		if v.OverflowInt(n) {
+			return mismatch
+		}
+		v.SetInt(n)
+	}
+	return nil
+}
+
+func (d *decoder) decodeString(v reflect.Value, mismatch *UnmarshalTypeError) error {
+	isBytes := (v.Kind() == reflect.Slice || v.Kind() == reflect.Array) && v.Type().Elem().Kind() == reflect.Uint8
+	if v.Kind() != reflect.String && !isBytes {
+		return mismatch
+	}
+	s, err := d.bytes()
+	if err != nil {
+		return err
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(string(s))
+	case reflect.Slice:
+		v.SetBytes(append([]byte{}, s...))
+	default:
+		if len(s) != v.Len() {
+			return mismatch
+		}
+		reflect.Copy(v, reflect.ValueOf(s))
+	}
+	return nil
+}
+
+func (d *decoder) decodeList(v reflect.Value, field string) error {
+	if err := d.enter(); err != nil {
+		return err
+	}
+	list := reflect.MakeSlice(v.Type(), 0, 0)
+	for i := 0; ; i++ {
+		more, err := d.more()
+		if err != nil {
+			return err
+		}
+		if !more {
+			v.Set(list)
+			return nil
+		}
+		list = reflect.Append(list, reflect.Zero(v.Type().Elem()))
+		err = d.decode(list.Index(i), fmt.Sprintf("%s[%d]", field, i))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (d *decoder) decodeMap(v reflect.Value, field string) error {
+	if err := d.enter(); err != nil {
+		return err
+	}
+	if v.IsNil() {
+		v.Set(reflect.MakeMap(v.Type()))
+	}
+	var prev []byte
+	for first := true; ; first = false {
+		more, err := d.more()
+		if err != nil || !more {
+			return err
+		}
+		prev, err = d.key(prev, first)
+		if err != nil {
+			return err
+		}
+		elem := reflect.New(v.Type().Elem()).Elem()
+		err = d.decode(elem, join(field, string(prev)))
+		if err != nil {
+			return err
+		}
+		v.SetMapIndex(reflect.ValueOf(string(prev)).Convert(v.Type().Key()), elem)
+	}
+}
+
+func (d *decoder) decodeStruct(v reflect.Value, field string) error {
+	if err := d.enter(); err != nil {
+		return err
+	}
+	fields := structFields(v.Type())
+	var prev []byte
+	for first := true; ; first = false {
+		more, err := d.more()
+		if err != nil || !more {
+			return err
+		}
+		prev, err = d.key(prev, first)
+		if err != nil {
+			return err
+		}
+		f, ok := fields.byName(string(prev))
+		if !ok {
+			if err = d.skip(); err != nil {
+				return err
+			}
+			continue
+		}
+		err = d.decode(v.Field(f.index), join(field, f.name))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
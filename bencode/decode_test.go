@@ -0,0 +1,200 @@
+package bencode
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		in   string
+		want interface{}
+	}{
+		{"i0e", int64(0)},
+		{"i-42e", int64(-42)},
+		{"i9223372036854775807e", int64(9223372036854775807)},
+		{"0:", ""},
+		{"4:spam", "spam"},
+		{"le", []interface{}{}},
+		{"li1e3:abce", []interface{}{int64(1), "abc"}},
+		{"de", map[string]interface{}{}},
+		{"d1:ai1e1:bl1:cee", map[string]interface{}{"a": int64(1), "b": []interface{}{"c"}}},
+		{"d0:i1e1:ai2ee", map[string]interface{}{"": int64(1), "a": int64(2)}},
+	}
+	for _, tt := range tests {
+		got, err := Decode([]byte(tt.in))
+		if err != nil {
+			t.Errorf("Decode(%q): %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Decode(%q) = %#v, want %#v", tt.in, got, tt.want)
+		}
+		if !Valid([]byte(tt.in)) {
+			t.Errorf("Valid(%q) = false", tt.in)
+		}
+	}
+}
+
+func TestDecodeRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+	}{
+		{"unsorted keys", "d1:bi1e1:ai2ee"},
+		{"duplicate keys", "d1:ai1e1:ai2ee"},
+		{"unsorted keys in a nested dictionary", "d1:ad1:bi1e1:ai2eee"},
+		{"prefix sorted after the longer key", "d2:abi1e1:ai2ee"},
+		{"non-string key", "di1ei2ee"},
+		{"leading zero", "i01e"},
+		{"negative leading zero", "i-01e"},
+		{"negative zero", "i-0e"},
+		{"empty integer", "ie"},
+		{"lone minus", "i-e"},
+		{"plus sign", "i+1e"},
+		{"integer out of range", "i9223372036854775808e"},
+		{"string length with leading zero", "01:a"},
+		{"negative string length", "-1:a"},
+		{"truncated integer", "i12"},
+		{"truncated string", "5:abc"},
+		{"truncated list", "li1e"},
+		{"truncated dictionary", "d1:a"},
+		{"dictionary key without value", "d1:ae"},
+		{"empty input", ""},
+		{"trailing data", "i1ei2e"},
+		{"trailing end", "lee"},
+		{"invalid value", "x"},
+		{"too deep", strings.Repeat("l", maxDepth+1) + strings.Repeat("e", maxDepth+1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := Decode([]byte(tt.in))
+			var syntax *SyntaxError
+			if !errors.As(err, &syntax) {
+				t.Errorf("Decode(%q) = %#v, %v, want a syntax error", tt.in, v, err)
+			}
+			var generic interface{}
+			if err := Unmarshal([]byte(tt.in), &generic); err == nil {
+				t.Errorf("Unmarshal(%q) into interface{} succeeded", tt.in)
+			}
+			var raw RawMessage
+			if err := Unmarshal([]byte(tt.in), &raw); err == nil {
+				t.Errorf("Unmarshal(%q) into RawMessage succeeded", tt.in)
+			}
+			if Valid([]byte(tt.in)) {
+				t.Errorf("Valid(%q) = true", tt.in)
+			}
+		})
+	}
+}
+
+func TestDecodeDepth(t *testing.T) {
+	deepest := strings.Repeat("l", maxDepth) + strings.Repeat("e", maxDepth)
+	if _, err := Decode([]byte(deepest)); err != nil {
+		t.Errorf("Decode of %d nested lists: %v", maxDepth, err)
+	}
+	if _, err := Decode([]byte("l" + deepest + "e")); err == nil {
+		t.Errorf("Decode of %d nested lists succeeded", maxDepth+1)
+	}
+	// closed lists and dictionaries give their depth back
+	siblings := strings.Repeat("l", maxDepth-1) + "ledelede" + strings.Repeat("e", maxDepth-1)
+	if !Valid([]byte(siblings)) {
+		t.Error("sibling values at the deepest level are counted as nested")
+	}
+}
+
+func TestUnmarshalStruct(t *testing.T) {
+	type file struct {
+		Length int64    `bencode:"length"`
+		Path   []string `bencode:"path"`
+	}
+	type info struct {
+		Files   []file `bencode:"files"`
+		Private bool   `bencode:"private"`
+		Hash    [4]byte
+	}
+	in := "d4:Hash4:abcd5:filesld6:lengthi3e4:pathl1:a1:beee7:privatei1e7:unknownli1eee"
+	var got info
+	err := Unmarshal([]byte(in), &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := info{Files: []file{{3, []string{"a", "b"}}}, Private: true, Hash: [4]byte{'a', 'b', 'c', 'd'}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unmarshal = %+v, want %+v", got, want)
+	}
+
+	mismatches := []struct {
+		in    string
+		field string
+	}{
+		{"d5:filesi1ee", "files"},
+		{"d5:filesld6:length1:xeee", "files[0].length"},
+		{"d7:privatei2ee", "private"},
+		{"d4:Hash3:abce", "Hash"},
+	}
+	for _, tt := range mismatches {
+		var v info
+		err := Unmarshal([]byte(tt.in), &v)
+		var typeErr *UnmarshalTypeError
+		if !errors.As(err, &typeErr) || typeErr.Field != tt.field {
+			t.Errorf("Unmarshal(%q) = %v, want a type error at %s", tt.in, err, tt.field)
+		}
+	}
+}
+
+func TestRawMessageInfoHash(t *testing.T) {
+	info := map[string]interface{}{
+		"length":       int64(5),
+		"name":         "file",
+		"piece length": int64(16384),
+		"pieces":       strings.Repeat("x", 20),
+	}
+	encodedInfo, err := Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := Marshal(map[string]interface{}{
+		"announce": "http://tracker.example/announce",
+		"info":     RawMessage(encodedInfo),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var torrent struct {
+		Announce string     `bencode:"announce"`
+		Info     RawMessage `bencode:"info"`
+	}
+	err = Unmarshal(data, &torrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(torrent.Info, encodedInfo) {
+		t.Errorf("RawMessage = %q, want %q", torrent.Info, encodedInfo)
+	}
+	// canonical input re-encodes to the same bytes, so the info hash is
+	// the same whichever form it is taken from
+	decoded, err := Decode(torrent.Info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reencoded, err := Marshal(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sha1.Sum(reencoded) != sha1.Sum(torrent.Info) {
+		t.Error("info hash changes when the info dictionary is re-encoded")
+	}
+	again, err := Marshal(torrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again, data) {
+		t.Errorf("Marshal after Unmarshal = %q, want %q", again, data)
+	}
+}
@@ -0,0 +1,163 @@
+package bencode
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// errNil is returned for nil pointers, interfaces and raw messages, which
+// have no encoding
+var errNil = errors.New("bencode: cannot encode nil")
+
+// Marshal returns the canonical encoding of v. Dictionary keys are sorted
+// whether they come from a map or from struct fields.
+func Marshal(v interface{}) ([]byte, error) {
+	var e encoder
+	err := e.encode(reflect.ValueOf(v))
+	if err != nil {
+		return nil, err
+	}
+	return e.buf, nil
+}
+
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) string(s string) {
+	e.buf = strconv.AppendInt(e.buf, int64(len(s)), 10)
+	e.buf = append(e.buf, ':')
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		return errNil
+	}
+	if v.Type() == rawMessageType {
+		if v.Len() == 0 {
+			return errNil
+		}
+		e.buf = append(e.buf, v.Bytes()...)
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return errNil
+		}
+		return e.encode(v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			e.buf = append(e.buf, "i1e"...)
+		} else {
+			e.buf = append(e.buf, "i0e"...)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.buf = append(e.buf, 'i')
+		e.buf = strconv.AppendInt(e.buf, v.Int(), 10)
+		e.buf = append(e.buf, 'e')
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.buf = append(e.buf, 'i')
+		e.buf = strconv.AppendUint(e.buf, v.Uint(), 10)
+		e.buf = append(e.buf, 'e')
+	case reflect.String:
+		e.string(v.String())
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			e.string(string(b))
+			return nil
+		}
+		e.buf = append(e.buf, 'l')
+		for i := 0; i < v.Len(); i++ {
+			if err := e.encode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+		e.buf = append(e.buf, 'e')
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("bencode: cannot encode map with %v keys", v.Type().Key())
+		}
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		e.buf = append(e.buf, 'd')
+		for _, k := range keys {
+			e.string(k.String())
+			if err := e.encode(v.MapIndex(k)); err != nil {
+				return fmt.Errorf("%w in key %q", err, k.String())
+			}
+		}
+		e.buf = append(e.buf, 'e')
+	case reflect.Struct:
+		e.buf = append(e.buf, 'd')
+		for _, f := range structFields(v.Type()) {
+			fv := v.Field(f.index)
+			if f.omitEmpty && isEmpty(fv) {
+				continue
+			}
+			e.string(f.name)
+			if err := e.encode(fv); err != nil {
+				return fmt.Errorf("%w in field %s", err, f.name)
+			}
+		}
+		e.buf = append(e.buf, 'e')
+	default:
+		return fmt.Errorf("bencode: cannot encode %v", v.Type())
+	}
+	return nil
+}
+
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map, reflect.String, reflect.Array:
+		return v.Len() == 0
+	case reflect.Pointer, reflect.Interface:
+		return v.IsNil()
+	}
+	return v.IsZero()
+}
+
+// field is a struct field mapped to a dictionary key
+type field struct {
+	name      string
+	index     int
+	omitEmpty bool
+}
+
+// fields are sorted by name
+type fields []field
+
+func (fs fields) byName(name string) (field, bool) {
+	i := sort.Search(len(fs), func(i int) bool { return fs[i].name >= name })
+	if i < len(fs) && fs[i].name == name {
+		return fs[i], true
+	}
+	return field{}, false
+}
+
+func structFields(t reflect.Type) fields {
+	var fs fields
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(sf.Tag.Get("bencode"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		fs = append(fs, field{name: name, index: i, omitEmpty: opts == "omitempty"})
+	}
+	sort.SliceStable(fs, func(i, j int) bool { return fs[i].name < fs[j].name })
+	return fs
+}
@@ -1,11 +1,36 @@
+// Package bitfield implements the piece bitfield of the peer wire
+// protocol. Piece 0 is the high bit of the first byte, and the bits past
+// the last piece are spare and always zero.
 package bitfield
 
+import (
+	"fmt"
+	"math/bits"
+)
+
 type Bitfield []byte
 
+// New returns an empty bitfield for the given number of pieces
+func New(pieces int) Bitfield {
+	return make(Bitfield, (pieces+7)/8)
+}
+
+// Validate checks that a bitfield received from a peer is sized for the
+// given number of pieces and has no spare bits set
+func (bf *Bitfield) Validate(pieces int) error {
+	if len(*bf) != (pieces+7)/8 {
+		return fmt.Errorf("bitfield of %d bytes for %d pieces", len(*bf), pieces)
+	}
+	if spare := pieces % 8; spare != 0 && (*bf)[len(*bf)-1]<<spare != 0 {
+		return fmt.Errorf("bitfield has bits set past piece %d", pieces-1)
+	}
+	return nil
+}
+
 func (bf *Bitfield) HasPiece(index int) bool {
 	byteNumber := index / 8
 	byteOffset := index % 8
-	if byteNumber < 0 || byteNumber >= len(*bf) {
+	if index < 0 || byteNumber >= len(*bf) {
 		return false
 	}
 	return (*bf)[byteNumber]>>uint(7-byteOffset)&1 != 0
@@ -14,8 +39,85 @@ func (bf *Bitfield) HasPiece(index int) bool {
 func (bf *Bitfield) SetPiece(index int) {
 	byteNumber := index / 8
 	byteOffset := index % 8
-	if byteNumber < 0 || len(*bf) >= byteNumber {
+	if index < 0 || byteNumber >= len(*bf) {
 		return
 	}
 	(*bf)[byteNumber] |= 1 << uint(7-byteOffset)
 }
+
+// Clear unsets the piece at index
+func (bf *Bitfield) Clear(index int) {
+	byteNumber := index / 8
+	byteOffset := index % 8
+	if index < 0 || byteNumber >= len(*bf) {
+		return
+	}
+	(*bf)[byteNumber] &^= 1 << uint(7-byteOffset)
+}
+
+// Count returns the number of pieces set
+func (bf *Bitfield) Count() int {
+	n := 0
+	for _, b := range *bf {
+		n += bits.OnesCount8(b)
+	}
+	return n
+}
+
+// All reports whether all of the given number of pieces are set
+func (bf *Bitfield) All(pieces int) bool {
+	if len(*bf) < (pieces+7)/8 {
+		return false
+	}
+	for i := 0; i < pieces/8; i++ {
+		if (*bf)[i] != 0xff {
+			return false
+		}
+	}
+	spare := pieces % 8
+	return spare == 0 || (*bf)[pieces/8]>>(8-spare) == 0xff>>(8-spare)
+}
+
+// Range calls fn with the index of every piece set, in order, until fn
+// returns false
+func (bf *Bitfield) Range(fn func(index int) bool) {
+	for i, b := range *bf {
+		for b != 0 {
+			offset := bits.LeadingZeros8(b)
+			if !fn(i*8 + offset) {
+				return
+			}
+			b &^= 0x80 >> offset
+		}
+	}
+}
+
+// And returns the pieces set in both bitfields
+func (bf *Bitfield) And(other Bitfield) Bitfield {
+	return bf.combine(other, func(a, b byte) byte { return a & b })
+}
+
+// AndNot returns the pieces set in bf but not in other, such as the pieces
+// a peer has that we still need
+func (bf *Bitfield) AndNot(other Bitfield) Bitfield {
+	return bf.combine(other, func(a, b byte) byte { return a &^ b })
+}
+
+// Or returns the pieces set in either bitfield
+func (bf *Bitfield) Or(other Bitfield) Bitfield {
+	return bf.combine(other, func(a, b byte) byte { return a | b })
+}
+
+// combine applies op byte by byte. The result is as long as bf, missing
+// bytes of other count as zero.
+func (bf *Bitfield) combine(other Bitfield, op func(a, b byte) byte) Bitfield {
+	res := make(Bitfield, len(*bf))
+	for i, a := range *bf {
+		var b byte
+		if i < len(other) {
+			b = other[i]
+		}
+		res[i] = op(a, b)
+	}
+	return res
+}
@@ -0,0 +1,118 @@
+package bitfield
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSetPiece(t *testing.T) {
+	bf := New(20)
+	for _, index := range []int{0, 7, 8, 19} {
+		bf.SetPiece(index)
+		if !bf.HasPiece(index) {
+			t.Errorf("piece %d not set", index)
+		}
+	}
+	want := Bitfield{0x81, 0x80, 0x10}
+	if !reflect.DeepEqual(bf, want) {
+		t.Errorf("bitfield = %08b, want %08b", bf, want)
+	}
+	// out of range indexes are ignored
+	for _, index := range []int{-1, 24, 100} {
+		bf.SetPiece(index)
+		if bf.HasPiece(index) {
+			t.Errorf("piece %d out of range is set", index)
+		}
+	}
+	if !reflect.DeepEqual(bf, want) {
+		t.Errorf("out of range SetPiece changed the bitfield to %08b", bf)
+	}
+
+	bf.Clear(7)
+	bf.Clear(24)
+	if bf.HasPiece(7) || bf.Count() != 3 {
+		t.Errorf("after Clear(7) the bitfield is %08b", bf)
+	}
+}
+
+func TestSpareBits(t *testing.T) {
+	tests := []struct {
+		name   string
+		bf     Bitfield
+		pieces int
+		valid  bool
+		all    bool
+	}{
+		{"empty", Bitfield{0x00, 0x00}, 10, true, false},
+		{"all set", Bitfield{0xff, 0xc0}, 10, true, true},
+		{"spare bit set", Bitfield{0xff, 0xc1}, 10, false, true},
+		{"only spare bits set", Bitfield{0x00, 0x3f}, 10, false, false},
+		{"whole bytes", Bitfield{0xff, 0xff}, 16, true, true},
+		{"last piece missing", Bitfield{0xff, 0x80}, 10, true, false},
+		{"too short", Bitfield{0xff}, 10, false, false},
+		{"too long", Bitfield{0xff, 0xc0, 0x00}, 10, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.bf.Validate(tt.pieces)
+			if (err == nil) != tt.valid {
+				t.Errorf("Validate(%d) = %v, want valid %t", tt.pieces, err, tt.valid)
+			}
+			if got := tt.bf.All(tt.pieces); got != tt.all {
+				t.Errorf("All(%d) = %t, want %t", tt.pieces, got, tt.all)
+			}
+		})
+	}
+
+	// a bitfield of our own never gets spare bits set
+	bf := New(10)
+	for i := 0; i < 10; i++ {
+		bf.SetPiece(i)
+	}
+	if err := bf.Validate(10); err != nil {
+		t.Errorf("full bitfield is invalid: %v", err)
+	}
+	if bf.Count() != 10 {
+		t.Errorf("full bitfield counts %d pieces, want 10", bf.Count())
+	}
+}
+
+func TestRange(t *testing.T) {
+	bf := Bitfield{0x81, 0x00, 0x40}
+	var got []int
+	bf.Range(func(index int) bool {
+		got = append(got, index)
+		return true
+	})
+	if want := []int{0, 7, 17}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Range visited %v, want %v", got, want)
+	}
+	got = nil
+	bf.Range(func(index int) bool {
+		got = append(got, index)
+		return len(got) < 2
+	})
+	if want := []int{0, 7}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Range stopped after %v, want %v", got, want)
+	}
+}
+
+func TestSetOperations(t *testing.T) {
+	a := Bitfield{0xf0, 0x80}
+	b := Bitfield{0x3c}
+	tests := []struct {
+		name string
+		got  Bitfield
+		want Bitfield
+	}{
+		{"And", a.And(b), Bitfield{0x30, 0x00}},
+		{"AndNot", a.AndNot(b), Bitfield{0xc0, 0x80}},
+		{"Or", a.Or(b), Bitfield{0xfc, 0x80}},
+		{"shorter receiver", b.Or(a), Bitfield{0xfc}},
+	}
+	for _, tt := range tests {
+		if !reflect.DeepEqual(tt.got, tt.want) {
+			t.Errorf("%s = %08b, want %08b", tt.name, tt.got, tt.want)
+		}
+	}
+}
@@ -2,11 +2,19 @@ package client
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/souravbiswassanto/bit-torrent-client/bitfield"
 	"github.com/souravbiswassanto/bit-torrent-client/handshake"
+	"github.com/souravbiswassanto/bit-torrent-client/ipfilter"
 	"github.com/souravbiswassanto/bit-torrent-client/message"
+	"github.com/souravbiswassanto/bit-torrent-client/metrics"
+	"github.com/souravbiswassanto/bit-torrent-client/mse"
+	"github.com/souravbiswassanto/bit-torrent-client/peerid"
 	"github.com/souravbiswassanto/bit-torrent-client/peers"
+	"github.com/souravbiswassanto/bit-torrent-client/ratelimit"
+	"github.com/souravbiswassanto/bit-torrent-client/utp"
 	"net"
 	"time"
 )
@@ -15,41 +23,200 @@ type Client struct {
 	Conn     net.Conn
 	Choked   bool
 	Bitfield bitfield.Bitfield
+	// PeerID is the ID the peer sent in its handshake
+	PeerID   [20]byte
 	peer     peers.Peer
 	infoHash [20]byte
-	peerID   [20]byte
+	live     *liveConn
 }
 
-func New(peer peers.Peer, infoHash, peerID [20]byte) (*Client, error) {
-	conn, err := net.DialTimeout("udp", peer.String(), 3*time.Second)
+// ErrBlockedClient is returned by New for peers running one of
+// Options.BlockClients
+var ErrBlockedClient = errors.New("peer client is blocked")
+
+// ErrBlockedIP is returned by New for peers blocked by Options.IPFilter
+var ErrBlockedIP = errors.New("peer address is blocked")
+
+// Options controls how connections to peers are made
+type Options struct {
+	// Encryption is the MSE policy for the connection
+	Encryption mse.Policy
+	// Dialer opens the connections. If nil, peers are dialed over TCP
+	// and, given a UTP socket, over uTP as well.
+	Dialer Dialer
+	// UTP is the socket used to reach peers over uTP. Without it only TCP
+	// is used.
+	UTP *utp.Socket
+	// PreferUTP dials uTP first and only falls back to TCP when it fails,
+	// otherwise both are dialed at once and the first to connect is used.
+	PreferUTP bool
+	// Network is the TCP network, "tcp" if empty
+	Network string
+	// DownloadLimit and UploadLimit are shared across connections, nil
+	// means unlimited
+	DownloadLimit *ratelimit.Limiter
+	UploadLimit   *ratelimit.Limiter
+	// BlockClients refuses peers whose ID names one of these clients, see
+	// peerid.Client.Matches
+	BlockClients []string
+	// IPFilter refuses to connect to the addresses it blocks
+	IPFilter *ipfilter.Filter
+	// HalfOpen, if set, is a semaphore limiting the connections being
+	// dialed or handshaken at once across everything sharing it
+	HalfOpen chan struct{}
+	// DialTimeout bounds connecting and HandshakeTimeout each step of the
+	// handshakes after that, zero means the defaults
+	DialTimeout      time.Duration
+	HandshakeTimeout time.Duration
+	// V2 announces support for BitTorrent v2 in the handshake, for v2 and
+	// hybrid torrents
+	V2 bool
+	// KeepAliveInterval is how long the connection may go without us
+	// sending anything before a keep-alive is sent
+	KeepAliveInterval time.Duration
+	// IdleTimeout disconnects peers that send nothing for that long,
+	// RequestTimeout those that take that long to answer block requests
+	IdleTimeout    time.Duration
+	RequestTimeout time.Duration
+}
+
+// Default timeouts for Options leaving them unset
+const (
+	DefaultDialTimeout      = 3 * time.Second
+	DefaultHandshakeTimeout = 5 * time.Second
+	DefaultIdleTimeout      = 3 * time.Minute
+	DefaultRequestTimeout   = 30 * time.Second
+	// DefaultKeepAliveInterval stays below the two minutes of silence
+	// after which peers commonly drop connections
+	DefaultKeepAliveInterval = 2 * time.Minute
+)
+
+// handshake returns the handshake we send for infoHash
+func (o Options) handshake(infoHash, peerID [20]byte) *handshake.Handshake {
+	hs := handshake.New(infoHash, peerID)
+	if o.V2 {
+		hs.Reserved[7] |= handshake.ReservedV2
+	}
+	return hs
+}
+
+func (o Options) handshakeTimeout() time.Duration {
+	return orDefault(o.HandshakeTimeout, DefaultHandshakeTimeout)
+}
+
+var (
+	handshakeFailures = metrics.NewCounterVec("bittorrent_handshake_failures_total",
+		"Peer connections that failed to set up, by the stage that failed", "stage")
+	halfOpen = metrics.NewGauge("bittorrent_half_open_connections",
+		"Peer connections being dialed or handshaken")
+)
+
+// New connects to peer and exchanges the handshake and bitfield. When
+// ctx is done before that the connection is closed and ctx.Err() returned.
+// While it runs New holds a slot of opts.HalfOpen. The connection sends
+// keep-alives until it is closed.
+func New(ctx context.Context, peer peers.Peer, infoHash, peerID [20]byte, opts Options) (*Client, error) {
+	if opts.IPFilter.Blocked(peer.IP) {
+		return nil, ErrBlockedIP
+	}
+	if opts.HalfOpen != nil {
+		select {
+		case opts.HalfOpen <- struct{}{}:
+			defer func() { <-opts.HalfOpen }()
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	halfOpen.Inc()
+	defer halfOpen.Dec()
+	conn, err := dial(ctx, peer, infoHash, opts)
 	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		handshakeFailures.With("dial").Inc()
 		return nil, err
 	}
-	_, err = completeHandshake(conn, infoHash, peerID)
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	conn = ratelimit.Conn(conn, opts.DownloadLimit, opts.UploadLimit)
+	hs, err := completeHandshake(conn, opts.handshake(infoHash, peerID), opts.handshakeTimeout())
 	if err != nil {
 		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		handshakeFailures.With("handshake").Inc()
 		return nil, err
 	}
-	bf, err := receiveBitField(conn)
+	if c := peerid.Parse(hs.PeerID); c.Matches(opts.BlockClients) {
+		conn.Close()
+		handshakeFailures.With("blocked").Inc()
+		return nil, fmt.Errorf("%w: %s", ErrBlockedClient, c)
+	}
+	bf, err := receiveBitField(conn, opts.handshakeTimeout())
 	if err != nil {
 		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		handshakeFailures.With("bitfield").Inc()
 		return nil, err
 	}
+	if !stop() {
+		// ctx was done right after the handshake and conn is closed
+		return nil, ctx.Err()
+	}
+	return newClient(conn, bf, hs.PeerID, peer, infoHash, opts), nil
+}
+
+// newClient wraps a connection that completed the handshakes
+func newClient(conn net.Conn, bf bitfield.Bitfield, peerID [20]byte, peer peers.Peer, infoHash [20]byte, opts Options) *Client {
+	live := newLiveConn(conn, orDefault(opts.KeepAliveInterval, DefaultKeepAliveInterval),
+		orDefault(opts.IdleTimeout, DefaultIdleTimeout),
+		orDefault(opts.RequestTimeout, DefaultRequestTimeout))
 	return &Client{
-		Conn:     conn,
+		Conn:     live,
 		Choked:   true,
 		Bitfield: bf,
+		PeerID:   peerID,
 		peer:     peer,
 		infoHash: infoHash,
-		peerID:   peerID,
-	}, nil
+		live:     live,
+	}
+}
 
+// dial connects to peer and negotiates stream encryption according to
+// policy. Under mse.PolicyPreferred a peer that fails the encrypted
+// handshake is dialed again in plaintext.
+func dial(ctx context.Context, peer peers.Peer, infoHash [20]byte, opts Options) (net.Conn, error) {
+	policy := opts.Encryption
+	dialer := opts.dialer()
+	conn, err := dialer.DialPeer(ctx, peer)
+	if err != nil || policy == mse.PolicyDisabled {
+		return conn, err
+	}
+	conn.SetDeadline(time.Now().Add(opts.handshakeTimeout()))
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	encrypted, err := mse.Initiate(conn, infoHash, policy.Provide())
+	if !stop() {
+		return nil, ctx.Err()
+	}
+	if err == nil {
+		conn.SetDeadline(time.Time{})
+		return encrypted, nil
+	}
+	conn.Close()
+	if policy == mse.PolicyRequired {
+		return nil, fmt.Errorf("encrypted handshake with %s failed: %w", peer.String(), err)
+	}
+	return dialer.DialPeer(ctx, peer)
 }
-func completeHandshake(conn net.Conn, infoHash, peerID [20]byte) (*handshake.Handshake, error) {
-	conn.SetDeadline(time.Now().Add(time.Second * 3))
+
+func completeHandshake(conn net.Conn, req *handshake.Handshake, timeout time.Duration) (*handshake.Handshake, error) {
+	conn.SetDeadline(time.Now().Add(timeout))
 	defer conn.SetDeadline(time.Time{})
 
-	req := handshake.New(infoHash, peerID)
 	_, err := conn.Write(req.Serialize())
 	if err != nil {
 		return nil, err
@@ -58,14 +225,14 @@ func completeHandshake(conn net.Conn, infoHash, peerID [20]byte) (*handshake.Han
 	if err != nil {
 		return nil, err
 	}
-	if !bytes.Equal(res.InfoHash[:], infoHash[:]) {
-		return nil, fmt.Errorf("expected infohash %x but got %x", res.InfoHash, infoHash)
+	if !bytes.Equal(res.InfoHash[:], req.InfoHash[:]) {
+		return nil, fmt.Errorf("expected infohash %x but got %x", req.InfoHash, res.InfoHash)
 	}
 	return res, nil
 }
 
-func receiveBitField(conn net.Conn) (bitfield.Bitfield, error) {
-	conn.SetDeadline(time.Now().Add(time.Second * 5))
+func receiveBitField(conn net.Conn, timeout time.Duration) (bitfield.Bitfield, error) {
+	conn.SetDeadline(time.Now().Add(timeout))
 	defer conn.SetDeadline(time.Time{})
 
 	msg, err := message.Read(conn)
@@ -83,6 +250,20 @@ func receiveBitField(conn net.Conn) (bitfield.Bitfield, error) {
 	return msg.Payload, nil
 }
 
+// SendHashes answers a hash request of the peer
+func (c *Client) SendHashes(req message.HashRequest, hashes [][32]byte) error {
+	msg := message.FormatHashes(req, hashes)
+	_, err := c.Conn.Write(msg.Serialize())
+	return err
+}
+
+// SendHashReject refuses a hash request of the peer
+func (c *Client) SendHashReject(req message.HashRequest) error {
+	msg := message.FormatHashReject(req)
+	_, err := c.Conn.Write(msg.Serialize())
+	return err
+}
+
 // SendInterested sends an Interested message to the peer
 func (c *Client) SendInterested() error {
 	msg := message.Message{ID: message.MsgInterested}
@@ -109,6 +290,13 @@ func (c *Client) SendHave(index int) error {
 	return err
 }
 
+// SetRequestsPending tells whether block requests are waiting for an
+// answer. Reads then time out after Options.RequestTimeout of silence,
+// otherwise after Options.IdleTimeout.
+func (c *Client) SetRequestsPending(pending bool) {
+	c.live.pending.Store(pending)
+}
+
 func (c *Client) Read() (*message.Message, error) {
 	msg, err := message.Read(c.Conn)
 	return msg, err
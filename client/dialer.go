@@ -0,0 +1,147 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/souravbiswassanto/bit-torrent-client/peers"
+	"github.com/souravbiswassanto/bit-torrent-client/proxy"
+	"github.com/souravbiswassanto/bit-torrent-client/utp"
+)
+
+// Dialer opens the transport connection to a peer, before encryption and
+// the BitTorrent handshake
+type Dialer interface {
+	DialPeer(ctx context.Context, peer peers.Peer) (net.Conn, error)
+}
+
+// TCPDialer connects to peers over TCP
+type TCPDialer struct {
+	// Network is "tcp", "tcp4" or "tcp6", "tcp" if empty
+	Network string
+	// Timeout bounds connecting, DefaultDialTimeout if zero
+	Timeout time.Duration
+}
+
+// DialPeer implements Dialer
+func (d TCPDialer) DialPeer(ctx context.Context, peer peers.Peer) (net.Conn, error) {
+	network := d.Network
+	if network == "" {
+		network = "tcp"
+	}
+	nd := net.Dialer{Timeout: orDefault(d.Timeout, DefaultDialTimeout)}
+	return nd.DialContext(ctx, network, peer.String())
+}
+
+// UTPDialer connects to peers over uTP from a shared socket
+type UTPDialer struct {
+	Socket *utp.Socket
+	// Timeout bounds connecting, DefaultDialTimeout if zero
+	Timeout time.Duration
+}
+
+// DialPeer implements Dialer
+func (d UTPDialer) DialPeer(ctx context.Context, peer peers.Peer) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, orDefault(d.Timeout, DefaultDialTimeout))
+	defer cancel()
+	return d.Socket.DialContext(ctx, peer.String())
+}
+
+// ProxyDialer connects to peers over TCP through a proxy
+type ProxyDialer struct {
+	Proxy *proxy.Dialer
+	// Timeout bounds connecting, DefaultDialTimeout if zero
+	Timeout time.Duration
+}
+
+// DialPeer implements Dialer
+func (d ProxyDialer) DialPeer(ctx context.Context, peer peers.Peer) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, orDefault(d.Timeout, DefaultDialTimeout))
+	defer cancel()
+	return d.Proxy.DialContext(ctx, "tcp", peer.String())
+}
+
+// FallbackDialer tries its dialers in turn until one connects
+type FallbackDialer []Dialer
+
+// DialPeer implements Dialer and returns the last dialer's error
+func (ds FallbackDialer) DialPeer(ctx context.Context, peer peers.Peer) (net.Conn, error) {
+	err := errors.New("no dialer")
+	for _, d := range ds {
+		var conn net.Conn
+		conn, err = d.DialPeer(ctx, peer)
+		if err == nil || ctx.Err() != nil {
+			return conn, err
+		}
+	}
+	return nil, err
+}
+
+// RaceDialer dials with all of its dialers at once and keeps the first
+// connection, the slower ones are cancelled or closed
+type RaceDialer []Dialer
+
+// DialPeer implements Dialer and returns the last error if none connects
+func (ds RaceDialer) DialPeer(ctx context.Context, peer peers.Peer) (net.Conn, error) {
+	if len(ds) == 0 {
+		return nil, errors.New("no dialer")
+	}
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	results := make(chan result, len(ds))
+	for _, d := range ds {
+		go func(d Dialer) {
+			conn, err := d.DialPeer(ctx, peer)
+			results <- result{conn, err}
+		}(d)
+	}
+	var err error
+	for i := range ds {
+		r := <-results
+		if r.err != nil {
+			err = r.err
+			continue
+		}
+		cancel()
+		// the slower transports are not needed anymore
+		go func(pending int) {
+			for ; pending > 0; pending-- {
+				if r := <-results; r.err == nil {
+					r.conn.Close()
+				}
+			}
+		}(len(ds) - i - 1)
+		return r.conn, nil
+	}
+	cancel()
+	return nil, err
+}
+
+// dialer returns opts.Dialer, or the TCP and uTP dialers described by the
+// other options
+func (o Options) dialer() Dialer {
+	if o.Dialer != nil {
+		return o.Dialer
+	}
+	tcp := TCPDialer{Network: o.Network, Timeout: o.DialTimeout}
+	if o.UTP == nil {
+		return tcp
+	}
+	u := UTPDialer{Socket: o.UTP, Timeout: o.DialTimeout}
+	if o.PreferUTP {
+		return FallbackDialer{u, tcp}
+	}
+	return RaceDialer{tcp, u}
+}
+
+func orDefault(d, def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return d
+}
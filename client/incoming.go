@@ -0,0 +1,96 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/souravbiswassanto/bit-torrent-client/bitfield"
+	"github.com/souravbiswassanto/bit-torrent-client/handshake"
+	"github.com/souravbiswassanto/bit-torrent-client/message"
+	"github.com/souravbiswassanto/bit-torrent-client/mse"
+	"github.com/souravbiswassanto/bit-torrent-client/peerid"
+	"github.com/souravbiswassanto/bit-torrent-client/peers"
+	"github.com/souravbiswassanto/bit-torrent-client/ratelimit"
+)
+
+// Incoming is a connection a peer opened to us whose handshake was read
+// but not answered yet. Its Handshake tells the torrent the peer wants,
+// the caller then either answers it or closes it.
+type Incoming struct {
+	Handshake *handshake.Handshake
+	Peer      peers.Peer
+	conn      net.Conn
+}
+
+// Accept negotiates stream encryption on conn according to
+// opts.Encryption and reads the peer's handshake. skeys are the info
+// hashes an encrypted peer may ask for. conn is closed if Accept fails.
+func Accept(conn net.Conn, skeys [][20]byte, opts Options) (*Incoming, error) {
+	peer, err := remotePeer(conn.RemoteAddr())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(opts.handshakeTimeout()))
+	encrypted, err := mse.Accept(conn, skeys, opts.Encryption)
+	if err != nil {
+		conn.Close()
+		handshakeFailures.With("encryption").Inc()
+		return nil, err
+	}
+	conn = ratelimit.Conn(encrypted, opts.DownloadLimit, opts.UploadLimit)
+	hs, err := handshake.Read(conn)
+	if err != nil {
+		conn.Close()
+		handshakeFailures.With("handshake").Inc()
+		return nil, err
+	}
+	return &Incoming{Handshake: hs, Peer: peer, conn: conn}, nil
+}
+
+// Answer completes the handshake for a torrent of the given number of
+// pieces. We have nothing to serve, so the bitfield we send is empty,
+// and like New it waits for the bitfield of the peer.
+func (in *Incoming) Answer(peerID [20]byte, pieces int, opts Options) (*Client, error) {
+	conn := in.conn
+	infoHash := in.Handshake.InfoHash
+	if c := peerid.Parse(in.Handshake.PeerID); c.Matches(opts.BlockClients) {
+		conn.Close()
+		handshakeFailures.With("blocked").Inc()
+		return nil, fmt.Errorf("%w: %s", ErrBlockedClient, c)
+	}
+	conn.SetDeadline(time.Now().Add(opts.handshakeTimeout()))
+	msg := message.Message{ID: message.MsgBitfield, Payload: bitfield.New(pieces)}
+	_, err := conn.Write(append(opts.handshake(infoHash, peerID).Serialize(), msg.Serialize()...))
+	if err != nil {
+		conn.Close()
+		handshakeFailures.With("handshake").Inc()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	bf, err := receiveBitField(conn, opts.handshakeTimeout())
+	if err != nil {
+		conn.Close()
+		handshakeFailures.With("bitfield").Inc()
+		return nil, err
+	}
+	return newClient(conn, bf, in.Handshake.PeerID, in.Peer, infoHash, opts), nil
+}
+
+// Close refuses the connection
+func (in *Incoming) Close() error {
+	return in.conn.Close()
+}
+
+// remotePeer returns the address a peer connected to us from
+func remotePeer(addr net.Addr) (peers.Peer, error) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return peers.Peer{IP: a.IP, Port: uint16(a.Port)}, nil
+	case *net.UDPAddr:
+		return peers.Peer{IP: a.IP, Port: uint16(a.Port)}, nil
+	}
+	return peers.Peer{}, errors.New("unsupported remote address " + addr.String())
+}
@@ -0,0 +1,89 @@
+package client
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/souravbiswassanto/bit-torrent-client/message"
+)
+
+// liveConn keeps a peer connection alive and notices when the peer went
+// silent. A goroutine sends keep-alives when nothing else was written for
+// keepAliveInterval, and every read fails once the peer sent nothing for
+// the read timeout, which is relative to the last bytes received.
+type liveConn struct {
+	net.Conn
+	keepAliveInterval time.Duration
+	idleTimeout       time.Duration
+	requestTimeout    time.Duration
+
+	// mu keeps keep-alives from interleaving with other messages
+	mu       sync.Mutex
+	lastSent atomic.Int64
+	// pending is set while block requests are unanswered, the peer then
+	// gets requestTimeout rather than idleTimeout to send something
+	pending atomic.Bool
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newLiveConn(conn net.Conn, keepAlive, idleTimeout, requestTimeout time.Duration) *liveConn {
+	c := &liveConn{
+		Conn:              conn,
+		keepAliveInterval: keepAlive,
+		idleTimeout:       idleTimeout,
+		requestTimeout:    requestTimeout,
+		closed:            make(chan struct{}),
+	}
+	c.lastSent.Store(time.Now().UnixNano())
+	go c.keepAlive()
+	return c
+}
+
+func (c *liveConn) Read(p []byte) (int, error) {
+	timeout := c.idleTimeout
+	if c.pending.Load() {
+		timeout = c.requestTimeout
+	}
+	c.Conn.SetReadDeadline(time.Now().Add(timeout))
+	return c.Conn.Read(p)
+}
+
+// Write fails if the peer doesn't take the data within the idle timeout
+func (c *liveConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Conn.SetWriteDeadline(time.Now().Add(c.idleTimeout))
+	n, err := c.Conn.Write(p)
+	c.lastSent.Store(time.Now().UnixNano())
+	return n, err
+}
+
+func (c *liveConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+func (c *liveConn) keepAlive() {
+	timer := time.NewTimer(c.keepAliveInterval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-c.closed:
+			return
+		}
+		quiet := time.Since(time.Unix(0, c.lastSent.Load()))
+		if quiet >= c.keepAliveInterval {
+			var keepAlive *message.Message
+			if _, err := c.Write(keepAlive.Serialize()); err != nil {
+				return
+			}
+			quiet = 0
+		}
+		timer.Reset(c.keepAliveInterval - quiet)
+	}
+}
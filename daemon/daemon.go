@@ -0,0 +1,506 @@
+package daemon
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/souravbiswassanto/bit-torrent-client/metrics"
+	"github.com/souravbiswassanto/bit-torrent-client/session"
+	tf "github.com/souravbiswassanto/bit-torrent-client/torrentfile"
+)
+
+// maxTorrentSize caps uploaded and fetched .torrent files
+const maxTorrentSize = 10 << 20
+
+// Server exposes a session over an HTTP/JSON API:
+//
+//	GET    /api/torrents                  list the torrents
+//	POST   /api/torrents                  add a torrent, see add
+//	GET    /api/torrents/<hash>           status of one torrent
+//	DELETE /api/torrents/<hash>           remove it, ?delete-data=true deletes its files
+//	POST   /api/torrents/<hash>/pause     pause it
+//	POST   /api/torrents/<hash>/resume    resume it
+//	PUT    /api/torrents/<hash>/priorities  {"<file index>": "skip|normal|high"}
+//	GET    /api/limits                    the bandwidth limits in bytes per second
+//	PUT    /api/limits                    {"download": n, "upload": n}
+//	GET    /api/events                    stream of events (text/event-stream)
+//
+// Requests other than GET must carry the X-Transmission-Session-Id of the
+// Transmission RPC, handed out with a 409 response like there, or a
+// content type such as application/json or application/x-bittorrent that
+// a cross-site form cannot send.
+//
+// It also speaks the Transmission RPC protocol on /transmission/rpc and
+// serves Prometheus metrics on /metrics.
+type Server struct {
+	Session *session.Session
+	// DataDir is where torrents are downloaded to
+	DataDir string
+	// HTTPClient fetches torrents added by URL
+	HTTPClient *http.Client
+
+	transmission *transmission
+	metrics      http.Handler
+}
+
+// New returns a server for s downloading into dataDir
+func New(s *session.Session, dataDir string) *Server {
+	return &Server{
+		Session:      s,
+		DataDir:      dataDir,
+		HTTPClient:   &http.Client{Timeout: 30 * time.Second},
+		transmission: newTransmission(s),
+		metrics:      metrics.Handler(sessionMetrics(s)...),
+	}
+}
+
+// Torrent is the JSON form of a session.Status
+type Torrent struct {
+	InfoHash     string  `json:"info_hash"`
+	Name         string  `json:"name"`
+	Path         string  `json:"path"`
+	State        string  `json:"state"`
+	Error        string  `json:"error,omitempty"`
+	Percent      float64 `json:"percent"`
+	PiecesDone   int     `json:"pieces_done"`
+	PiecesTotal  int     `json:"pieces_total"`
+	BytesDone    int     `json:"bytes_done"`
+	BytesTotal   int     `json:"bytes_total"`
+	Downloaded   int64   `json:"downloaded"`
+	Uploaded     int64   `json:"uploaded"`
+	DownloadRate float64 `json:"download_rate"`
+	UploadRate   float64 `json:"upload_rate"`
+	Peers        int     `json:"peers"`
+	PeersTotal   int     `json:"peers_total"`
+	ETA          float64 `json:"eta_seconds"`
+	Files        []File  `json:"files"`
+	PeerList     []Peer  `json:"peer_list"`
+}
+
+// Peer is the JSON form of a connected p2p.PeerInfo
+type Peer struct {
+	Address string `json:"address"`
+	Client  string `json:"client"`
+}
+
+// File is the JSON form of a session.FileStatus. Index is the one used to
+// change its priority, pad files are left out.
+type File struct {
+	Index    int    `json:"index"`
+	Path     string `json:"path"`
+	Length   int    `json:"length"`
+	Priority string `json:"priority"`
+}
+
+// Limits are the session's bandwidth limits in bytes per second
+type Limits struct {
+	Download int `json:"download"`
+	Upload   int `json:"upload"`
+}
+
+// Event is the JSON form of a session.Event
+type Event struct {
+	Type    string  `json:"type"`
+	Torrent Torrent `json:"torrent"`
+}
+
+func toJSON(st session.Status) Torrent {
+	p := st.Progress
+	t := Torrent{
+		InfoHash:     hex.EncodeToString(st.InfoHash[:]),
+		Name:         st.Name,
+		Path:         st.Path,
+		State:        st.State.String(),
+		Percent:      p.Percent(),
+		PiecesDone:   p.PiecesDone,
+		PiecesTotal:  p.PiecesTotal,
+		BytesDone:    p.BytesDone,
+		BytesTotal:   p.BytesTotal,
+		Downloaded:   p.Downloaded,
+		Uploaded:     p.Uploaded,
+		DownloadRate: p.DownloadRate,
+		UploadRate:   p.UploadRate,
+		Peers:        p.Peers,
+		PeersTotal:   p.PeersTotal,
+		ETA:          p.ETA.Seconds(),
+		Files:        []File{},
+		PeerList:     []Peer{},
+	}
+	if st.Err != nil {
+		t.Error = st.Err.Error()
+	}
+	for _, peer := range p.Connected {
+		t.PeerList = append(t.PeerList, Peer{Address: peer.Addr.String(), Client: peer.Client.String()})
+	}
+	for i, f := range st.Files {
+		if f.Padding {
+			continue
+		}
+		t.Files = append(t.Files, File{
+			Index:    i,
+			Path:     strings.Join(f.Path, "/"),
+			Length:   f.Length,
+			Priority: f.Priority.String(),
+		})
+	}
+	return t
+}
+
+// errCrossSite is returned for requests that could come from a form or
+// script of another site
+var errCrossSite = errors.New("missing session id or non-form content type")
+
+func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	parts := strings.Split(path, "/")
+	if parts[0] == "api" && !srv.sameSite(r) {
+		w.Header().Set(sessionIDHeader, srv.transmission.sessionID)
+		writeError(w, http.StatusConflict, errCrossSite)
+		return
+	}
+	switch {
+	case path == "api/torrents":
+		switch r.Method {
+		case http.MethodGet:
+			srv.list(w, r)
+		case http.MethodPost:
+			srv.add(w, r)
+		default:
+			methodNotAllowed(w, "GET, POST")
+		}
+	case len(parts) == 3 && parts[0] == "api" && parts[1] == "torrents":
+		switch r.Method {
+		case http.MethodGet:
+			srv.get(w, r, parts[2])
+		case http.MethodDelete:
+			srv.remove(w, r, parts[2])
+		default:
+			methodNotAllowed(w, "GET, DELETE")
+		}
+	case len(parts) == 4 && parts[0] == "api" && parts[1] == "torrents":
+		srv.action(w, r, parts[2], parts[3])
+	case path == "api/limits":
+		srv.limits(w, r)
+	case path == "api/events":
+		srv.events(w, r)
+	case path == "transmission/rpc":
+		srv.transmissionRPC(w, r)
+	case path == "metrics":
+		srv.metrics.ServeHTTP(w, r)
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("no such endpoint"))
+	}
+}
+
+// sameSite reports whether r, if it changes state, cannot have been sent
+// by a page of another site. Browsers only send a page's requests to
+// other sites without asking them first if their content type is one a
+// form can have, and no other site knows the session id. GET and HEAD
+// requests change nothing.
+func (srv *Server) sameSite(r *http.Request) bool {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return true
+	}
+	if r.Header.Get(sessionIDHeader) == srv.transmission.sessionID {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	switch mediaType {
+	case "application/x-www-form-urlencoded", "multipart/form-data", "text/plain":
+		return false
+	}
+	return true
+}
+
+func (srv *Server) list(w http.ResponseWriter, r *http.Request) {
+	torrents := []Torrent{}
+	for _, st := range srv.Session.List() {
+		torrents = append(torrents, toJSON(st))
+	}
+	writeJSON(w, http.StatusOK, torrents)
+}
+
+// addRequest is the JSON body adding a torrent by URL or magnet link
+type addRequest struct {
+	URL    string `json:"url"`
+	Magnet string `json:"magnet"`
+}
+
+// add accepts a .torrent as the request body (application/x-bittorrent),
+// as the "torrent" field of a multipart form, which needs the session id,
+// or a JSON addRequest
+func (srv *Server) add(w http.ResponseWriter, r *http.Request) {
+	data, status, err := srv.readTorrent(r)
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+	st, err := srv.AddTorrent(data, "")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, toJSON(st))
+}
+
+// AddTorrent parses a .torrent and adds it to the session, downloading
+// into dir or DataDir if dir is empty
+func (srv *Server) AddTorrent(data []byte, dir string) (session.Status, error) {
+	t, err := tf.Parse(data)
+	if err != nil {
+		return session.Status{}, err
+	}
+	if dir == "" {
+		dir = srv.DataDir
+	}
+	err = srv.Session.Add(t, filepath.Join(dir, t.StorageName()))
+	if err != nil {
+		return session.Status{}, err
+	}
+	return srv.Session.Status(t.InfoHash)
+}
+
+// FetchTorrent downloads a .torrent file from an http or https URL
+func (srv *Server) FetchTorrent(url string) ([]byte, error) {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil, fmt.Errorf("unsupported torrent url %q", url)
+	}
+	resp, err := srv.HTTPClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", url, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxTorrentSize))
+}
+
+// errMagnet is returned for magnet links, which need the metadata exchange
+// of BEP 9 to become a torrent
+var errMagnet = errors.New("magnet links are not supported, the client cannot fetch metadata from peers")
+
+func (srv *Server) readTorrent(r *http.Request) ([]byte, int, error) {
+	contentType := r.Header.Get("Content-Type")
+	switch {
+	case strings.HasPrefix(contentType, "multipart/form-data"):
+		err := r.ParseMultipartForm(maxTorrentSize)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		file, _, err := r.FormFile("torrent")
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		defer file.Close()
+		data, err := io.ReadAll(io.LimitReader(file, maxTorrentSize))
+		return data, http.StatusBadRequest, err
+	case strings.HasPrefix(contentType, "application/json"):
+		var req addRequest
+		err := json.NewDecoder(io.LimitReader(r.Body, maxTorrentSize)).Decode(&req)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		switch {
+		case req.Magnet != "":
+			return nil, http.StatusNotImplemented, errMagnet
+		case req.URL != "":
+			data, err := srv.FetchTorrent(req.URL)
+			return data, http.StatusBadGateway, err
+		default:
+			return nil, http.StatusBadRequest, fmt.Errorf("url or magnet is required")
+		}
+	default:
+		data, err := io.ReadAll(io.LimitReader(r.Body, maxTorrentSize))
+		return data, http.StatusBadRequest, err
+	}
+}
+
+func (srv *Server) get(w http.ResponseWriter, r *http.Request, hash string) {
+	infoHash, err := parseHash(hash)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	st, err := srv.Session.Status(infoHash)
+	if err != nil {
+		writeSessionError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toJSON(st))
+}
+
+func (srv *Server) remove(w http.ResponseWriter, r *http.Request, hash string) {
+	infoHash, err := parseHash(hash)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	deleteData, _ := strconv.ParseBool(r.URL.Query().Get("delete-data"))
+	err = srv.Session.Remove(infoHash, deleteData)
+	if err != nil {
+		writeSessionError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (srv *Server) action(w http.ResponseWriter, r *http.Request, hash, action string) {
+	infoHash, err := parseHash(hash)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	switch action {
+	case "pause", "resume":
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, "POST")
+			return
+		}
+		if action == "pause" {
+			err = srv.Session.Pause(infoHash)
+		} else {
+			err = srv.Session.Resume(infoHash)
+		}
+	case "priorities":
+		if r.Method != http.MethodPut {
+			methodNotAllowed(w, "PUT")
+			return
+		}
+		var req map[string]string
+		err = json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		priorities := make(map[int]session.Priority)
+		for index, name := range req {
+			i, err := strconv.Atoi(index)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid file index %q", index))
+				return
+			}
+			priorities[i], err = session.ParsePriority(name)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+		err = srv.Session.SetPriorities(infoHash, priorities)
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("no such endpoint"))
+		return
+	}
+	if err != nil {
+		writeSessionError(w, err)
+		return
+	}
+	srv.get(w, r, hash)
+}
+
+func (srv *Server) limits(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req Limits
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if req.Download < 0 || req.Upload < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("limits must not be negative"))
+			return
+		}
+		srv.Session.SetLimits(req.Download, req.Upload)
+	default:
+		methodNotAllowed(w, "GET, PUT")
+		return
+	}
+	down, up := srv.Session.Limits()
+	writeJSON(w, http.StatusOK, Limits{Download: down, Upload: up})
+}
+
+// events streams the session's events as server-sent events until the
+// client goes away
+func (srv *Server) events(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("streaming is not supported"))
+		return
+	}
+	events, cancel := srv.Session.Subscribe()
+	defer cancel()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(Event{Type: string(ev.Type), Torrent: toJSON(ev.Status)})
+			if err != nil {
+				return
+			}
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func parseHash(s string) ([20]byte, error) {
+	var hash [20]byte
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(hash) {
+		return hash, fmt.Errorf("invalid info hash %q", s)
+	}
+	copy(hash[:], b)
+	return hash, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func writeSessionError(w http.ResponseWriter, err error) {
+	if errors.Is(err, session.ErrUnknownTorrent) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeError(w, http.StatusBadRequest, err)
+}
+
+func methodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+}
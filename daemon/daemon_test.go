@@ -0,0 +1,164 @@
+package daemon
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/souravbiswassanto/bit-torrent-client/bencode"
+	"github.com/souravbiswassanto/bit-torrent-client/config"
+	"github.com/souravbiswassanto/bit-torrent-client/session"
+	tf "github.com/souravbiswassanto/bit-torrent-client/torrentfile"
+)
+
+// newTestServer runs a daemon over a fresh session on a free port
+func newTestServer(t *testing.T) (*Server, *httptest.Server) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Default()
+	cfg.Port = uint16(ln.Addr().(*net.TCPAddr).Port)
+	ln.Close()
+	s, err := session.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	srv := New(s, t.TempDir())
+	ts := httptest.NewServer(srv)
+	t.Cleanup(ts.Close)
+	return srv, ts
+}
+
+// testTorrent encodes a single file torrent with the given name whose
+// tracker refuses connections
+func testTorrent(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := bencode.Marshal(map[string]interface{}{
+		"announce": "http://127.0.0.1:1/announce",
+		"info": map[string]interface{}{
+			"name":         name,
+			"length":       1,
+			"piece length": 16384,
+			"pieces":       strings.Repeat("x", 20),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestAddTorrentStorageName(t *testing.T) {
+	srv, _ := newTestServer(t)
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"file.iso", "file.iso"},
+		{"", ""},
+		{".", ""},
+		{"..", ""},
+		{"../escape", ""},
+	}
+	for _, tt := range tests {
+		data := testTorrent(t, tt.name)
+		torrent, err := tf.Parse(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := tt.want
+		if want == "" {
+			want = hex.EncodeToString(torrent.InfoHash[:])
+		}
+		st, err := srv.AddTorrent(data, "")
+		if err != nil {
+			t.Fatalf("AddTorrent(%q): %v", tt.name, err)
+		}
+		if st.Path != filepath.Join(srv.DataDir, want) {
+			t.Errorf("torrent named %q stored at %s, want %s", tt.name, st.Path, filepath.Join(srv.DataDir, want))
+		}
+	}
+}
+
+func TestCrossSiteRequests(t *testing.T) {
+	srv, ts := newTestServer(t)
+	torrent := testTorrent(t, "file.iso")
+	parsed, err := tf.Parse(torrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrentURL := ts.URL + "/api/torrents/" + hex.EncodeToString(parsed.InfoHash[:])
+
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	fw, _ := mw.CreateFormFile("torrent", "file.torrent")
+	fw.Write(torrent)
+	mw.Close()
+
+	tests := []struct {
+		name        string
+		method      string
+		url         string
+		contentType string
+		body        []byte
+		sessionID   bool
+		want        int
+	}{
+		{"text/plain add", http.MethodPost, ts.URL + "/api/torrents", "text/plain", torrent, false, http.StatusConflict},
+		{"form add", http.MethodPost, ts.URL + "/api/torrents", mw.FormDataContentType(), form.Bytes(), false, http.StatusConflict},
+		{"add without content type", http.MethodPost, ts.URL + "/api/torrents", "", torrent, false, http.StatusConflict},
+		{"form pause", http.MethodPost, torrentURL + "/pause", "application/x-www-form-urlencoded", nil, false, http.StatusConflict},
+		{"list", http.MethodGet, ts.URL + "/api/torrents", "", nil, false, http.StatusOK},
+		{"form add with session id", http.MethodPost, ts.URL + "/api/torrents", mw.FormDataContentType(), form.Bytes(), true, http.StatusCreated},
+		{"delete", http.MethodDelete, torrentURL + "?delete-data=true", "", nil, false, http.StatusConflict},
+		{"form pause with session id", http.MethodPost, torrentURL + "/pause", "text/plain", nil, true, http.StatusOK},
+		{"json limits", http.MethodPut, ts.URL + "/api/limits", "application/json", []byte(`{"download": 0, "upload": 0}`), false, http.StatusOK},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, tt.url, bytes.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+		if tt.sessionID {
+			req.Header.Set(sessionIDHeader, srv.transmission.sessionID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, resp.StatusCode, tt.want)
+		}
+		if resp.StatusCode == http.StatusConflict && resp.Header.Get(sessionIDHeader) != srv.transmission.sessionID {
+			t.Errorf("%s: the 409 response does not carry the session id", tt.name)
+		}
+	}
+	// only the add with the session id went through
+	var torrents []Torrent
+	resp, err := http.Get(ts.URL + "/api/torrents")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(&torrents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(torrents) != 1 {
+		t.Errorf("session has %d torrents, want 1", len(torrents))
+	}
+}
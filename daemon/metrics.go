@@ -0,0 +1,43 @@
+package daemon
+
+import (
+	"encoding/hex"
+
+	"github.com/souravbiswassanto/bit-torrent-client/metrics"
+	"github.com/souravbiswassanto/bit-torrent-client/session"
+)
+
+// sessionMetrics returns the per torrent metrics of s, read from its
+// status whenever they are scraped
+func sessionMetrics(s *session.Session) []metrics.Family {
+	labels := []string{"info_hash", "name"}
+	collect := func(value func(session.Status) float64) func() []metrics.Sample {
+		return func() []metrics.Sample {
+			var samples []metrics.Sample
+			for _, st := range s.List() {
+				samples = append(samples, metrics.Sample{
+					Labels: []string{hex.EncodeToString(st.InfoHash[:]), st.Name},
+					Value:  value(st),
+				})
+			}
+			return samples
+		}
+	}
+	return []metrics.Family{
+		metrics.CounterFunc("bittorrent_torrent_downloaded_bytes_total",
+			"Bytes received from peers and web seeds, by torrent", labels,
+			collect(func(st session.Status) float64 { return float64(st.Progress.Downloaded) })),
+		metrics.CounterFunc("bittorrent_torrent_uploaded_bytes_total",
+			"Bytes sent to peers, by torrent", labels,
+			collect(func(st session.Status) float64 { return float64(st.Progress.Uploaded) })),
+		metrics.GaugeFunc("bittorrent_torrent_peers_connected",
+			"Connected peers, by torrent", labels,
+			collect(func(st session.Status) float64 { return float64(st.Progress.Peers) })),
+		metrics.GaugeFunc("bittorrent_torrent_verified_bytes",
+			"Bytes of the wanted pieces that passed the hash check, by torrent", labels,
+			collect(func(st session.Status) float64 { return float64(st.Progress.BytesDone) })),
+		metrics.GaugeFunc("bittorrent_torrent_wanted_bytes",
+			"Bytes of the wanted pieces, by torrent", labels,
+			collect(func(st session.Status) float64 { return float64(st.Progress.BytesTotal) })),
+	}
+}
@@ -0,0 +1,586 @@
+package daemon
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/souravbiswassanto/bit-torrent-client/mse"
+	"github.com/souravbiswassanto/bit-torrent-client/session"
+	tf "github.com/souravbiswassanto/bit-torrent-client/torrentfile"
+)
+
+// sessionIDHeader carries the token protecting the Transmission RPC and
+// the API against cross-site requests
+const sessionIDHeader = "X-Transmission-Session-Id"
+
+// Transmission torrent status codes
+const (
+	trStopped      = 0
+	trDownloadWait = 3
+	trDownloading  = 4
+)
+
+// trLocalError is the Transmission error code for local failures
+const trLocalError = 3
+
+// transmission keeps the state the Transmission protocol needs on top of
+// the session: numeric torrent ids and the speed limits, which Transmission
+// remembers while they are disabled.
+type transmission struct {
+	sessionID string
+	started   time.Time
+
+	mu     sync.Mutex
+	ids    map[[20]byte]int
+	nextID int
+	added  map[[20]byte]time.Time
+
+	downLimit, upLimit     int // KB/s
+	downEnabled, upEnabled bool
+}
+
+func newTransmission(s *session.Session) *transmission {
+	token := make([]byte, 24)
+	rand.Read(token)
+	down, up := s.Limits()
+	return &transmission{
+		sessionID:   base64.RawURLEncoding.EncodeToString(token),
+		started:     time.Now(),
+		ids:         make(map[[20]byte]int),
+		nextID:      1,
+		added:       make(map[[20]byte]time.Time),
+		downLimit:   down / 1000,
+		upLimit:     up / 1000,
+		downEnabled: down > 0,
+		upEnabled:   up > 0,
+	}
+}
+
+// id returns the numeric id of a torrent, assigning the next one the first
+// time a torrent is seen
+func (tr *transmission) id(hash [20]byte) int {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	id, ok := tr.ids[hash]
+	if !ok {
+		id = tr.nextID
+		tr.nextID++
+		tr.ids[hash] = id
+		tr.added[hash] = time.Now()
+	}
+	return id
+}
+
+type rpcRequest struct {
+	Method    string          `json:"method"`
+	Arguments json.RawMessage `json:"arguments"`
+	Tag       *int            `json:"tag,omitempty"`
+}
+
+type rpcResponse struct {
+	Result    string      `json:"result"`
+	Arguments interface{} `json:"arguments"`
+	Tag       *int        `json:"tag,omitempty"`
+}
+
+type rpcMethod func(srv *Server, args json.RawMessage) (interface{}, error)
+
+var rpcMethods = map[string]rpcMethod{
+	"session-get":       (*Server).rpcSessionGet,
+	"session-set":       (*Server).rpcSessionSet,
+	"session-stats":     (*Server).rpcSessionStats,
+	"torrent-add":       (*Server).rpcTorrentAdd,
+	"torrent-get":       (*Server).rpcTorrentGet,
+	"torrent-set":       (*Server).rpcTorrentSet,
+	"torrent-start":     (*Server).rpcTorrentStart,
+	"torrent-start-now": (*Server).rpcTorrentStart,
+	"torrent-stop":      (*Server).rpcTorrentStop,
+	"torrent-remove":    (*Server).rpcTorrentRemove,
+}
+
+// transmissionRPC implements the Transmission RPC protocol. Every request
+// must carry the session id handed out with a 409 response.
+func (srv *Server) transmissionRPC(w http.ResponseWriter, r *http.Request) {
+	tr := srv.transmission
+	if r.Header.Get(sessionIDHeader) != tr.sessionID {
+		w.Header().Set(sessionIDHeader, tr.sessionID)
+		http.Error(w, "invalid session id", http.StatusConflict)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req rpcRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp := rpcResponse{Result: "success", Arguments: struct{}{}, Tag: req.Tag}
+	method, ok := rpcMethods[req.Method]
+	if !ok {
+		resp.Result = "method name not recognized"
+	} else {
+		args, err := method(srv, req.Arguments)
+		if err != nil {
+			resp.Result = err.Error()
+		} else if args != nil {
+			resp.Arguments = args
+		}
+	}
+	w.Header().Set(sessionIDHeader, tr.sessionID)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func decodeArgs(raw json.RawMessage, v interface{}) error {
+	if len(raw) == 0 {
+		return nil
+	}
+	return json.Unmarshal(raw, v)
+}
+
+func (srv *Server) rpcSessionGet(raw json.RawMessage) (interface{}, error) {
+	tr := srv.transmission
+	cfg := srv.Session.Config()
+	encryption := "preferred"
+	switch cfg.Encryption {
+	case mse.PolicyRequired:
+		encryption = "required"
+	case mse.PolicyDisabled:
+		encryption = "tolerated"
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return map[string]interface{}{
+		"version":                  "3.00 (bit-torrent-client)",
+		"rpc-version":              15,
+		"rpc-version-minimum":      1,
+		"download-dir":             srv.DataDir,
+		"peer-port":                cfg.Port,
+		"peer-limit-global":        cfg.MaxPeers,
+		"peer-limit-per-torrent":   cfg.MaxPeersPerTorrent,
+		"encryption":               encryption,
+		"utp-enabled":              cfg.UseUTP,
+		"dht-enabled":              false,
+		"pex-enabled":              false,
+		"speed-limit-down":         tr.downLimit,
+		"speed-limit-down-enabled": tr.downEnabled,
+		"speed-limit-up":           tr.upLimit,
+		"speed-limit-up-enabled":   tr.upEnabled,
+		"units": map[string]interface{}{
+			"speed-units":  []string{"kB/s", "MB/s", "GB/s", "TB/s"},
+			"speed-bytes":  1000,
+			"size-units":   []string{"kB", "MB", "GB", "TB"},
+			"size-bytes":   1000,
+			"memory-units": []string{"KiB", "MiB", "GiB", "TiB"},
+			"memory-bytes": 1024,
+		},
+	}, nil
+}
+
+func (srv *Server) rpcSessionSet(raw json.RawMessage) (interface{}, error) {
+	var args struct {
+		DownLimit   *int  `json:"speed-limit-down"`
+		DownEnabled *bool `json:"speed-limit-down-enabled"`
+		UpLimit     *int  `json:"speed-limit-up"`
+		UpEnabled   *bool `json:"speed-limit-up-enabled"`
+	}
+	err := decodeArgs(raw, &args)
+	if err != nil {
+		return nil, err
+	}
+	tr := srv.transmission
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if args.DownLimit != nil {
+		tr.downLimit = *args.DownLimit
+	}
+	if args.DownEnabled != nil {
+		tr.downEnabled = *args.DownEnabled
+	}
+	if args.UpLimit != nil {
+		tr.upLimit = *args.UpLimit
+	}
+	if args.UpEnabled != nil {
+		tr.upEnabled = *args.UpEnabled
+	}
+	down, up := 0, 0
+	if tr.downEnabled {
+		down = tr.downLimit * 1000
+	}
+	if tr.upEnabled {
+		up = tr.upLimit * 1000
+	}
+	srv.Session.SetLimits(down, up)
+	return nil, nil
+}
+
+func (srv *Server) rpcSessionStats(raw json.RawMessage) (interface{}, error) {
+	var active, paused int
+	var downRate, upRate float64
+	var downloaded, uploaded int64
+	list := srv.Session.List()
+	for _, st := range list {
+		switch st.State {
+		case session.Queued, session.Downloading:
+			active++
+		default:
+			paused++
+		}
+		downRate += st.Progress.DownloadRate
+		upRate += st.Progress.UploadRate
+		downloaded += st.Progress.Downloaded
+		uploaded += st.Progress.Uploaded
+	}
+	stats := map[string]interface{}{
+		"uploadedBytes":   uploaded,
+		"downloadedBytes": downloaded,
+		"filesAdded":      len(list),
+		"sessionCount":    1,
+		"secondsActive":   int(time.Since(srv.transmission.started).Seconds()),
+	}
+	return map[string]interface{}{
+		"activeTorrentCount": active,
+		"pausedTorrentCount": paused,
+		"torrentCount":       len(list),
+		"downloadSpeed":      int(downRate),
+		"uploadSpeed":        int(upRate),
+		"cumulative-stats":   stats,
+		"current-stats":      stats,
+	}, nil
+}
+
+func (srv *Server) rpcTorrentAdd(raw json.RawMessage) (interface{}, error) {
+	var args struct {
+		Filename    string `json:"filename"`
+		Metainfo    string `json:"metainfo"`
+		DownloadDir string `json:"download-dir"`
+		Paused      bool   `json:"paused"`
+	}
+	err := decodeArgs(raw, &args)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	switch {
+	case args.Metainfo != "":
+		data, err = base64.StdEncoding.DecodeString(args.Metainfo)
+	case strings.HasPrefix(args.Filename, "magnet:"):
+		err = errMagnet
+	case args.Filename != "":
+		data, err = srv.FetchTorrent(args.Filename)
+	default:
+		err = fmt.Errorf("no filename or metainfo specified")
+	}
+	if err != nil {
+		return nil, err
+	}
+	t, err := tf.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	if existing, err := srv.Session.Status(t.InfoHash); err == nil {
+		return map[string]interface{}{"torrent-duplicate": srv.addedJSON(existing)}, nil
+	}
+	st, err := srv.AddTorrent(data, args.DownloadDir)
+	if err != nil {
+		return nil, err
+	}
+	if args.Paused {
+		srv.Session.Pause(st.InfoHash)
+	}
+	return map[string]interface{}{"torrent-added": srv.addedJSON(st)}, nil
+}
+
+func (srv *Server) addedJSON(st session.Status) map[string]interface{} {
+	return map[string]interface{}{
+		"id":         srv.transmission.id(st.InfoHash),
+		"name":       st.Name,
+		"hashString": hex.EncodeToString(st.InfoHash[:]),
+	}
+}
+
+// torrentIDs is the "ids" argument: absent for every torrent, or a single
+// id, or a list of numeric ids and info hashes
+type torrentIDs struct {
+	IDs json.RawMessage `json:"ids"`
+}
+
+// selectTorrents returns the torrents matched by ids
+func (srv *Server) selectTorrents(ids json.RawMessage) ([]session.Status, error) {
+	list := srv.Session.List()
+	if len(ids) == 0 {
+		return list, nil
+	}
+	var values []interface{}
+	var single interface{}
+	err := json.Unmarshal(ids, &single)
+	if err != nil {
+		return nil, err
+	}
+	switch v := single.(type) {
+	case []interface{}:
+		values = v
+	case string:
+		if v == "recently-active" {
+			var active []session.Status
+			for _, st := range list {
+				if st.State == session.Queued || st.State == session.Downloading {
+					active = append(active, st)
+				}
+			}
+			return active, nil
+		}
+		values = []interface{}{v}
+	default:
+		values = []interface{}{v}
+	}
+	var selected []session.Status
+	for _, st := range list {
+		id := srv.transmission.id(st.InfoHash)
+		hash := hex.EncodeToString(st.InfoHash[:])
+		for _, v := range values {
+			switch v := v.(type) {
+			case float64:
+				if int(v) == id {
+					selected = append(selected, st)
+				}
+			case string:
+				if strings.EqualFold(v, hash) {
+					selected = append(selected, st)
+				}
+			}
+		}
+	}
+	return selected, nil
+}
+
+func (srv *Server) rpcTorrentGet(raw json.RawMessage) (interface{}, error) {
+	var args struct {
+		torrentIDs
+		Fields []string `json:"fields"`
+	}
+	err := decodeArgs(raw, &args)
+	if err != nil {
+		return nil, err
+	}
+	selected, err := srv.selectTorrents(args.IDs)
+	if err != nil {
+		return nil, err
+	}
+	torrents := []map[string]interface{}{}
+	for _, st := range selected {
+		all := srv.torrentFields(st)
+		fields := make(map[string]interface{})
+		for _, name := range args.Fields {
+			if v, ok := all[name]; ok {
+				fields[name] = v
+			}
+		}
+		torrents = append(torrents, fields)
+	}
+	return map[string]interface{}{"torrents": torrents}, nil
+}
+
+// torrentFields returns the torrent-get fields we can answer for st
+func (srv *Server) torrentFields(st session.Status) map[string]interface{} {
+	p := st.Progress
+	status := trStopped
+	switch st.State {
+	case session.Queued:
+		status = trDownloadWait
+	case session.Downloading:
+		status = trDownloading
+	}
+	errCode, errString := 0, ""
+	if st.Err != nil {
+		errCode, errString = trLocalError, st.Err.Error()
+	}
+	eta := -1
+	if p.ETA > 0 {
+		eta = int(p.ETA.Seconds())
+	}
+	done := 0.0
+	if p.BytesTotal > 0 {
+		done = float64(p.BytesDone) / float64(p.BytesTotal)
+	}
+	if st.State == session.Done {
+		done = 1
+	}
+
+	var totalSize int
+	files := []map[string]interface{}{}
+	fileStats := []map[string]interface{}{}
+	wanted := []int{}
+	priorities := []int{}
+	for _, f := range st.Files {
+		totalSize += f.Length
+		// the session tracks pieces, not files, so completion is
+		// estimated from the torrent's progress
+		completed := 0
+		if f.Priority != session.PrioritySkip {
+			completed = int(float64(f.Length) * done)
+		}
+		isWanted := f.Priority != session.PrioritySkip
+		priority := 0
+		if f.Priority == session.PriorityHigh {
+			priority = 1
+		}
+		files = append(files, map[string]interface{}{
+			"name":           filepath.ToSlash(filepath.Join(append([]string{st.Name}, f.Path...)...)),
+			"length":         f.Length,
+			"bytesCompleted": completed,
+		})
+		fileStats = append(fileStats, map[string]interface{}{
+			"bytesCompleted": completed,
+			"wanted":         isWanted,
+			"priority":       priority,
+		})
+		wanted = append(wanted, boolInt(isWanted))
+		priorities = append(priorities, priority)
+	}
+
+	peerList := []map[string]interface{}{}
+	for _, peer := range p.Connected {
+		peerList = append(peerList, map[string]interface{}{
+			"address":    peer.Addr.IP.String(),
+			"port":       peer.Addr.Port,
+			"clientName": peer.Client.String(),
+		})
+	}
+
+	tr := srv.transmission
+	id := tr.id(st.InfoHash)
+	tr.mu.Lock()
+	added := tr.added[st.InfoHash]
+	tr.mu.Unlock()
+	return map[string]interface{}{
+		"id":             id,
+		"hashString":     hex.EncodeToString(st.InfoHash[:]),
+		"name":           st.Name,
+		"status":         status,
+		"error":          errCode,
+		"errorString":    errString,
+		"percentDone":    done,
+		"totalSize":      totalSize,
+		"sizeWhenDone":   p.BytesTotal,
+		"leftUntilDone":  p.BytesTotal - p.BytesDone,
+		"haveValid":      p.BytesDone,
+		"downloadedEver": p.Downloaded,
+		"uploadedEver":   p.Uploaded,
+		"rateDownload":   int(p.DownloadRate),
+		"rateUpload":     int(p.UploadRate),
+		"eta":            eta,
+		"peersConnected": p.Peers,
+		"peers":          peerList,
+		"downloadDir":    filepath.Dir(st.Path),
+		"isFinished":     st.State == session.Done,
+		"addedDate":      added.Unix(),
+		"queuePosition":  id,
+		"files":          files,
+		"fileStats":      fileStats,
+		"wanted":         wanted,
+		"priorities":     priorities,
+	}
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (srv *Server) rpcTorrentSet(raw json.RawMessage) (interface{}, error) {
+	var args struct {
+		torrentIDs
+		Wanted   []int `json:"files-wanted"`
+		Unwanted []int `json:"files-unwanted"`
+		High     []int `json:"priority-high"`
+		Normal   []int `json:"priority-normal"`
+		Low      []int `json:"priority-low"`
+	}
+	err := decodeArgs(raw, &args)
+	if err != nil {
+		return nil, err
+	}
+	selected, err := srv.selectTorrents(args.IDs)
+	if err != nil {
+		return nil, err
+	}
+	for _, st := range selected {
+		priorities := make(map[int]session.Priority)
+		set := func(files []int, p session.Priority, onlySkipped bool) {
+			for _, i := range files {
+				if onlySkipped && i >= 0 && i < len(st.Files) && st.Files[i].Priority != session.PrioritySkip {
+					continue
+				}
+				priorities[i] = p
+			}
+		}
+		// there is no low priority, low files are downloaded as normal
+		set(args.Low, session.PriorityNormal, false)
+		set(args.Normal, session.PriorityNormal, false)
+		set(args.High, session.PriorityHigh, false)
+		set(args.Wanted, session.PriorityNormal, true)
+		set(args.Unwanted, session.PrioritySkip, false)
+		if len(priorities) == 0 {
+			continue
+		}
+		err = srv.Session.SetPriorities(st.InfoHash, priorities)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+func (srv *Server) rpcTorrentStart(raw json.RawMessage) (interface{}, error) {
+	return srv.forEach(raw, srv.Session.Resume)
+}
+
+func (srv *Server) rpcTorrentStop(raw json.RawMessage) (interface{}, error) {
+	return srv.forEach(raw, srv.Session.Pause)
+}
+
+func (srv *Server) rpcTorrentRemove(raw json.RawMessage) (interface{}, error) {
+	var args struct {
+		DeleteData bool `json:"delete-local-data"`
+	}
+	err := decodeArgs(raw, &args)
+	if err != nil {
+		return nil, err
+	}
+	return srv.forEach(raw, func(hash [20]byte) error {
+		return srv.Session.Remove(hash, args.DeleteData)
+	})
+}
+
+func (srv *Server) forEach(raw json.RawMessage, fn func([20]byte) error) (interface{}, error) {
+	var args torrentIDs
+	err := decodeArgs(raw, &args)
+	if err != nil {
+		return nil, err
+	}
+	selected, err := srv.selectTorrents(args.IDs)
+	if err != nil {
+		return nil, err
+	}
+	for _, st := range selected {
+		err = fn(st.InfoHash)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
@@ -1,5 +1,3 @@
 module github.com/souravbiswassanto/bit-torrent-client
 
 go 1.21.6
-
-require github.com/jackpal/bencode-go v1.0.2
@@ -1,9 +1,17 @@
 package handshake
 
-import "io"
+import (
+	"errors"
+	"io"
+)
+
+// ReservedV2 is the bit in the last reserved byte announcing support for
+// BitTorrent v2 (BEP 52)
+const ReservedV2 = 0x10
 
 type Handshake struct {
 	Pstr     string
+	Reserved [8]byte
 	InfoHash [20]byte
 	PeerID   [20]byte
 }
@@ -21,7 +29,7 @@ func (h *Handshake) Serialize() []byte {
 	buf[0] = byte(len(h.Pstr))
 	idx := 1
 	idx += copy(buf[idx:], h.Pstr)
-	idx += copy(buf[idx:], make([]byte, 8))
+	idx += copy(buf[idx:], h.Reserved[:])
 	idx += copy(buf[idx:], h.InfoHash[:])
 	idx += copy(buf[idx:], h.PeerID[:])
 	return buf
@@ -35,15 +43,17 @@ func Read(r io.Reader) (*Handshake, error) {
 	}
 	pstrLen := int(pstrLenBuf[0])
 	if pstrLen == 0 {
-		return nil, err
+		return nil, errors.New("handshake: pstrlen cannot be 0")
 	}
 
 	response := make([]byte, pstrLen+48)
 	_, err = io.ReadFull(r, response)
 	if err != nil {
-		return nil, nil
+		return nil, err
 	}
 	pstr := string(response[:pstrLen])
+	var reserved [8]byte
+	copy(reserved[:], response[pstrLen:])
 	idx := pstrLen + 8
 	infoHash := make([]byte, 20)
 	peerID := make([]byte, 20)
@@ -51,7 +61,13 @@ func Read(r io.Reader) (*Handshake, error) {
 	idx += copy(peerID, response[idx:])
 	return &Handshake{
 		Pstr:     pstr,
+		Reserved: reserved,
 		InfoHash: [20]byte(infoHash),
 		PeerID:   [20]byte(peerID),
 	}, nil
 }
+
+// SupportsV2 reports whether the sender can upgrade a hybrid torrent to v2
+func (h *Handshake) SupportsV2() bool {
+	return h.Reserved[7]&ReservedV2 != 0
+}
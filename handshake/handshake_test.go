@@ -0,0 +1,60 @@
+package handshake
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func testHandshake() *Handshake {
+	var infoHash, peerID [20]byte
+	copy(infoHash[:], "info hash of a test!")
+	copy(peerID[:], "-GO0100-abcdefghijkl")
+	hs := New(infoHash, peerID)
+	hs.Reserved[7] = ReservedV2
+	return hs
+}
+
+func TestReadRoundTrip(t *testing.T) {
+	hs := testHandshake()
+	got, err := Read(bytes.NewReader(hs.Serialize()))
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if *got != *hs {
+		t.Errorf("Read = %+v, want %+v", got, hs)
+	}
+	if !got.SupportsV2() {
+		t.Error("SupportsV2 = false, want true")
+	}
+}
+
+func TestReadMalformed(t *testing.T) {
+	full := testHandshake().Serialize()
+	tests := []struct {
+		name  string
+		input []byte
+		// want is the error expected, nil for any error
+		want error
+	}{
+		{"empty", nil, io.EOF},
+		{"zero pstrlen", []byte{0}, nil},
+		{"truncated pstr", full[:10], io.ErrUnexpectedEOF},
+		{"truncated peer id", full[:len(full)-1], io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Read(bytes.NewReader(tt.input))
+			if err == nil {
+				t.Fatalf("Read = %+v, nil, want an error", got)
+			}
+			if got != nil {
+				t.Errorf("Read returned %+v along with error %v", got, err)
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("Read error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
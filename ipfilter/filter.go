@@ -0,0 +1,194 @@
+package ipfilter
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/souravbiswassanto/bit-torrent-client/metrics"
+	"github.com/souravbiswassanto/bit-torrent-client/peers"
+)
+
+var (
+	blockedPeers = metrics.NewCounter("bittorrent_ip_filter_blocked_total",
+		"Peer addresses refused by the IP filter")
+	filterRanges = metrics.NewGauge("bittorrent_ip_filter_ranges",
+		"Address ranges in the IP filter")
+)
+
+// Filter blocks the addresses listed in a set of files. The files can be
+// reloaded while the filter is in use, lookups see either the old or the
+// new list. A nil *Filter blocks nothing.
+type Filter struct {
+	paths []string
+	list  atomic.Pointer[List]
+
+	// mu serializes reloads
+	mu      sync.Mutex
+	modTime map[string]time.Time
+}
+
+// Open loads the lists at paths into one filter
+func Open(paths ...string) (*Filter, error) {
+	f := &Filter{paths: paths}
+	err := f.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload reads the files again. If one can't be read the filter keeps its
+// current list.
+func (f *Filter) Reload() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var b builder
+	modTime := make(map[string]time.Time)
+	for _, path := range f.paths {
+		err := f.readFile(&b, path, modTime)
+		if err != nil {
+			return fmt.Errorf("ip filter %s: %w", path, err)
+		}
+	}
+	l := b.list()
+	f.list.Store(l)
+	f.modTime = modTime
+	filterRanges.Set(int64(l.Len()))
+	if l.Invalid() > 0 {
+		log.Printf("IP filter: skipped %d malformed lines\n", l.Invalid())
+	}
+	return nil
+}
+
+func (f *Filter) readFile(b *builder, path string, modTime map[string]time.Time) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	modTime[path] = info.ModTime()
+	return b.read(file)
+}
+
+// changed reports whether a file was modified since it was read
+func (f *Filter) changed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, path := range f.paths {
+		info, err := os.Stat(path)
+		if err == nil && !info.ModTime().Equal(f.modTime[path]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch reloads the filter whenever one of its files changes, checking
+// every interval until ctx is done. Failed reloads are logged.
+func (f *Filter) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !f.changed() {
+				continue
+			}
+			err := f.Reload()
+			if err != nil {
+				log.Printf("Keeping the previous IP filter: %v\n", err)
+				continue
+			}
+			log.Printf("Reloaded the IP filter, %d ranges\n", f.Len())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Len returns the number of ranges blocked
+func (f *Filter) Len() int {
+	if f == nil {
+		return 0
+	}
+	return f.list.Load().Len()
+}
+
+// Blocked reports whether ip is blocked
+func (f *Filter) Blocked(ip net.IP) bool {
+	if f == nil {
+		return false
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok || !f.list.Load().Contains(addr) {
+		return false
+	}
+	blockedPeers.Inc()
+	return true
+}
+
+// Peers returns the peers that aren't blocked
+func (f *Filter) Peers(ps []peers.Peer) []peers.Peer {
+	if f == nil {
+		return ps
+	}
+	allowed := make([]peers.Peer, 0, len(ps))
+	for _, p := range ps {
+		if !f.Blocked(p.IP) {
+			allowed = append(allowed, p)
+		}
+	}
+	return allowed
+}
+
+// Listener wraps ln so that connections from blocked addresses are closed
+// as soon as they are accepted. A nil *Filter returns ln as is.
+func (f *Filter) Listener(ln net.Listener) net.Listener {
+	if f == nil {
+		return ln
+	}
+	return &listener{Listener: ln, filter: f}
+}
+
+type listener struct {
+	net.Listener
+	filter *Filter
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if !l.filter.Blocked(remoteIP(conn.RemoteAddr())) {
+			return conn, nil
+		}
+		conn.Close()
+	}
+}
+
+func remoteIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,244 @@
+// Package ipfilter blocks peers by IP address. Lists are read from files
+// in any mix of these formats, optionally gzip compressed:
+//
+//	001.009.096.105 - 001.009.096.105 , 000 , Some Org   eMule ipfilter.dat
+//	Some Org:1.9.96.105-1.9.96.105                       P2P plaintext
+//	10.0.0.0/8                                           CIDR
+//	192.0.2.1                                            single address
+//	192.0.2.1-192.0.2.9                                  range
+//
+// Blank lines and lines starting with # or // are ignored. ipfilter.dat
+// entries with an access level of 128 or more allow the range and are
+// skipped, as in eMule.
+package ipfilter
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// List is an immutable set of blocked address ranges. Ranges are merged
+// and sorted so a lookup is a binary search.
+type List struct {
+	v4 []span4
+	v6 []span6
+	// invalid counts the lines that could not be parsed
+	invalid int
+}
+
+type span4 struct {
+	first, last uint32
+}
+
+type span6 struct {
+	first, last netip.Addr
+}
+
+// Parse reads a list. Lines that aren't in any known format are skipped
+// and counted, see Invalid.
+func Parse(r io.Reader) (*List, error) {
+	var b builder
+	err := b.read(r)
+	if err != nil {
+		return nil, err
+	}
+	return b.list(), nil
+}
+
+// Len returns the number of ranges after merging
+func (l *List) Len() int {
+	return len(l.v4) + len(l.v6)
+}
+
+// Invalid returns the number of lines skipped as malformed
+func (l *List) Invalid() int {
+	return l.invalid
+}
+
+// Contains reports whether addr is in one of the ranges
+func (l *List) Contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if addr.Is4() {
+		u := v4(addr)
+		i := sort.Search(len(l.v4), func(i int) bool { return l.v4[i].last >= u })
+		return i < len(l.v4) && l.v4[i].first <= u
+	}
+	i := sort.Search(len(l.v6), func(i int) bool { return l.v6[i].last.Compare(addr) >= 0 })
+	return i < len(l.v6) && l.v6[i].first.Compare(addr) <= 0
+}
+
+func v4(addr netip.Addr) uint32 {
+	b := addr.As4()
+	return binary.BigEndian.Uint32(b[:])
+}
+
+// builder collects ranges from any number of readers
+type builder struct {
+	v4      []span4
+	v6      []span6
+	invalid int
+}
+
+// gzipMagic starts every gzip stream
+var gzipMagic = []byte{0x1f, 0x8b}
+
+func (b *builder) read(r io.Reader) error {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(len(gzipMagic))
+	if bytes.Equal(magic, gzipMagic) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		br = bufio.NewReader(zr)
+	}
+	scanner := bufio.NewScanner(br)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || strings.HasPrefix(line, "//") {
+			continue
+		}
+		first, last, block, err := parseLine(line)
+		switch {
+		case err != nil:
+			b.invalid++
+		case block:
+			b.add(first, last)
+		}
+	}
+	return scanner.Err()
+}
+
+var errSyntax = errors.New("unknown entry format")
+
+// parseLine returns the range of an entry and whether it is blocked. The
+// formats are tried in turn since descriptions may contain commas and
+// colons.
+func parseLine(line string) (first, last netip.Addr, block bool, err error) {
+	if rng, rest, ok := strings.Cut(line, ","); ok {
+		// ipfilter.dat: range, access level, description
+		level, _, _ := strings.Cut(rest, ",")
+		n, lerr := strconv.Atoi(strings.TrimSpace(level))
+		first, last, err = parseRange(rng)
+		if lerr == nil && err == nil {
+			return first, last, n < 128, nil
+		}
+	}
+	if prefix, err := netip.ParsePrefix(line); err == nil {
+		prefix = prefix.Masked()
+		return prefix.Addr(), lastAddr(prefix), true, nil
+	}
+	if addr, err := parseAddr(line); err == nil {
+		return addr, addr, true, nil
+	}
+	if first, last, err = parseRange(line); err == nil {
+		return first, last, true, nil
+	}
+	// P2P plaintext: description:range
+	i := strings.LastIndexByte(line, ':')
+	if i < 0 {
+		return first, last, false, errSyntax
+	}
+	first, last, err = parseRange(line[i+1:])
+	return first, last, true, err
+}
+
+// parseRange parses "first - last" of a single address family
+func parseRange(s string) (first, last netip.Addr, err error) {
+	a, b, ok := strings.Cut(s, "-")
+	if !ok {
+		return first, last, errSyntax
+	}
+	first, err = parseAddr(strings.TrimSpace(a))
+	if err != nil {
+		return first, last, err
+	}
+	last, err = parseAddr(strings.TrimSpace(b))
+	if err != nil {
+		return first, last, err
+	}
+	if first.Is4() != last.Is4() || first.Compare(last) > 0 {
+		return first, last, errSyntax
+	}
+	return first, last, nil
+}
+
+// parseAddr parses an address, allowing the zero padded IPv4 octets of
+// ipfilter.dat
+func parseAddr(s string) (netip.Addr, error) {
+	addr, err := netip.ParseAddr(s)
+	if err == nil {
+		return addr.Unmap(), nil
+	}
+	octets := strings.Split(s, ".")
+	if len(octets) != 4 {
+		return netip.Addr{}, err
+	}
+	var b [4]byte
+	for i, o := range octets {
+		n, perr := strconv.ParseUint(o, 10, 8)
+		if perr != nil {
+			return netip.Addr{}, err
+		}
+		b[i] = byte(n)
+	}
+	return netip.AddrFrom4(b), nil
+}
+
+// lastAddr returns the highest address of a masked prefix
+func lastAddr(p netip.Prefix) netip.Addr {
+	b := p.Addr().AsSlice()
+	for bit := p.Bits(); bit < len(b)*8; bit++ {
+		b[bit/8] |= 0x80 >> (bit % 8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+func (b *builder) add(first, last netip.Addr) {
+	if first.Is4() {
+		b.v4 = append(b.v4, span4{v4(first), v4(last)})
+	} else {
+		b.v6 = append(b.v6, span6{first, last})
+	}
+}
+
+// list sorts the ranges and merges overlapping and adjacent ones
+func (b *builder) list() *List {
+	l := &List{invalid: b.invalid}
+	sort.Slice(b.v4, func(i, j int) bool { return b.v4[i].first < b.v4[j].first })
+	for _, s := range b.v4 {
+		n := len(l.v4)
+		if n > 0 && (l.v4[n-1].last == ^uint32(0) || s.first <= l.v4[n-1].last+1) {
+			if s.last > l.v4[n-1].last {
+				l.v4[n-1].last = s.last
+			}
+			continue
+		}
+		l.v4 = append(l.v4, s)
+	}
+	sort.Slice(b.v6, func(i, j int) bool { return b.v6[i].first.Less(b.v6[j].first) })
+	for _, s := range b.v6 {
+		n := len(l.v6)
+		if n > 0 {
+			prev := &l.v6[n-1]
+			if next := prev.last.Next(); !next.IsValid() || s.first.Compare(next) <= 0 {
+				if s.last.Compare(prev.last) > 0 {
+					prev.last = s.last
+				}
+				continue
+			}
+		}
+		l.v6 = append(l.v6, s)
+	}
+	return l
+}
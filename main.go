@@ -1,21 +1,594 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/souravbiswassanto/bit-torrent-client/config"
+	daemonapi "github.com/souravbiswassanto/bit-torrent-client/daemon"
+	"github.com/souravbiswassanto/bit-torrent-client/p2p"
+	"github.com/souravbiswassanto/bit-torrent-client/session"
 	tf "github.com/souravbiswassanto/bit-torrent-client/torrentfile"
 )
 
+// Exit codes
+const (
+	exitOK      = 0
+	exitFatal   = 1
+	exitUsage   = 2
+	exitPartial = 3 // the download or verification is incomplete
+)
+
+// errUsage is returned by commands called with bad arguments, their flag
+// set has already printed the usage
+var errUsage = errors.New("usage")
+
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(fs *flag.FlagSet, args []string) error
+}
+
+var commands = []command{
+	{"download", "<file.torrent>...", "download the content of torrents", download},
+	{"daemon", "", "run as a daemon serving the HTTP control API", daemon},
+	{"info", "<file.torrent>", "print the metadata of a torrent", info},
+	{"verify", "<file.torrent> <path>", "check downloaded data against the piece hashes", verify},
+	{"create", "<path>", "create a torrent from a file or directory", create},
+	{"magnet", "<file.torrent>...", "print the magnet links of torrents, one per line", magnet},
+	{"scrape", "<file.torrent>", "ask the tracker for the size of the swarm", scrape},
+}
+
 func main() {
-	args1 := os.Args[1]
-	args2 := os.Args[2]
-	// fmt.Println(args1, args2)
-	torrent, err := tf.Open(args1)
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	if len(args) == 0 {
+		usage(os.Stderr)
+		return exitUsage
+	}
+	switch args[0] {
+	case "help", "-h", "-help", "--help":
+		if len(args) > 1 {
+			if cmd := lookup(args[1]); cmd != nil {
+				// the flags are defined by run, which prints them on -h
+				cmd.run(newFlagSet(cmd), []string{"-h"})
+				return exitOK
+			}
+		}
+		usage(os.Stdout)
+		return exitOK
+	}
+	cmd := lookup(args[0])
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", args[0])
+		usage(os.Stderr)
+		return exitUsage
+	}
+	fs := newFlagSet(cmd)
+	err := cmd.run(fs, args[1:])
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, flag.ErrHelp):
+		return exitOK
+	case errors.Is(err, errUsage):
+		return exitUsage
+	case errors.Is(err, p2p.ErrIncomplete):
+		fmt.Fprintf(os.Stderr, "%s: %v\n", cmd.name, err)
+		return exitPartial
+	default:
+		fmt.Fprintf(os.Stderr, "%s: %v\n", cmd.name, err)
+		return exitFatal
+	}
+}
+
+func lookup(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "usage: %s <command> [flags] [args]\n\ncommands:\n", filepath.Base(os.Args[0]))
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-10s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(w, "\nRun '%s help <command>' for the flags of a command.\n", filepath.Base(os.Args[0]))
+	fmt.Fprintf(w, "\nexit status: %d success, %d error, %d bad usage, %d incomplete download or data\n",
+		exitOK, exitFatal, exitUsage, exitPartial)
+}
+
+func newFlagSet(cmd *command) *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s %s [flags] %s\n\n%s\n", filepath.Base(os.Args[0]), cmd.name, cmd.args, cmd.summary)
+		var hasFlags bool
+		fs.VisitAll(func(*flag.Flag) { hasFlags = true })
+		if hasFlags {
+			fmt.Fprintf(fs.Output(), "\nflags:\n")
+			fs.PrintDefaults()
+		}
+	}
+	return fs
+}
+
+// parse parses the flags and checks the number of positional arguments
+func parse(fs *flag.FlagSet, args []string, nargs int) error {
+	err := fs.Parse(args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	if fs.NArg() != nargs && !(nargs == anyArgs && fs.NArg() > 0) {
+		fs.Usage()
+		return errUsage
+	}
+	return nil
+}
+
+// anyArgs makes parse accept one or more positional arguments
+const anyArgs = -1
+
+// errInterrupted is returned by commands stopped with Ctrl-C or SIGTERM
+var errInterrupted = errors.New("interrupted")
+
+// interruptContext is cancelled on Ctrl-C or SIGTERM so that commands can
+// close their connections before exiting
+func interruptContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+// download handles `download [flags] <file.torrent>...`. Several torrents
+// are downloaded at once in one session.
+func download(fs *flag.FlagSet, args []string) error {
+	out := fs.String("o", ".", "output directory")
+	loadConfig := sessionFlags(fs)
+	quiet := fs.Bool("q", false, "only print errors")
+	err := parse(fs, args, anyArgs)
+	if err != nil {
+		return err
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	var torrents []tf.TorrentFile
+	for _, arg := range fs.Args() {
+		t, err := tf.Open(arg)
+		if err != nil {
+			return err
+		}
+		torrents = append(torrents, t)
+	}
+	err = os.MkdirAll(*out, 0755)
+	if err != nil {
+		return err
+	}
+	ctx, stop := interruptContext()
+	defer stop()
+	sess, err := session.New(cfg)
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+	for _, t := range torrents {
+		path := filepath.Join(*out, t.StorageName())
+		if !*quiet {
+			fmt.Printf("downloading %s (%s) to %s\n", t.Name, formatBytes(float64(t.Length)), path)
+		}
+		err = sess.Add(t, path)
+		if err != nil {
+			return err
+		}
+	}
+
+	ticker := time.NewTicker(p2p.ProgressInterval)
+	defer ticker.Stop()
+	var list []session.Status
+	for {
+		list = sess.List()
+		if !*quiet {
+			printProgress(total(list))
+		}
+		if finished(list) {
+			break
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if !*quiet {
+				fmt.Fprintln(os.Stderr)
+			}
+			return errInterrupted
+		}
+	}
+	if !*quiet {
+		// finish the progress line
+		fmt.Fprintln(os.Stderr)
+	}
+
+	// a hard failure outranks an incomplete download for the exit code
+	var incomplete, failed error
+	for _, st := range list {
+		if st.Err == nil {
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "%s: %v\n", st.Name, st.Err)
+		if errors.Is(st.Err, p2p.ErrIncomplete) {
+			incomplete = st.Err
+		} else {
+			failed = st.Err
+		}
+	}
+	switch {
+	case failed != nil:
+		return fmt.Errorf("%d of %d torrents failed", countFailed(list), len(list))
+	case incomplete != nil:
+		return fmt.Errorf("%w: %d of %d torrents", p2p.ErrIncomplete, countFailed(list), len(list))
+	}
+	if !*quiet {
+		fmt.Printf("done\n")
+	}
+	return nil
+}
+
+// daemon handles `daemon [flags]` and serves the control API until
+// interrupted
+func daemon(fs *flag.FlagSet, args []string) error {
+	out := fs.String("o", ".", "download directory")
+	loadConfig := sessionFlags(fs)
+	err := parse(fs, args, 0)
+	if err != nil {
+		return err
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(*out, 0755)
+	if err != nil {
+		return err
+	}
+	ctx, stop := interruptContext()
+	defer stop()
+	sess, err := session.New(cfg)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	defer sess.Close()
+	api := daemonapi.New(sess, *out)
+	if d, _ := cfg.ProxyDialer(); d != nil {
+		api.HTTPClient.Transport = d.Transport()
+	}
+	server := &http.Server{
+		Addr:        cfg.Listen,
+		Handler:     api,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	fmt.Printf("serving the control API on http://%s/api/\n", cfg.Listen)
+	err = server.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// sessionFlags defines the flags shared by the commands running a session,
+// among them -config naming a file of further options. The returned
+// function completes the config from that file and the environment once
+// the flags are parsed, and validates it.
+func sessionFlags(fs *flag.FlagSet) func() (config.Config, error) {
+	cfg := config.Default()
+	cfg.Flags(fs)
+	path := fs.String("config", os.Getenv("BT_CONFIG"), "file of name = value options, flags and BT_* environment variables take precedence")
+	verbose := fs.Bool("v", false, "log peer and tracker activity")
+	return func() (config.Config, error) {
+		err := cfg.Load(fs, *path)
+		if err != nil {
+			fmt.Fprintln(fs.Output(), err)
+			return config.Config{}, errUsage
+		}
+		if !*verbose {
+			log.SetOutput(io.Discard)
+		}
+		return cfg, nil
+	}
+}
+
+func finished(list []session.Status) bool {
+	for _, st := range list {
+		if st.State != session.Done && st.State != session.Failed {
+			return false
+		}
+	}
+	return true
+}
+
+func countFailed(list []session.Status) int {
+	n := 0
+	for _, st := range list {
+		if st.State == session.Failed {
+			n++
+		}
+	}
+	return n
+}
+
+// total sums up the progress of every torrent
+func total(list []session.Status) p2p.Progress {
+	var sum p2p.Progress
+	for _, st := range list {
+		p := st.Progress
+		sum.PiecesDone += p.PiecesDone
+		sum.PiecesTotal += p.PiecesTotal
+		sum.BytesDone += p.BytesDone
+		sum.BytesTotal += p.BytesTotal
+		sum.Downloaded += p.Downloaded
+		sum.Uploaded += p.Uploaded
+		sum.DownloadRate += p.DownloadRate
+		sum.UploadRate += p.UploadRate
+		sum.Peers += p.Peers
+		sum.PeersTotal += p.PeersTotal
+	}
+	if left := sum.BytesTotal - sum.BytesDone; left > 0 && sum.DownloadRate >= 1 {
+		sum.ETA = time.Duration(float64(left) / sum.DownloadRate * float64(time.Second))
+	}
+	return sum
+}
+
+// printProgress redraws the progress line on stderr
+func printProgress(p p2p.Progress) {
+	eta := "--"
+	if p.ETA > 0 {
+		eta = p.ETA.Round(time.Second).String()
+	}
+	fmt.Fprintf(os.Stderr, "\r\033[K%5.1f%%  %d/%d pieces  down %s/s  up %s/s  peers %d/%d  eta %s",
+		p.Percent(), p.PiecesDone, p.PiecesTotal,
+		formatBytes(p.DownloadRate), formatBytes(p.UploadRate),
+		p.Peers, p.PeersTotal, eta)
+}
+
+func formatBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f %s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
+
+// info handles `info [-json] <file.torrent>`
+func info(fs *flag.FlagSet, args []string) error {
+	asJSON := fs.Bool("json", false, "print the metadata as JSON")
+	err := parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	t, err := tf.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	m := t.Metadata()
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(m)
+	}
+
+	field := func(name, format string, args ...interface{}) {
+		fmt.Printf("%-14s "+format+"\n", append([]interface{}{name + ":"}, args...)...)
+	}
+	field("name", "%s", m.Name)
+	if m.InfoHash != "" {
+		field("info hash", "%s", m.InfoHash)
+	}
+	if m.InfoHashV2 != "" {
+		field("info hash v2", "%s", m.InfoHashV2)
+	}
+	field("size", "%s (%d bytes)", formatBytes(float64(m.Size)), m.Size)
+	field("pieces", "%d x %s", m.Pieces, formatBytes(float64(m.PieceLength)))
+	field("private", "%t", m.Private)
+	if m.Comment != "" {
+		field("comment", "%s", m.Comment)
+	}
+	if m.CreatedBy != "" {
+		field("created by", "%s", m.CreatedBy)
+	}
+	if m.CreationDate != nil {
+		field("creation date", "%s", m.CreationDate.Format(time.RFC3339))
+	}
+	if m.Source != "" {
+		field("source", "%s", m.Source)
+	}
+	for i, tier := range m.Trackers {
+		for _, tracker := range tier {
+			field(fmt.Sprintf("tier %d", i+1), "%s", tracker)
+		}
+	}
+	for _, u := range m.WebSeeds {
+		field("web seed", "%s", u)
+	}
+	fmt.Printf("files:\n")
+	printFileTree(m.Files, 1)
+	return nil
+}
+
+// printFileTree prints a file per line, directories followed by a slash
+// and their content indented below them
+func printFileTree(n tf.FileNode, depth int) {
+	name := n.Name
+	if n.Children != nil {
+		name += "/"
+	}
+	fmt.Printf("%12d  %s%s\n", n.Size, strings.Repeat("  ", depth-1), name)
+	for _, child := range n.Children {
+		printFileTree(child, depth+1)
+	}
+}
+
+// verify handles `verify <file.torrent> <path>`
+func verify(fs *flag.FlagSet, args []string) error {
+	err := parse(fs, args, 2)
+	if err != nil {
+		return err
+	}
+	t, err := tf.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	pieces, err := t.Verify(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	good := 0
+	for _, ok := range pieces {
+		if ok {
+			good++
+		}
+	}
+	fmt.Printf("%d of %d pieces ok\n", good, len(pieces))
+	if good != len(pieces) {
+		return fmt.Errorf("%w: %d pieces missing or corrupt", p2p.ErrIncomplete, len(pieces)-good)
+	}
+	return nil
+}
+
+// create handles `create [flags] <path>` and writes a .torrent for path
+func create(fs *flag.FlagSet, args []string) error {
+	out := fs.String("o", "", "output .torrent path (default <name>.torrent)")
+	name := fs.String("name", "", "torrent name (default base name of path)")
+	pieceLength := fs.Int("piece-length", 0, "piece length in bytes, 0 picks one automatically")
+	trackers := fs.String("trackers", "", "comma separated trackers, tiers separated by ';'")
+	comment := fs.String("comment", "", "comment")
+	createdBy := fs.String("created-by", "bit-torrent-client", "created by")
+	noDate := fs.Bool("no-date", false, "omit the creation date")
+	private := fs.Bool("private", false, "set the private flag")
+	webSeeds := fs.String("web-seeds", "", "comma separated web seed urls")
+	source := fs.String("source", "", "source tag")
+	err := parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	root := fs.Arg(0)
+
+	opts := tf.CreateOptions{
+		Name:        *name,
+		PieceLength: *pieceLength,
+		Comment:     *comment,
+		CreatedBy:   *createdBy,
+		Private:     *private,
+		Source:      *source,
+		WebSeeds:    splitList(*webSeeds, ","),
+	}
+	for _, tier := range splitList(*trackers, ";") {
+		opts.AnnounceList = append(opts.AnnounceList, splitList(tier, ","))
+	}
+	if !*noDate {
+		opts.CreationDate = time.Now()
+	}
+
+	outPath := *out
+	if outPath == "" {
+		base := *name
+		if base == "" {
+			st, err := os.Stat(root)
+			if err != nil {
+				return err
+			}
+			base = st.Name()
+		}
+		outPath = base + ".torrent"
+	}
+	return tf.CreateFile(root, outPath, opts)
+}
+
+// magnet handles `magnet <file.torrent>...`. Nothing is printed unless
+// every torrent can be read.
+func magnet(fs *flag.FlagSet, args []string) error {
+	err := parse(fs, args, anyArgs)
+	if err != nil {
+		return err
+	}
+	links := make([]string, fs.NArg())
+	for i, path := range fs.Args() {
+		t, err := tf.Open(path)
+		if err != nil {
+			return err
+		}
+		links[i] = t.Magnet()
+	}
+	for _, link := range links {
+		fmt.Println(link)
+	}
+	return nil
+}
+
+// scrape handles `scrape <file.torrent>`
+func scrape(fs *flag.FlagSet, args []string) error {
+	err := parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	t, err := tf.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	// the tracker timeout and user agent may come from the environment
+	cfg := config.Default()
+	err = cfg.LoadEnv()
+	if err != nil {
+		return err
+	}
+	ctx, stop := interruptContext()
+	defer stop()
+	res, err := t.Scrape(ctx, cfg)
+	if ctx.Err() != nil {
+		return errInterrupted
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("seeders: %d\nleechers: %d\ncompleted: %d\n", res.Seeders, res.Leechers, res.Completed)
+	return nil
+}
+
+func splitList(s, sep string) []string {
+	var out []string
+	for _, part := range strings.Split(s, sep) {
+		part = strings.TrimSpace(part)
+		if part != "" {
+			out = append(out, part)
+		}
 	}
-	// fmt.Println(torrent.Announce, torrent.Name, torrent.Length)
-	err = torrent.Download(args2)
-	log.Fatalf("%v", err)
+	return out
 }
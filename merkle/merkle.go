@@ -0,0 +1,101 @@
+package merkle
+
+import (
+	"crypto/sha256"
+	"fmt"
+)
+
+// BlockSize is the size of the data covered by a single leaf of a v2 merkle tree
+const BlockSize = 16384
+
+// HashSize is the size of every node in the tree
+const HashSize = sha256.Size
+
+// HashBlock returns the leaf hash of a block of at most BlockSize bytes
+func HashBlock(block []byte) [32]byte {
+	return sha256.Sum256(block)
+}
+
+// HashPair returns the parent of two nodes
+func HashPair(left, right [32]byte) [32]byte {
+	var buf [64]byte
+	copy(buf[:32], left[:])
+	copy(buf[32:], right[:])
+	return sha256.Sum256(buf[:])
+}
+
+// NextPowerOfTwo returns the smallest power of two that is >= n
+func NextPowerOfTwo(n int) int {
+	p := 1
+	for p < n {
+		p <<= 1
+	}
+	return p
+}
+
+// PadHash returns the root of a subtree of width zero leaves. It is the
+// value used to fill a layer above the leaves beyond the end of a file.
+func PadHash(width int) [32]byte {
+	var h [32]byte
+	for ; width > 1; width >>= 1 {
+		h = HashPair(h, h)
+	}
+	return h
+}
+
+// Root builds the tree over nodes, padded up to width entries with pad,
+// and returns its root. width must be a power of two >= len(nodes).
+func Root(nodes [][32]byte, width int, pad [32]byte) [32]byte {
+	if width == 0 {
+		return [32]byte{}
+	}
+	layer := make([][32]byte, width)
+	n := copy(layer, nodes)
+	for i := n; i < width; i++ {
+		layer[i] = pad
+	}
+	for len(layer) > 1 {
+		for i := 0; i < len(layer)/2; i++ {
+			layer[i] = HashPair(layer[2*i], layer[2*i+1])
+		}
+		layer = layer[:len(layer)/2]
+	}
+	return layer[0]
+}
+
+// DataRoot hashes data in BlockSize leaves and returns the root of the
+// tree over them padded with zero leaves up to width leaves
+func DataRoot(data []byte, width int) [32]byte {
+	leaves := make([][32]byte, 0, (len(data)+BlockSize-1)/BlockSize)
+	for begin := 0; begin < len(data); begin += BlockSize {
+		end := begin + BlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		leaves = append(leaves, HashBlock(data[begin:end]))
+	}
+	return Root(leaves, width, [32]byte{})
+}
+
+// Proof returns the uncle hashes needed to verify layer[index] against
+// the root of the tree built over layer, padded with pad up to width
+func Proof(layer [][32]byte, width int, pad [32]byte, index int) ([][32]byte, error) {
+	if index < 0 || index >= width {
+		return nil, fmt.Errorf("index %d out of range for width %d", index, width)
+	}
+	nodes := make([][32]byte, width)
+	n := copy(nodes, layer)
+	for i := n; i < width; i++ {
+		nodes[i] = pad
+	}
+	var proof [][32]byte
+	for len(nodes) > 1 {
+		proof = append(proof, nodes[index^1])
+		for i := 0; i < len(nodes)/2; i++ {
+			nodes[i] = HashPair(nodes[2*i], nodes[2*i+1])
+		}
+		nodes = nodes[:len(nodes)/2]
+		index /= 2
+	}
+	return proof, nil
+}
@@ -0,0 +1,115 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+)
+
+// leaves returns n distinct leaf hashes
+func leaves(n int) [][32]byte {
+	l := make([][32]byte, n)
+	for i := range l {
+		l[i] = sha256.Sum256([]byte{byte(i)})
+	}
+	return l
+}
+
+func TestNextPowerOfTwo(t *testing.T) {
+	tests := []struct{ n, want int }{{0, 1}, {1, 1}, {2, 2}, {3, 4}, {4, 4}, {5, 8}, {1000, 1024}}
+	for _, tt := range tests {
+		if got := NextPowerOfTwo(tt.n); got != tt.want {
+			t.Errorf("NextPowerOfTwo(%d) = %d, want %d", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestPadHash(t *testing.T) {
+	for _, width := range []int{1, 2, 4, 16, 64} {
+		want := Root(nil, width, [32]byte{})
+		if got := PadHash(width); got != want {
+			t.Errorf("PadHash(%d) is not the root of %d zero leaves", width, width)
+		}
+	}
+}
+
+func TestRoot(t *testing.T) {
+	l := leaves(3)
+	pad := sha256.Sum256([]byte("pad"))
+	tests := []struct {
+		name  string
+		nodes [][32]byte
+		width int
+		want  [32]byte
+	}{
+		{"empty", nil, 0, [32]byte{}},
+		{"single", l[:1], 1, l[0]},
+		{"pair", l[:2], 2, HashPair(l[0], l[1])},
+		{"padded", l[:1], 2, HashPair(l[0], pad)},
+		{"three", l, 4, HashPair(HashPair(l[0], l[1]), HashPair(l[2], pad))},
+	}
+	for _, tt := range tests {
+		if got := Root(tt.nodes, tt.width, pad); got != tt.want {
+			t.Errorf("%s: Root = %x, want %x", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDataRoot(t *testing.T) {
+	data := bytes.Repeat([]byte("abc"), BlockSize)
+	blocks := [][32]byte{
+		HashBlock(data[:BlockSize]),
+		HashBlock(data[BlockSize : 2*BlockSize]),
+		HashBlock(data[2*BlockSize:]),
+	}
+	tests := []struct {
+		name  string
+		data  []byte
+		width int
+		want  [32]byte
+	}{
+		{"short block", data[:10], 1, HashBlock(data[:10])},
+		{"whole blocks", data, 4, HashPair(HashPair(blocks[0], blocks[1]), HashPair(blocks[2], [32]byte{}))},
+		{"wider tree", data[:BlockSize], 4, HashPair(HashPair(blocks[0], [32]byte{}), PadHash(2))},
+	}
+	for _, tt := range tests {
+		if got := DataRoot(tt.data, tt.width); got != tt.want {
+			t.Errorf("%s: DataRoot = %x, want %x", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestProof(t *testing.T) {
+	pad := PadHash(4)
+	for _, n := range []int{1, 2, 3, 5, 8} {
+		layer := leaves(n)
+		width := NextPowerOfTwo(n)
+		root := Root(layer, width, pad)
+		for index := 0; index < width; index++ {
+			proof, err := Proof(layer, width, pad, index)
+			if err != nil {
+				t.Fatalf("Proof(%d of %d): %v", index, width, err)
+			}
+			// walk the uncles up to the root
+			h, i := pad, index
+			if index < n {
+				h = layer[index]
+			}
+			for _, uncle := range proof {
+				if i%2 == 0 {
+					h = HashPair(h, uncle)
+				} else {
+					h = HashPair(uncle, h)
+				}
+				i /= 2
+			}
+			if h != root {
+				t.Errorf("proof of node %d of %d does not lead to the root", index, n)
+			}
+		}
+		_, err := Proof(layer, width, pad, width)
+		if err == nil {
+			t.Errorf("Proof of node %d of width %d succeeded", width, width)
+		}
+	}
+}
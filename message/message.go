@@ -27,8 +27,26 @@ const (
 	MsgPiece messageID = 7
 	// MsgCancel cancels a request
 	MsgCancel messageID = 8
+	// MsgHashRequest requests merkle hashes of a v2 file (BEP 52)
+	MsgHashRequest messageID = 21
+	// MsgHashes delivers merkle hashes to fulfill a hash request
+	MsgHashes messageID = 22
+	// MsgHashReject refuses a hash request
+	MsgHashReject messageID = 23
 )
 
+// HashRequest identifies a range of merkle hashes of a v2 file. It is the
+// payload of HASH REQUEST and HASH REJECT and the header of HASHES.
+type HashRequest struct {
+	PiecesRoot  [32]byte
+	BaseLayer   int
+	Index       int
+	Length      int
+	ProofLayers int
+}
+
+const hashRequestSize = 32 + 4*4
+
 // Message stores ID and payload of a message
 type Message struct {
 	ID      messageID
@@ -87,6 +105,52 @@ func ParseHave(msg *Message) (int, error) {
 	return index, nil
 }
 
+// FormatHashReject creates a HASH REJECT message for a request we can't serve
+func FormatHashReject(req HashRequest) *Message {
+	return &Message{ID: MsgHashReject, Payload: req.serialize()}
+}
+
+// FormatHashes creates a HASHES message answering req. hashes holds the
+// requested base layer hashes followed by the uncle hashes of the proof.
+func FormatHashes(req HashRequest, hashes [][32]byte) *Message {
+	payload := req.serialize()
+	for _, h := range hashes {
+		payload = append(payload, h[:]...)
+	}
+	return &Message{ID: MsgHashes, Payload: payload}
+}
+
+// ParseHashRequest parses a HASH REQUEST or HASH REJECT message
+func ParseHashRequest(msg *Message) (HashRequest, error) {
+	if msg.ID != MsgHashRequest && msg.ID != MsgHashReject {
+		return HashRequest{}, fmt.Errorf("Expected HASH REQUEST or HASH REJECT, got ID %d", msg.ID)
+	}
+	if len(msg.Payload) != hashRequestSize {
+		return HashRequest{}, fmt.Errorf("Expected payload length %d, got length %d", hashRequestSize, len(msg.Payload))
+	}
+	return parseHashRequest(msg.Payload), nil
+}
+
+func (r HashRequest) serialize() []byte {
+	payload := make([]byte, hashRequestSize)
+	copy(payload[0:32], r.PiecesRoot[:])
+	binary.BigEndian.PutUint32(payload[32:36], uint32(r.BaseLayer))
+	binary.BigEndian.PutUint32(payload[36:40], uint32(r.Index))
+	binary.BigEndian.PutUint32(payload[40:44], uint32(r.Length))
+	binary.BigEndian.PutUint32(payload[44:48], uint32(r.ProofLayers))
+	return payload
+}
+
+func parseHashRequest(payload []byte) HashRequest {
+	var r HashRequest
+	copy(r.PiecesRoot[:], payload[0:32])
+	r.BaseLayer = int(binary.BigEndian.Uint32(payload[32:36]))
+	r.Index = int(binary.BigEndian.Uint32(payload[36:40]))
+	r.Length = int(binary.BigEndian.Uint32(payload[40:44]))
+	r.ProofLayers = int(binary.BigEndian.Uint32(payload[44:48]))
+	return r
+}
+
 // Serialize serializes a message into a buffer of the form
 // <length prefix><message ID><payload>
 // Interprets `nil` as a keep-alive message
@@ -156,6 +220,12 @@ func (m *Message) name() string {
 		return "Piece"
 	case MsgCancel:
 		return "Cancel"
+	case MsgHashRequest:
+		return "HashRequest"
+	case MsgHashes:
+		return "Hashes"
+	case MsgHashReject:
+		return "HashReject"
 	default:
 		return fmt.Sprintf("Unknown#%d", m.ID)
 	}
@@ -0,0 +1,245 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Family is a named group of samples in the Prometheus text format
+type Family interface {
+	name() string
+	write(w io.Writer)
+}
+
+// Registry holds the metric families served by Handler
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]Family
+}
+
+// Default is the registry the New* functions register with
+var Default = &Registry{families: make(map[string]Family)}
+
+// Register adds f to the registry. Registering a name twice panics, as
+// with duplicate flags this is a programming error.
+func (r *Registry) Register(f Family) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.families[f.name()]; ok {
+		panic("metrics: duplicate metric " + f.name())
+	}
+	r.families[f.name()] = f
+}
+
+// Write writes every family sorted by name
+func (r *Registry) Write(w io.Writer) {
+	r.mu.Lock()
+	families := make([]Family, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	r.mu.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name() < families[j].name() })
+	for _, f := range families {
+		f.write(w)
+	}
+}
+
+// Handler serves the default registry followed by the extra families,
+// which are typically collected from an object living shorter than the
+// process
+func Handler(extra ...Family) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		Default.Write(bw)
+		for _, f := range extra {
+			f.write(bw)
+		}
+		bw.Flush()
+	})
+}
+
+// Counter is a value that only goes up
+type Counter struct {
+	v atomic.Int64
+}
+
+func (c *Counter) Inc()         { c.v.Add(1) }
+func (c *Counter) Add(n int64)  { c.v.Add(n) }
+func (c *Counter) Value() int64 { return c.v.Load() }
+
+// Gauge is a value that goes up and down
+type Gauge struct {
+	v atomic.Int64
+}
+
+func (g *Gauge) Set(n int64)  { g.v.Store(n) }
+func (g *Gauge) Add(n int64)  { g.v.Add(n) }
+func (g *Gauge) Inc()         { g.v.Add(1) }
+func (g *Gauge) Dec()         { g.v.Add(-1) }
+func (g *Gauge) Value() int64 { return g.v.Load() }
+
+// series is one labelled value of a vec
+type series struct {
+	labels  []string
+	counter Counter
+	gauge   Gauge
+}
+
+// vec is a family of values sharing the same label names
+type vec struct {
+	family string
+	help   string
+	typ    string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+func newVec(name, help, typ string, labels []string) *vec {
+	v := &vec{
+		family: name,
+		help:   help,
+		typ:    typ,
+		labels: labels,
+		series: make(map[string]*series),
+	}
+	Default.Register(v)
+	return v
+}
+
+func (v *vec) with(values []string) *series {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", v.family, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{labels: append([]string(nil), values...)}
+		v.series[key] = s
+	}
+	return s
+}
+
+func (v *vec) name() string { return v.family }
+
+func (v *vec) write(w io.Writer) {
+	v.mu.Lock()
+	samples := make([]Sample, 0, len(v.series))
+	for _, s := range v.series {
+		value := s.counter.Value()
+		if v.typ == "gauge" {
+			value = s.gauge.Value()
+		}
+		samples = append(samples, Sample{Labels: s.labels, Value: float64(value)})
+	}
+	v.mu.Unlock()
+	writeFamily(w, v.family, v.help, v.typ, v.labels, samples)
+}
+
+// CounterVec is a counter partitioned by labels
+type CounterVec struct {
+	vec *vec
+}
+
+// NewCounter registers a counter without labels
+func NewCounter(name, help string) *Counter {
+	return NewCounterVec(name, help).With()
+}
+
+// NewCounterVec registers a counter with the given label names
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{newVec(name, help, "counter", labels)}
+}
+
+// With returns the counter for the label values, given in the order of
+// the label names
+func (v *CounterVec) With(values ...string) *Counter {
+	return &v.vec.with(values).counter
+}
+
+// GaugeVec is a gauge partitioned by labels
+type GaugeVec struct {
+	vec *vec
+}
+
+// NewGauge registers a gauge without labels
+func NewGauge(name, help string) *Gauge {
+	return NewGaugeVec(name, help).With()
+}
+
+// NewGaugeVec registers a gauge with the given label names
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{newVec(name, help, "gauge", labels)}
+}
+
+// With returns the gauge for the label values
+func (v *GaugeVec) With(values ...string) *Gauge {
+	return &v.vec.with(values).gauge
+}
+
+// Sample is one value of a Func family
+type Sample struct {
+	Labels []string
+	Value  float64
+}
+
+// Func is a family whose samples are collected when it is scraped
+type Func struct {
+	family  string
+	help    string
+	typ     string
+	labels  []string
+	collect func() []Sample
+}
+
+// CounterFunc returns an unregistered counter family read from collect
+func CounterFunc(name, help string, labels []string, collect func() []Sample) *Func {
+	return &Func{name, help, "counter", labels, collect}
+}
+
+// GaugeFunc returns an unregistered gauge family read from collect
+func GaugeFunc(name, help string, labels []string, collect func() []Sample) *Func {
+	return &Func{name, help, "gauge", labels, collect}
+}
+
+func (f *Func) name() string { return f.family }
+
+func (f *Func) write(w io.Writer) {
+	writeFamily(w, f.family, f.help, f.typ, f.labels, f.collect())
+}
+
+func writeFamily(w io.Writer, name, help, typ string, labels []string, samples []Sample) {
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].Labels, "\xff") < strings.Join(samples[j].Labels, "\xff")
+	})
+	fmt.Fprintf(w, "# HELP %s %s\n", name, strings.ReplaceAll(help, "\n", " "))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+	for _, s := range samples {
+		fmt.Fprint(w, name)
+		if len(labels) > 0 {
+			pairs := make([]string, len(labels))
+			for i, label := range labels {
+				pairs[i] = fmt.Sprintf("%s=\"%s\"", label, escape(s.Labels[i]))
+			}
+			fmt.Fprintf(w, "{%s}", strings.Join(pairs, ","))
+		}
+		fmt.Fprintf(w, " %v\n", s.Value)
+	}
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escape(s string) string {
+	return escaper.Replace(s)
+}
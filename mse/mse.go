@@ -0,0 +1,394 @@
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+)
+
+// Policy decides whether connections are encrypted
+type Policy int
+
+const (
+	// PolicyDisabled only speaks plaintext BitTorrent
+	PolicyDisabled Policy = iota
+	// PolicyPreferred encrypts when the other side supports it and falls
+	// back to plaintext otherwise
+	PolicyPreferred
+	// PolicyRequired refuses plaintext connections
+	PolicyRequired
+)
+
+// CryptoMethod is a bit of crypto_provide / crypto_select
+type CryptoMethod uint32
+
+const (
+	// CryptoPlaintext only obfuscates the handshake
+	CryptoPlaintext CryptoMethod = 0x01
+	// CryptoRC4 encrypts the whole stream
+	CryptoRC4 CryptoMethod = 0x02
+)
+
+const (
+	keySize = 96
+	// maxPadding is the largest amount of random padding after a public key
+	maxPadding = 512
+	// plaintextPstr starts every plaintext BitTorrent handshake
+	plaintextPstr = "\x13BitTorrent protocol"
+)
+
+var (
+	prime, _  = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	generator = big.NewInt(2)
+	vc        = make([]byte, 8)
+)
+
+// Provide returns the crypto_provide bits offered under policy
+func (p Policy) Provide() CryptoMethod {
+	switch p {
+	case PolicyRequired:
+		return CryptoRC4
+	case PolicyPreferred:
+		return CryptoRC4 | CryptoPlaintext
+	default:
+		return CryptoPlaintext
+	}
+}
+
+func (p Policy) String() string {
+	switch p {
+	case PolicyDisabled:
+		return "disabled"
+	case PolicyPreferred:
+		return "preferred"
+	case PolicyRequired:
+		return "required"
+	default:
+		return fmt.Sprintf("Policy(%d)", int(p))
+	}
+}
+
+// ParsePolicy converts "disabled", "preferred" or "required" to a Policy
+func ParsePolicy(s string) (Policy, error) {
+	for _, p := range []Policy{PolicyDisabled, PolicyPreferred, PolicyRequired} {
+		if p.String() == s {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown encryption policy %q", s)
+}
+
+// Conn is a connection that completed the MSE handshake. Depending on the
+// negotiated method the stream after the handshake is RC4 encrypted or
+// plaintext.
+type Conn struct {
+	net.Conn
+	Method CryptoMethod
+	r      io.Reader
+	enc    *rc4.Cipher
+	dec    *rc4.Cipher
+	mu     sync.Mutex
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if c.dec != nil {
+		c.dec.XORKeyStream(p[:n], p[:n])
+	}
+	return n, err
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	if c.enc == nil {
+		return c.Conn.Write(p)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	buf := make([]byte, len(p))
+	c.enc.XORKeyStream(buf, p)
+	return c.Conn.Write(buf)
+}
+
+// Initiate performs the outgoing side of the handshake for the torrent
+// identified by skey, offering the methods in provide
+func Initiate(conn net.Conn, skey [20]byte, provide CryptoMethod) (*Conn, error) {
+	br := bufio.NewReader(conn)
+	x, y, err := keyPair()
+	if err != nil {
+		return nil, err
+	}
+	pad, err := padding()
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(append(y, pad...))
+	if err != nil {
+		return nil, err
+	}
+
+	remote := make([]byte, keySize)
+	_, err = io.ReadFull(br, remote)
+	if err != nil {
+		return nil, err
+	}
+	s := sharedSecret(x, remote)
+
+	enc := newCipher("keyA", s, skey[:])
+	dec := newCipher("keyB", s, skey[:])
+	var msg bytes.Buffer
+	msg.Write(hash("req1", s))
+	msg.Write(xor(hash("req2", skey[:]), hash("req3", s)))
+	plain := make([]byte, 0, 16)
+	plain = append(plain, vc...)
+	plain = binary.BigEndian.AppendUint32(plain, uint32(provide))
+	plain = binary.BigEndian.AppendUint16(plain, 0) // len(PadC)
+	plain = binary.BigEndian.AppendUint16(plain, 0) // len(IA)
+	encrypted := make([]byte, len(plain))
+	enc.XORKeyStream(encrypted, plain)
+	msg.Write(encrypted)
+	_, err = conn.Write(msg.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	// the encrypted VC marks the end of the responder's padding
+	encryptedVC := make([]byte, len(vc))
+	newCipher("keyB", s, skey[:]).XORKeyStream(encryptedVC, vc)
+	err = synchronize(br, encryptedVC, maxPadding+len(vc))
+	if err != nil {
+		return nil, err
+	}
+	// advance the incoming stream past the VC we just consumed
+	dec.XORKeyStream(encryptedVC, encryptedVC)
+
+	header := make([]byte, 6)
+	_, err = io.ReadFull(br, header)
+	if err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(header, header)
+	selected := CryptoMethod(binary.BigEndian.Uint32(header[0:4]))
+	padLen := int(binary.BigEndian.Uint16(header[4:6]))
+	if padLen > maxPadding {
+		return nil, fmt.Errorf("mse: padding too long")
+	}
+	padD := make([]byte, padLen)
+	_, err = io.ReadFull(br, padD)
+	if err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(padD, padD)
+	if selected&provide == 0 || (selected != CryptoRC4 && selected != CryptoPlaintext) {
+		return nil, fmt.Errorf("mse: peer selected unsupported method %d", selected)
+	}
+	return newConn(conn, br, selected, enc, dec, nil), nil
+}
+
+// Accept performs the incoming side of the handshake. skeys lists the info
+// hashes we serve, a peer asking for any other torrent is refused. Under
+// PolicyPreferred a plaintext BitTorrent handshake is let through
+// unchanged, under PolicyDisabled conn is returned as is.
+func Accept(conn net.Conn, skeys [][20]byte, policy Policy) (net.Conn, error) {
+	if policy == PolicyDisabled {
+		return conn, nil
+	}
+	br := bufio.NewReader(conn)
+	head, err := br.Peek(len(plaintextPstr))
+	if err != nil {
+		return nil, err
+	}
+	if string(head) == plaintextPstr {
+		if policy == PolicyRequired {
+			return nil, fmt.Errorf("mse: plaintext connection refused")
+		}
+		return &Conn{Conn: conn, Method: CryptoPlaintext, r: br}, nil
+	}
+
+	remote := make([]byte, keySize)
+	_, err = io.ReadFull(br, remote)
+	if err != nil {
+		return nil, err
+	}
+	x, y, err := keyPair()
+	if err != nil {
+		return nil, err
+	}
+	pad, err := padding()
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(append(y, pad...))
+	if err != nil {
+		return nil, err
+	}
+	s := sharedSecret(x, remote)
+
+	err = synchronize(br, hash("req1", s), maxPadding+sha1.Size)
+	if err != nil {
+		return nil, err
+	}
+	obfuscated := make([]byte, sha1.Size)
+	_, err = io.ReadFull(br, obfuscated)
+	if err != nil {
+		return nil, err
+	}
+	req2 := xor(obfuscated, hash("req3", s))
+	var skey []byte
+	for _, k := range skeys {
+		if bytes.Equal(hash("req2", k[:]), req2) {
+			skey = append([]byte{}, k[:]...)
+			break
+		}
+	}
+	if skey == nil {
+		return nil, fmt.Errorf("mse: unknown info hash")
+	}
+
+	dec := newCipher("keyA", s, skey)
+	enc := newCipher("keyB", s, skey)
+	header := make([]byte, 14)
+	_, err = io.ReadFull(br, header)
+	if err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(header, header)
+	if !bytes.Equal(header[0:8], vc) {
+		return nil, fmt.Errorf("mse: bad verification constant")
+	}
+	provide := CryptoMethod(binary.BigEndian.Uint32(header[8:12]))
+	padLen := int(binary.BigEndian.Uint16(header[12:14]))
+	if padLen > maxPadding {
+		return nil, fmt.Errorf("mse: padding too long")
+	}
+	rest := make([]byte, padLen+2)
+	_, err = io.ReadFull(br, rest)
+	if err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(rest, rest)
+	ia := make([]byte, binary.BigEndian.Uint16(rest[padLen:]))
+	_, err = io.ReadFull(br, ia)
+	if err != nil {
+		return nil, err
+	}
+
+	var selected CryptoMethod
+	switch {
+	case provide&CryptoRC4 != 0:
+		selected = CryptoRC4
+	case provide&CryptoPlaintext != 0 && policy != PolicyRequired:
+		selected = CryptoPlaintext
+	default:
+		return nil, fmt.Errorf("mse: no acceptable crypto method in %d", provide)
+	}
+	reply := append([]byte{}, vc...)
+	reply = binary.BigEndian.AppendUint32(reply, uint32(selected))
+	reply = binary.BigEndian.AppendUint16(reply, 0) // len(PadD)
+	enc.XORKeyStream(reply, reply)
+	_, err = conn.Write(reply)
+	if err != nil {
+		return nil, err
+	}
+	return newConn(conn, br, selected, enc, dec, ia), nil
+}
+
+// newConn wraps conn after the handshake. initial holds the still
+// encrypted initial payload which Read returns before anything else.
+func newConn(conn net.Conn, br *bufio.Reader, method CryptoMethod, enc, dec *rc4.Cipher, initial []byte) *Conn {
+	c := &Conn{Conn: conn, Method: method, r: br}
+	if method == CryptoRC4 {
+		c.enc = enc
+		c.dec = dec
+	} else {
+		// the initial payload is encrypted even when the rest of the stream
+		// is not
+		dec.XORKeyStream(initial, initial)
+	}
+	if len(initial) > 0 {
+		c.r = io.MultiReader(bytes.NewReader(initial), br)
+	}
+	return c
+}
+
+func keyPair() (*big.Int, []byte, error) {
+	secret := make([]byte, 20)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return nil, nil, err
+	}
+	x := new(big.Int).SetBytes(secret)
+	y := new(big.Int).Exp(generator, x, prime)
+	return x, y.FillBytes(make([]byte, keySize)), nil
+}
+
+func sharedSecret(x *big.Int, remote []byte) []byte {
+	y := new(big.Int).SetBytes(remote)
+	return new(big.Int).Exp(y, x, prime).FillBytes(make([]byte, keySize))
+}
+
+// padding returns between 0 and maxPadding random bytes
+func padding() ([]byte, error) {
+	var n [2]byte
+	_, err := rand.Read(n[:])
+	if err != nil {
+		return nil, err
+	}
+	pad := make([]byte, int(binary.BigEndian.Uint16(n[:]))%(maxPadding+1))
+	_, err = rand.Read(pad)
+	return pad, err
+}
+
+func hash(parts ...interface{}) []byte {
+	h := sha1.New()
+	for _, p := range parts {
+		switch p := p.(type) {
+		case string:
+			h.Write([]byte(p))
+		case []byte:
+			h.Write(p)
+		}
+	}
+	return h.Sum(nil)
+}
+
+func xor(a, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range a {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
+
+// newCipher returns the RC4 stream keyed with HASH(name, s, skey) with the
+// first 1024 bytes discarded
+func newCipher(name string, s, skey []byte) *rc4.Cipher {
+	c, _ := rc4.NewCipher(hash(name, s, skey))
+	discard := make([]byte, 1024)
+	c.XORKeyStream(discard, discard)
+	return c
+}
+
+// synchronize consumes r up to and including marker, which has to show up
+// within limit bytes
+func synchronize(r *bufio.Reader, marker []byte, limit int) error {
+	window := make([]byte, 0, limit)
+	for len(window) < limit {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		window = append(window, b)
+		if bytes.HasSuffix(window, marker) {
+			return nil
+		}
+	}
+	return fmt.Errorf("mse: could not synchronize with peer")
+}
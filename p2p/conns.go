@@ -0,0 +1,292 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/souravbiswassanto/bit-torrent-client/client"
+	"github.com/souravbiswassanto/bit-torrent-client/ipfilter"
+	"github.com/souravbiswassanto/bit-torrent-client/peers"
+)
+
+// DefaultTargetPeers is the number of connections a download keeps up when
+// neither TargetPeers nor MaxPeers is set
+const DefaultTargetPeers = 40
+
+// AnnounceInterval is how often Torrent.Announce is called during a
+// download. It is called sooner when the candidates run out.
+var AnnounceInterval = 30 * time.Minute
+
+const (
+	// retryBackoff is the wait before redialing a peer after its first
+	// failure, doubled with every further failure up to maxRetryBackoff
+	retryBackoff    = 5 * time.Second
+	maxRetryBackoff = 5 * time.Minute
+	// maxPeerFailures is the number of failures or clean exits without a
+	// piece in a row after which a peer is given up on
+	maxPeerFailures = 5
+	// minAnnounceInterval spaces the announces asking for more peers,
+	// idleAnnounceInterval those made while no peer is connected
+	minAnnounceInterval  = 5 * time.Minute
+	idleAnnounceInterval = time.Minute
+)
+
+var (
+	// errSelf and errDuplicate are returned by workers connected to
+	// ourselves or to a peer already connected under another address
+	errSelf      = errors.New("connected to ourselves")
+	errDuplicate = errors.New("peer already connected")
+	// errChoked ends a piece the peer stopped serving by choking us
+	errChoked = errors.New("choked by peer")
+)
+
+type candidateState int
+
+const (
+	idle candidateState = iota
+	connecting
+	dropped
+)
+
+// candidate is a peer of one of the torrent's swarms
+type candidate struct {
+	peer     peers.Peer
+	infoHash [20]byte
+	state    candidateState
+	failures int
+	retryAt  time.Time
+}
+
+// peerExit reports a worker that ended and how many pieces it got. c is
+// nil for peers that connected to us.
+type peerExit struct {
+	c      *candidate
+	pieces int
+	err    error
+}
+
+// connManager keeps up to target connections to the candidates, retries
+// the ones that fail and asks for more when they run out. Its methods
+// other than claim run on the goroutine of Download.
+type connManager struct {
+	target     int
+	filter     *ipfilter.Filter
+	announce   func(ctx context.Context) (found, alt []peers.Peer, err error)
+	infoHash   [20]byte
+	altHash    [20]byte
+	candidates map[string]*candidate
+	// order is the dialing order, the order candidates were found in
+	order  []*candidate
+	active int
+
+	announcing   bool
+	lastAnnounce time.Time
+	// exhausted is set when an announce brought no new candidates
+	exhausted bool
+
+	mu sync.Mutex
+	// ids are the peer IDs of the established connections
+	ids map[[20]byte]bool
+}
+
+func newConnManager(t *Torrent) *connManager {
+	target := t.TargetPeers
+	if target <= 0 {
+		target = DefaultTargetPeers
+	}
+	if t.MaxPeers > 0 && t.MaxPeers < target {
+		target = t.MaxPeers
+	}
+	m := &connManager{
+		target:       target,
+		filter:       t.Options.IPFilter,
+		announce:     t.Announce,
+		infoHash:     t.InfoHash,
+		altHash:      t.AltInfoHash,
+		candidates:   make(map[string]*candidate),
+		lastAnnounce: time.Now(),
+		ids:          make(map[[20]byte]bool),
+	}
+	m.add(t.Peers, t.AltPeers)
+	return m
+}
+
+// add makes the peers not known yet candidates and returns their number.
+// The IP filter is applied here as it may have been reloaded since the
+// peers were found.
+func (m *connManager) add(found, alt []peers.Peer) int {
+	allowed, altAllowed := m.filter.Peers(found), m.filter.Peers(alt)
+	if blocked := len(found) + len(alt) - len(allowed) - len(altAllowed); blocked > 0 {
+		log.Printf("IP filter blocked %d peers\n", blocked)
+	}
+	found, alt = allowed, altAllowed
+	added := 0
+	for _, list := range []struct {
+		peers    []peers.Peer
+		infoHash [20]byte
+	}{{found, m.infoHash}, {alt, m.altHash}} {
+		for _, p := range list.peers {
+			key := string(list.infoHash[:]) + p.String()
+			if _, ok := m.candidates[key]; ok {
+				continue
+			}
+			c := &candidate{peer: p, infoHash: list.infoHash}
+			m.candidates[key] = c
+			m.order = append(m.order, c)
+			added++
+		}
+	}
+	if added > 0 {
+		m.exhausted = false
+	}
+	return added
+}
+
+// announced adds the result of an announce and returns the number of new
+// candidates
+func (m *connManager) announced(found, alt []peers.Peer) int {
+	m.announcing = false
+	added := m.add(found, alt)
+	if added == 0 {
+		m.exhausted = true
+	}
+	return added
+}
+
+// known returns the number of candidates not given up on
+func (m *connManager) known() int {
+	n := 0
+	for _, c := range m.order {
+		if c.state != dropped {
+			n++
+		}
+	}
+	return n
+}
+
+// next returns the candidates to dial now to get to the target, marking
+// them as connecting
+func (m *connManager) next(now time.Time) []*candidate {
+	var dial []*candidate
+	for _, c := range m.order {
+		if m.active >= m.target {
+			break
+		}
+		if c.state != idle || now.Before(c.retryAt) {
+			continue
+		}
+		c.state = connecting
+		m.active++
+		dial = append(dial, c)
+	}
+	return dial
+}
+
+// admit counts a peer that connected to us, if there is room for it
+func (m *connManager) admit() bool {
+	if m.active >= m.target {
+		return false
+	}
+	m.active++
+	return true
+}
+
+// exit records the end of a connection and schedules the retry. Exits
+// with an error count as failures, and so do clean exits without a piece:
+// a peer that never has what we need would otherwise be redialed forever
+// and the download never found to be starved.
+func (m *connManager) exit(e peerExit, now time.Time) {
+	m.active--
+	c := e.c
+	if c == nil {
+		// a peer that connected to us, we can't dial it back
+		return
+	}
+	switch {
+	case errors.Is(e.err, errSelf), errors.Is(e.err, errDuplicate),
+		errors.Is(e.err, client.ErrBlockedClient), errors.Is(e.err, client.ErrBlockedIP):
+		log.Printf("Dropping %s: %v\n", c.peer.String(), e.err)
+		c.state = dropped
+		return
+	case e.err == nil && e.pieces > 0:
+		// a clean exit after making progress, such as a peer that has
+		// none of the remaining pieces yet: check back on it after the
+		// shortest wait
+		c.failures = 0
+		c.state = idle
+		c.retryAt = now.Add(retryBackoff)
+		return
+	case e.pieces > 0:
+		// the peer was useful, start over with the shortest wait
+		c.failures = 0
+	}
+	c.failures++
+	if c.failures > maxPeerFailures {
+		log.Printf("Giving up on %s after %d tries without a piece\n", c.peer.String(), maxPeerFailures)
+		c.state = dropped
+		return
+	}
+	backoff := retryBackoff << (c.failures - 1)
+	if backoff > maxRetryBackoff {
+		backoff = maxRetryBackoff
+	}
+	c.state = idle
+	c.retryAt = now.Add(backoff)
+}
+
+// waiting reports whether a candidate will be dialed later
+func (m *connManager) waiting() bool {
+	for _, c := range m.order {
+		if c.state == idle {
+			return true
+		}
+	}
+	return false
+}
+
+// shouldAnnounce reports whether to ask for more peers now. Without any
+// connection it asks right away, or after idleAnnounceInterval if the last
+// announce found nothing new, and below the target every
+// minAnnounceInterval.
+func (m *connManager) shouldAnnounce(now time.Time) bool {
+	if m.announce == nil || m.announcing {
+		return false
+	}
+	since := now.Sub(m.lastAnnounce)
+	switch {
+	case since >= AnnounceInterval:
+		return true
+	case m.active >= m.target:
+		return false
+	case m.active == 0:
+		return !m.exhausted || since >= idleAnnounceInterval
+	}
+	return since >= minAnnounceInterval
+}
+
+// starved reports whether the manager has nothing left to try
+func (m *connManager) starved() bool {
+	return m.active == 0 && !m.waiting() && !m.announcing && (m.announce == nil || m.exhausted)
+}
+
+// claim registers the peer ID of a new connection. It fails for our own
+// ID and for peers already connected.
+func (m *connManager) claim(id, self [20]byte) (release func(), err error) {
+	if id == self {
+		return nil, errSelf
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.ids[id] {
+		return nil, errDuplicate
+	}
+	m.ids[id] = true
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.ids, id)
+	}, nil
+}
@@ -0,0 +1,101 @@
+package p2p
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/souravbiswassanto/bit-torrent-client/peers"
+)
+
+func TestConnManagerExit(t *testing.T) {
+	errReset := errors.New("connection reset")
+	tests := []struct {
+		name string
+		// exits are the pieces and errors of the connections in order
+		exits []peerExit
+		// dropped tells whether the peer is given up on after them
+		dropped bool
+		// backoff is the wait before the next dial otherwise
+		backoff time.Duration
+	}{
+		{
+			name:    "clean exit after progress",
+			exits:   []peerExit{{pieces: 3}},
+			backoff: retryBackoff,
+		},
+		{
+			name:    "clean exit without a piece",
+			exits:   []peerExit{{}},
+			backoff: retryBackoff,
+		},
+		{
+			name:    "clean exits without a piece back off",
+			exits:   []peerExit{{}, {}, {}},
+			backoff: 4 * retryBackoff,
+		},
+		{
+			name:    "repeated clean exits without a piece",
+			exits:   []peerExit{{}, {}, {}, {}, {}, {}},
+			dropped: true,
+		},
+		{
+			name:    "failures",
+			exits:   []peerExit{{err: errReset}, {}, {err: errReset}, {}, {err: errReset}, {}},
+			dropped: true,
+		},
+		{
+			name:    "progress starts over",
+			exits:   []peerExit{{}, {}, {}, {}, {}, {pieces: 1}, {}, {}},
+			backoff: 2 * retryBackoff,
+		},
+		{
+			name:    "failure after progress",
+			exits:   []peerExit{{}, {}, {}, {}, {}, {pieces: 1, err: errReset}},
+			backoff: retryBackoff,
+		},
+		{
+			name:    "duplicate",
+			exits:   []peerExit{{err: errDuplicate}},
+			dropped: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peer := peers.Peer{IP: net.IPv4(127, 0, 0, 1), Port: 6881}
+			m := newConnManager(&Torrent{Peers: []peers.Peer{peer}})
+			now := time.Now()
+			var exited time.Time
+			for i, e := range tt.exits {
+				dial := m.next(now)
+				if len(dial) != 1 {
+					t.Fatalf("connection %d: dialing %d peers, want 1", i, len(dial))
+				}
+				e.c = dial[0]
+				exited = now
+				m.exit(e, exited)
+				now = dial[0].retryAt
+			}
+			c := m.order[0]
+			if got := c.state == dropped; got != tt.dropped {
+				t.Fatalf("peer dropped %t, want %t", got, tt.dropped)
+			}
+			if tt.dropped {
+				if !m.starved() {
+					t.Error("manager without candidates is not starved")
+				}
+				return
+			}
+			if m.starved() {
+				t.Error("manager with a candidate to retry is starved")
+			}
+			if got := c.retryAt.Sub(exited); got != tt.backoff {
+				t.Errorf("retrying after %v, want %v", got, tt.backoff)
+			}
+			if len(m.next(c.retryAt.Add(-time.Millisecond))) != 0 {
+				t.Error("peer redialed before its backoff ended")
+			}
+		})
+	}
+}
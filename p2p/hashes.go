@@ -0,0 +1,52 @@
+package p2p
+
+import (
+	"math/bits"
+
+	"github.com/souravbiswassanto/bit-torrent-client/merkle"
+	"github.com/souravbiswassanto/bit-torrent-client/message"
+)
+
+// maxHashes is the largest number of base layer hashes a request may ask
+// for (BEP 52)
+const maxHashes = 512
+
+// hashes answers a BEP 52 hash request from the piece layers. Only the
+// piece layer itself can be served, the layers below it would take the
+// whole file. The result holds the Length hashes starting at Index,
+// followed by the uncle hashes of up to ProofLayers layers above them
+// that prove them against the pieces root.
+func (t *Torrent) hashes(req message.HashRequest) ([][32]byte, bool) {
+	layer, ok := t.PieceLayers[req.PiecesRoot]
+	if !ok || len(layer) == 0 {
+		return nil, false
+	}
+	leaves := t.PieceLength / merkle.BlockSize
+	if req.BaseLayer != bits.TrailingZeros(uint(leaves)) {
+		return nil, false
+	}
+	width := merkle.NextPowerOfTwo(len(layer))
+	if req.Length < 2 || req.Length > maxHashes || req.Length&(req.Length-1) != 0 ||
+		req.Index < 0 || req.Index%req.Length != 0 || req.Index+req.Length > width {
+		return nil, false
+	}
+	pad := merkle.PadHash(leaves)
+	hashes := make([][32]byte, 0, req.Length+req.ProofLayers)
+	for i := req.Index; i < req.Index+req.Length; i++ {
+		if i < len(layer) {
+			hashes = append(hashes, layer[i])
+		} else {
+			hashes = append(hashes, pad)
+		}
+	}
+	proof, err := merkle.Proof(layer, width, pad, req.Index)
+	if err != nil {
+		return nil, false
+	}
+	// the uncles below the root of the requested hashes are among them
+	proof = proof[bits.TrailingZeros(uint(req.Length)):]
+	if req.ProofLayers < len(proof) {
+		proof = proof[:req.ProofLayers]
+	}
+	return append(hashes, proof...), true
+}
@@ -0,0 +1,99 @@
+package p2p
+
+import (
+	"crypto/sha256"
+	"testing"
+
+	"github.com/souravbiswassanto/bit-torrent-client/merkle"
+	"github.com/souravbiswassanto/bit-torrent-client/message"
+)
+
+func TestHashes(t *testing.T) {
+	const pieceLength = 4 * merkle.BlockSize
+	pad := merkle.PadHash(pieceLength / merkle.BlockSize)
+	layer := make([][32]byte, 5)
+	for i := range layer {
+		layer[i] = sha256.Sum256([]byte{byte(i)})
+	}
+	root := merkle.Root(layer, 8, pad)
+	torrent := &Torrent{
+		PieceLength: pieceLength,
+		PieceLayers: map[[32]byte][][32]byte{root: layer},
+	}
+	// the piece layer sits two layers above the 16 KiB leaves
+	req := func(index, length, proofLayers int) message.HashRequest {
+		return message.HashRequest{PiecesRoot: root, BaseLayer: 2, Index: index, Length: length, ProofLayers: proofLayers}
+	}
+
+	tests := []struct {
+		name string
+		req  message.HashRequest
+		// proof is the number of uncles expected after the hashes
+		proof int
+	}{
+		{"whole layer", req(0, 8, 0), 0},
+		{"whole layer with proof", req(0, 8, 5), 0},
+		{"first pair with full proof", req(0, 2, 2), 2},
+		{"padded pair", req(4, 2, 2), 2},
+		{"half with short proof", req(4, 4, 0), 0},
+		{"half with proof", req(4, 4, 1), 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hashes, ok := torrent.hashes(tt.req)
+			if !ok {
+				t.Fatal("request rejected")
+			}
+			if len(hashes) != tt.req.Length+tt.proof {
+				t.Fatalf("got %d hashes, want %d and %d uncles", len(hashes), tt.req.Length, tt.proof)
+			}
+			for i, h := range hashes[:tt.req.Length] {
+				want := pad
+				if tt.req.Index+i < len(layer) {
+					want = layer[tt.req.Index+i]
+				}
+				if h != want {
+					t.Errorf("hash %d does not match the layer", i)
+				}
+			}
+			if tt.req.Length+tt.proof < 8 {
+				// not enough to reach the root
+				return
+			}
+			// hash the requested nodes into their subtree root and walk
+			// the uncles up to the pieces root
+			h := merkle.Root(hashes[:tt.req.Length], tt.req.Length, pad)
+			index := tt.req.Index / tt.req.Length
+			for _, uncle := range hashes[tt.req.Length:] {
+				if index%2 == 0 {
+					h = merkle.HashPair(h, uncle)
+				} else {
+					h = merkle.HashPair(uncle, h)
+				}
+				index /= 2
+			}
+			if h != root {
+				t.Error("hashes do not prove up to the pieces root")
+			}
+		})
+	}
+
+	rejects := []struct {
+		name string
+		req  message.HashRequest
+	}{
+		{"unknown root", message.HashRequest{PiecesRoot: [32]byte{1}, BaseLayer: 2, Length: 2}},
+		{"leaf layer", message.HashRequest{PiecesRoot: root, BaseLayer: 0, Length: 2}},
+		{"single hash", req(0, 1, 0)},
+		{"not a power of two", req(0, 3, 0)},
+		{"unaligned index", req(2, 4, 0)},
+		{"negative index", req(-2, 2, 0)},
+		{"beyond the layer", req(8, 2, 0)},
+		{"wider than the layer", req(0, 16, 0)},
+	}
+	for _, tt := range rejects {
+		if hashes, ok := torrent.hashes(tt.req); ok {
+			t.Errorf("%s: answered with %d hashes", tt.name, len(hashes))
+		}
+	}
+}
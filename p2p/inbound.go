@@ -0,0 +1,98 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/souravbiswassanto/bit-torrent-client/client"
+	"github.com/souravbiswassanto/bit-torrent-client/peers"
+	"github.com/souravbiswassanto/bit-torrent-client/utp"
+)
+
+// incoming is a peer that connected to us, handed to the running Download
+type incoming struct {
+	c    *client.Client
+	peer peers.Peer
+}
+
+// inbound is where Serve finds the running Download of a torrent
+type inbound struct {
+	mu   sync.Mutex
+	ch   chan incoming
+	done <-chan struct{}
+}
+
+// open starts taking connections until ctx is done
+func (in *inbound) open(ctx context.Context) <-chan incoming {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.ch = make(chan incoming)
+	in.done = ctx.Done()
+	return in.ch
+}
+
+// hand passes p to the running Download and reports whether it took it
+func (in *inbound) hand(p incoming) bool {
+	in.mu.Lock()
+	ch, done := in.ch, in.done
+	in.mu.Unlock()
+	if ch == nil {
+		return false
+	}
+	select {
+	case ch <- p:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// Serve accepts the connections peers open on ln and hands each to the
+// running Download of the torrent it asks for, among those returned by
+// torrents. opts sets up the connections until the torrent is known,
+// its own Options after that. Serve returns when ln is closed.
+func Serve(ln net.Listener, opts client.Options, torrents func() []*Torrent) error {
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) || errors.Is(err, utp.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		go serveConn(conn, opts, torrents())
+	}
+}
+
+func serveConn(conn net.Conn, opts client.Options, torrents []*Torrent) {
+	skeys := make([][20]byte, 0, len(torrents))
+	for _, t := range torrents {
+		skeys = append(skeys, t.InfoHash)
+		if t.AltInfoHash != [20]byte{} {
+			skeys = append(skeys, t.AltInfoHash)
+		}
+	}
+	in, err := client.Accept(conn, skeys, opts)
+	if err != nil {
+		return
+	}
+	infoHash := in.Handshake.InfoHash
+	for _, t := range torrents {
+		if t.InfoHash != infoHash && (t.AltInfoHash != infoHash || infoHash == [20]byte{}) {
+			continue
+		}
+		c, err := in.Answer(t.PeerID, t.numPieces(), t.Options)
+		if err != nil {
+			log.Printf("Could not handshake with incoming %s: %v\n", in.Peer.IP, err)
+			return
+		}
+		if !t.inbound.hand(incoming{c, in.Peer}) {
+			c.Conn.Close()
+		}
+		return
+	}
+	in.Close()
+}
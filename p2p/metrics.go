@@ -0,0 +1,14 @@
+package p2p
+
+import "github.com/souravbiswassanto/bit-torrent-client/metrics"
+
+var (
+	piecesVerified = metrics.NewCounterVec("bittorrent_pieces_verified_total",
+		"Pieces that passed the hash check, by torrent", "info_hash")
+	piecesFailed = metrics.NewCounterVec("bittorrent_pieces_failed_total",
+		"Pieces that failed the hash check, by torrent", "info_hash")
+	peerHashFailures = metrics.NewCounterVec("bittorrent_peer_hash_failures_total",
+		"Pieces failing the hash check, by the peer or web seed that sent them", "peer")
+	requestBacklog = metrics.NewGauge("bittorrent_request_backlog",
+		"Block requests sent to peers and not answered yet")
+)
@@ -2,20 +2,33 @@ package p2p
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/souravbiswassanto/bit-torrent-client/client"
+	"github.com/souravbiswassanto/bit-torrent-client/merkle"
 	"github.com/souravbiswassanto/bit-torrent-client/message"
+	"github.com/souravbiswassanto/bit-torrent-client/peerid"
 	"github.com/souravbiswassanto/bit-torrent-client/peers"
+	"github.com/souravbiswassanto/bit-torrent-client/webseed"
 	"log"
+	"sort"
 	"time"
 )
 
-// MaxBlockSize is the largest number of bytes a request can ask for
-const MaxBlockSize = 16384
+// DefaultBlockSize is the number of bytes a request asks for when
+// Torrent.BlockSize is unset
+const DefaultBlockSize = 16384
 
-// MaxBacklog is the number of unfulfilled requests a client can have in its pipeline
-const MaxBacklog = 5
+// DefaultBacklog is the number of unfulfilled requests a client can have in
+// its pipeline when Torrent.Backlog is unset
+const DefaultBacklog = 5
+
+// ErrIncomplete is returned by Download when every peer and web seed gave
+// up before all pieces were downloaded
+var ErrIncomplete = errors.New("download incomplete")
 
 // Torrent holds data required to download a torrent from a list of peers
 type Torrent struct {
@@ -26,12 +39,70 @@ type Torrent struct {
 	PieceLength int
 	Length      int
 	Name        string
+	// V2Pieces is set for v2-only torrents, whose pieces are aligned to
+	// file boundaries and verified by merkle root instead of PieceHashes
+	V2Pieces []V2Piece
+	// PieceLayers are the piece layers of a v2 or hybrid torrent by pieces
+	// root, used to answer the hash requests of peers
+	PieceLayers map[[32]byte][][32]byte
+	// AltInfoHash and AltPeers describe the v2 swarm of a hybrid torrent
+	AltInfoHash [20]byte
+	AltPeers    []peers.Peer
+	// WebSeeds are HTTP servers holding the complete content (BEP 19)
+	WebSeeds []*webseed.Client
+	// Options controls how peers are connected to
+	Options client.Options
+	// MaxPeers caps the number of peers connected at once, zero means no limit
+	MaxPeers int
+	// TargetPeers is the number of connections the download keeps up,
+	// dialing more candidates as connections end. Zero means MaxPeers or
+	// DefaultTargetPeers, whichever is lower.
+	TargetPeers int
+	// Announce, if set, finds more peers for InfoHash and AltInfoHash. It
+	// is called every AnnounceInterval and when the candidates run out.
+	Announce func(ctx context.Context) (found, alt []peers.Peer, err error)
+	// BlockSize is the size of the blocks requested from peers and Backlog
+	// the number of requests kept in flight to each, zero means the defaults
+	BlockSize int
+	Backlog   int
+	// SharedSlots, if set, is a semaphore limiting peer connections across
+	// every torrent using it, on top of MaxPeers
+	SharedSlots chan struct{}
+	// Priorities orders the pieces, higher ones are requested first and
+	// negative ones are not downloaded. Nil downloads every piece in order.
+	Priorities []int
+	// OnProgress, if set, is called every ProgressInterval and once more
+	// when the download ends. It runs on the goroutine calling Download.
+	OnProgress func(Progress)
+
+	stats stats
+	// inbound takes the peers that connect to us while Download runs
+	inbound inbound
+
+	// buf and have keep the pieces downloaded so far, so a cancelled
+	// download resumes where it left off
+	buf  []byte
+	have []bool
+}
+
+// maxWebSeedFailures is the number of consecutive failed pieces after
+// which a web seed is abandoned
+const maxWebSeedFailures = 5
+
+// V2Piece locates a v2 piece in the content and holds its merkle root
+type V2Piece struct {
+	Offset int
+	Length int
+	Root   [32]byte
+	// Leaves is the width of the piece's subtree in blocks
+	Leaves int
 }
 
 type pieceWork struct {
 	index  int
 	hash   [20]byte
 	length int
+	v2     *V2Piece
 }
 
 type pieceResult struct {
@@ -40,6 +111,7 @@ type pieceResult struct {
 }
 
 type pieceProgress struct {
+	t          *Torrent
 	index      int
 	client     *client.Client
 	buf        []byte
@@ -48,20 +120,183 @@ type pieceProgress struct {
 	backlog    int
 }
 
-func (t *Torrent) Download() error {
-	pieceStream := make(chan *pieceWork, len(t.PieceHashes))
+// Download fetches every wanted piece from peers and web seeds and returns
+// the assembled content. Peers are connected to up to TargetPeers at a
+// time, failed ones are retried with exponential backoff and Announce is
+// asked for more. If all of them give up early the pieces downloaded so
+// far are returned together with an error wrapping ErrIncomplete.
+//
+// When ctx is done every peer connection and web seed request is closed
+// and ctx.Err() is returned along with the pieces downloaded so far.
+// Download may be called again after it returned, with Peers refreshed, to
+// fetch the pieces still missing.
+func (t *Torrent) Download(ctx context.Context) ([]byte, error) {
+	if t.buf == nil {
+		t.buf = make([]byte, t.Length)
+		t.have = make([]bool, t.numPieces())
+	}
+	if err := ctx.Err(); err != nil {
+		return t.buf, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	pieceStream := make(chan *pieceWork, t.numPieces())
 	resultStream := make(chan *pieceResult)
 
-	for index, piece := range t.PieceHashes {
-		length := t.calculatePieceLength(index)
-		pieceStream <- &pieceWork{index, piece, length}
+	m := newConnManager(t)
+	accepted := t.inbound.open(ctx)
+	progress := Progress{PeersTotal: m.known()}
+	works := t.pieceWorks()
+	sort.SliceStable(works, func(i, j int) bool {
+		return t.priority(works[i].index) > t.priority(works[j].index)
+	})
+	for _, pw := range works {
+		if t.priority(pw.index) < 0 {
+			continue
+		}
+		progress.PiecesTotal++
+		progress.BytesTotal += pw.length
+		if t.have[pw.index] {
+			progress.PiecesDone++
+			progress.BytesDone += pw.length
+			continue
+		}
+		pieceStream <- pw
 	}
 
-	for _, peer := range t.Peers {
-		go t.startDownloadWorker(peer, pieceStream, resultStream)
+	webSeeds := len(t.WebSeeds)
+	exited := make(chan struct{}, webSeeds)
+	for _, ws := range t.WebSeeds {
+		ws := ws
+		go func() {
+			defer func() { exited <- struct{}{} }()
+			t.startWebSeedWorker(ctx, ws, pieceStream, resultStream)
+		}()
+	}
+	// peers are dialed up to the manager's target, only limited by
+	// Options.HalfOpen, and a connected peer then waits for a shared slot
+	peerExits := make(chan peerExit)
+	dial := func() {
+		for _, c := range m.next(time.Now()) {
+			c := c
+			go func() {
+				pieces, err := t.startDownloadWorker(ctx, c.peer, c.infoHash, m, pieceStream, resultStream)
+				select {
+				case peerExits <- peerExit{c, pieces, err}:
+				case <-ctx.Done():
+				}
+			}()
+		}
+	}
+	type announceResult struct {
+		found, alt []peers.Peer
+		err        error
 	}
+	announced := make(chan announceResult, 1)
+	announce := func() {
+		if !m.shouldAnnounce(time.Now()) {
+			return
+		}
+		m.announcing = true
+		m.lastAnnounce = time.Now()
+		go func() {
+			found, alt, err := m.announce(ctx)
+			announced <- announceResult{found, alt, err}
+		}()
+	}
+	dial()
 
-	return nil
+	var meter progressMeter
+	report := func() {
+		if t.OnProgress != nil {
+			meter.update(&t.stats, &progress)
+			t.OnProgress(progress)
+		}
+	}
+	ticker := time.NewTicker(ProgressInterval)
+	defer ticker.Stop()
+	report()
+	defer report()
+
+	for progress.PiecesDone < progress.PiecesTotal {
+		announce()
+		if webSeeds == 0 && m.starved() {
+			close(pieceStream)
+			return t.buf, fmt.Errorf("%w: %d of %d pieces", ErrIncomplete, progress.PiecesDone, progress.PiecesTotal)
+		}
+		select {
+		case res := <-resultStream:
+			begin, end := t.calculateBoundsForPiece(res.index)
+			copy(t.buf[begin:end], res.data)
+			t.have[res.index] = true
+			progress.PiecesDone++
+			progress.BytesDone += end - begin
+
+			log.Printf("(%0.2f%%) Downloaded piece #%d\n", progress.Percent(), res.index)
+		case e := <-peerExits:
+			m.exit(e, time.Now())
+			dial()
+		case in := <-accepted:
+			if !m.admit() {
+				in.c.Conn.Close()
+				break
+			}
+			go func() {
+				pieces, err := t.downloadFrom(ctx, in.c, in.peer, m, pieceStream, resultStream)
+				select {
+				case peerExits <- peerExit{nil, pieces, err}:
+				case <-ctx.Done():
+				}
+			}()
+		case a := <-announced:
+			if a.err != nil && ctx.Err() == nil {
+				log.Printf("Announce failed: %v\n", a.err)
+			}
+			log.Printf("Announce found %d new peers\n", m.announced(a.found, a.alt))
+			dial()
+		case <-exited:
+			webSeeds--
+		case <-ticker.C:
+			// retry the peers whose backoff ended
+			dial()
+			progress.PeersTotal = m.known()
+			report()
+		case <-ctx.Done():
+			return t.buf, ctx.Err()
+		}
+	}
+	close(pieceStream)
+
+	return t.buf, nil
+}
+
+func (t *Torrent) priority(index int) int {
+	if index < len(t.Priorities) {
+		return t.Priorities[index]
+	}
+	return 0
+}
+
+func (t *Torrent) numPieces() int {
+	if t.V2Pieces != nil {
+		return len(t.V2Pieces)
+	}
+	return len(t.PieceHashes)
+}
+
+func (t *Torrent) pieceWorks() []*pieceWork {
+	works := make([]*pieceWork, 0, t.numPieces())
+	if t.V2Pieces != nil {
+		for index := range t.V2Pieces {
+			piece := &t.V2Pieces[index]
+			works = append(works, &pieceWork{index: index, length: piece.Length, v2: piece})
+		}
+		return works
+	}
+	for index, hash := range t.PieceHashes {
+		works = append(works, &pieceWork{index, hash, t.calculatePieceLength(index), nil})
+	}
+	return works
 }
 
 func (t *Torrent) calculatePieceLength(index int) int {
@@ -70,6 +305,10 @@ func (t *Torrent) calculatePieceLength(index int) int {
 }
 
 func (t *Torrent) calculateBoundsForPiece(index int) (begin int, end int) {
+	if t.V2Pieces != nil {
+		piece := t.V2Pieces[index]
+		return piece.Offset, piece.Offset + piece.Length
+	}
 	begin = index * t.PieceLength
 	end = begin + t.PieceLength
 	if end > t.Length {
@@ -78,66 +317,215 @@ func (t *Torrent) calculateBoundsForPiece(index int) (begin int, end int) {
 	return begin, end
 }
 
-func (t *Torrent) startDownloadWorker(peer peers.Peer, pieceStream chan *pieceWork, resultStream chan *pieceResult) {
-	c, err := client.New(peer, t.InfoHash, t.PeerID)
+// nextPiece takes a piece off the queue. It returns nil once the queue is
+// closed or the download has ended.
+func nextPiece(ctx context.Context, pieceStream chan *pieceWork) *pieceWork {
+	select {
+	case pw := <-pieceStream:
+		return pw
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+// acquire takes a slot of each of the semaphores that isn't nil, in
+// order. It returns false without holding any if ctx is done first.
+func acquire(ctx context.Context, sems ...chan struct{}) (release func(), ok bool) {
+	var held []chan struct{}
+	release = func() {
+		for _, sem := range held {
+			<-sem
+		}
+	}
+	for _, sem := range sems {
+		if sem == nil {
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+			held = append(held, sem)
+		case <-ctx.Done():
+			release()
+			return nil, false
+		}
+	}
+	return release, true
+}
+
+// startDownloadWorker connects to a peer and downloads pieces from it
+// until it has none left that we want or fails. It returns the number of
+// pieces it got and the error that ended the connection.
+func (t *Torrent) startDownloadWorker(ctx context.Context, peer peers.Peer, infoHash [20]byte, m *connManager, pieceStream chan *pieceWork, resultStream chan *pieceResult) (pieces int, err error) {
+	c, err := client.New(ctx, peer, infoHash, t.PeerID, t.Options)
 	if err != nil {
 		log.Printf("Could not handshake with %s. Disconnecting\n", peer.IP)
-		return
+		return 0, err
 	}
+	return t.downloadFrom(ctx, c, peer, m, pieceStream, resultStream)
+}
+
+// downloadFrom downloads pieces from a connected peer, whether we dialed
+// it or it connected to us, and closes the connection when done
+func (t *Torrent) downloadFrom(ctx context.Context, c *client.Client, peer peers.Peer, m *connManager, pieceStream chan *pieceWork, resultStream chan *pieceResult) (pieces int, err error) {
 	defer c.Conn.Close()
-	log.Printf("Completed handshake with %s\n", peer.IP)
+	// unblock reads and writes when the download ends
+	stop := context.AfterFunc(ctx, func() { c.Conn.Close() })
+	defer stop()
+	err = c.Bitfield.Validate(t.numPieces())
+	if err != nil {
+		return 0, err
+	}
+	unclaim, err := m.claim(c.PeerID, t.PeerID)
+	if err != nil {
+		return 0, err
+	}
+	defer unclaim()
+	release, ok := acquire(ctx, t.SharedSlots)
+	if !ok {
+		return 0, ctx.Err()
+	}
+	defer release()
+	c.Conn = &countingConn{c.Conn, &t.stats}
+	info := &PeerInfo{Addr: peer, Client: peerid.Parse(c.PeerID)}
+	defer t.stats.connect(info)()
+	log.Printf("Completed handshake with %s (%s)\n", peer.IP, info.Client)
 	c.SendUnchoke()
 	c.SendInterested()
 
-	for pw := range pieceStream {
+	// misses counts pieces in a row the peer doesn't have. Once it went
+	// through the whole queue the peer has nothing left for us.
+	misses := 0
+	for pw := nextPiece(ctx, pieceStream); pw != nil; pw = nextPiece(ctx, pieceStream) {
 		if !c.Bitfield.HasPiece(pw.index) {
 			pieceStream <- pw
+			misses++
+			if misses > t.numPieces() {
+				log.Printf("%s has none of the remaining pieces\n", peer.IP)
+				return pieces, nil
+			}
+			continue
+		}
+		misses = 0
+		if c.Choked {
+			// leave the piece to others while we wait
+			pieceStream <- pw
+			err := t.awaitUnchoke(c)
+			if err != nil {
+				return pieces, err
+			}
+			continue
+		}
+		buf, err := t.attemptToDownloadPieces(c, pw)
+		if errors.Is(err, errChoked) {
+			pieceStream <- pw
+			continue
 		}
-		buf, err := attemptToDownloadPieces(c, pw)
 		if err != nil {
 			log.Println("Exiting", err)
 			pieceStream <- pw
-			return
+			return pieces, err
 		}
 		err = checkIntegrity(pw, buf)
 		if err != nil {
 			log.Printf("Piece #%d failed integrity check\n", pw.index)
-			return
+			t.countPiece(false, peer.String())
+			pieceStream <- pw
+			continue
 		}
+		t.countPiece(true, peer.String())
 		c.SendHave(pw.index)
-		resultStream <- &pieceResult{
-			index: pw.index,
-			data:  buf,
+		select {
+		case resultStream <- &pieceResult{index: pw.index, data: buf}:
+			pieces++
+		case <-ctx.Done():
+			return pieces, ctx.Err()
+		}
+	}
+	return pieces, ctx.Err()
+}
+
+// startWebSeedWorker downloads pieces from a web seed with range requests.
+// Pieces are verified exactly like peer data, and a seed that keeps failing
+// is given up on with its pieces left to the others.
+func (t *Torrent) startWebSeedWorker(ctx context.Context, ws *webseed.Client, pieceStream chan *pieceWork, resultStream chan *pieceResult) {
+	failures := 0
+	for pw := nextPiece(ctx, pieceStream); pw != nil; pw = nextPiece(ctx, pieceStream) {
+		begin, _ := t.calculateBoundsForPiece(pw.index)
+		buf := make([]byte, pw.length)
+		err := ws.ReadAt(ctx, buf, begin)
+		if err == nil {
+			t.stats.downloaded.Add(int64(len(buf)))
+			err = checkIntegrity(pw, buf)
+			t.countPiece(err == nil, ws.String())
+		}
+		if err != nil && ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("Web seed %s failed piece #%d: %v\n", ws, pw.index, err)
+			pieceStream <- pw
+			failures++
+			if failures >= maxWebSeedFailures {
+				log.Printf("Giving up on web seed %s\n", ws)
+				return
+			}
+			select {
+			case <-time.After(time.Duration(failures) * time.Second):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		failures = 0
+		select {
+		case resultStream <- &pieceResult{index: pw.index, data: buf}:
+		case <-ctx.Done():
+			return
 		}
 	}
 }
 
-func attemptToDownloadPieces(c *client.Client, pw *pieceWork) ([]byte, error) {
+func (t *Torrent) attemptToDownloadPieces(c *client.Client, pw *pieceWork) ([]byte, error) {
 	state := pieceProgress{
+		t:      t,
 		index:  pw.index,
 		client: c,
 		buf:    make([]byte, pw.length),
 	}
-	// Setting a deadline helps get unresponsive peers unstuck.
-	c.Conn.SetDeadline(time.Time{}.Add(30 * time.Second))
-	defer c.Conn.SetDeadline(time.Time{})
+	// requests still unanswered when we give up leave the backlog too
+	defer func() { requestBacklog.Add(-int64(state.backlog)) }()
+
+	// unanswered requests shorten the time the peer may stay silent
+	defer c.SetRequestsPending(false)
 
+	maxBacklog := t.Backlog
+	if maxBacklog <= 0 {
+		maxBacklog = DefaultBacklog
+	}
+	maxBlockSize := t.BlockSize
+	if maxBlockSize <= 0 {
+		maxBlockSize = DefaultBlockSize
+	}
 	for state.downloaded < pw.length {
-		if !state.client.Choked {
-			for state.backlog < MaxBacklog && state.requested < pw.length {
-				blockSize := MaxBlockSize
+		if state.client.Choked {
+			// the peer discarded our requests
+			return nil, errChoked
+		}
+		for state.backlog < maxBacklog && state.requested < pw.length {
+			blockSize := maxBlockSize
 
-				if pw.length-state.requested < blockSize {
-					blockSize = pw.length - state.requested
-				}
-				err := c.SendRequest(state.index, state.requested, blockSize)
-				if err != nil {
-					return nil, err
-				}
-				state.backlog++
-				state.requested += blockSize
+			if pw.length-state.requested < blockSize {
+				blockSize = pw.length - state.requested
 			}
+			err := c.SendRequest(state.index, state.requested, blockSize)
+			if err != nil {
+				return nil, err
+			}
+			state.backlog++
+			requestBacklog.Inc()
+			state.requested += blockSize
 		}
+		c.SetRequestsPending(state.backlog > 0)
 		err := state.readMessage()
 		if err != nil {
 			return nil, err
@@ -146,6 +534,18 @@ func attemptToDownloadPieces(c *client.Client, pw *pieceWork) ([]byte, error) {
 	return state.buf, nil
 }
 
+// awaitUnchoke reads messages until the peer unchokes us
+func (t *Torrent) awaitUnchoke(c *client.Client) error {
+	pp := pieceProgress{t: t, client: c}
+	for c.Choked {
+		err := pp.readMessage()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (pp *pieceProgress) readMessage() error {
 	msg, err := pp.client.Read() // this call blocks
 
@@ -162,6 +562,16 @@ func (pp *pieceProgress) readMessage() error {
 		pp.client.Choked = false
 	case message.MsgChoke:
 		pp.client.Choked = true
+	case message.MsgHashRequest:
+		req, err := message.ParseHashRequest(msg)
+		if err != nil {
+			return err
+		}
+		hashes, ok := pp.t.hashes(req)
+		if !ok {
+			return pp.client.SendHashReject(req)
+		}
+		return pp.client.SendHashes(req, hashes)
 	case message.MsgHave:
 		index, err := message.ParseHave(msg)
 		if err != nil {
@@ -169,17 +579,39 @@ func (pp *pieceProgress) readMessage() error {
 		}
 		pp.client.Bitfield.SetPiece(index)
 	case message.MsgPiece:
+		if pp.buf == nil {
+			// a block sent before the peer choked us, nothing is in progress
+			return nil
+		}
 		n, err := message.ParsePiece(pp.index, pp.buf, msg)
 		if err != nil {
 			return err
 		}
 		pp.downloaded += n
 		pp.backlog--
+		requestBacklog.Dec()
 	}
 	return nil
 }
 
+// countPiece records the outcome of a piece's hash check
+func (t *Torrent) countPiece(ok bool, source string) {
+	infoHash := hex.EncodeToString(t.InfoHash[:])
+	if ok {
+		piecesVerified.With(infoHash).Inc()
+		return
+	}
+	piecesFailed.With(infoHash).Inc()
+	peerHashFailures.With(source).Inc()
+}
+
 func checkIntegrity(pw *pieceWork, buf []byte) error {
+	if pw.v2 != nil {
+		if merkle.DataRoot(buf, pw.v2.Leaves) != pw.v2.Root {
+			return fmt.Errorf("Index %d failed merkle integrity check", pw.index)
+		}
+		return nil
+	}
 	hash := sha1.Sum(buf)
 	if !bytes.Equal(hash[:], pw.hash[:]) {
 		return fmt.Errorf("Index %d failed integrity check", pw.index)
@@ -0,0 +1,144 @@
+package p2p
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/souravbiswassanto/bit-torrent-client/peerid"
+	"github.com/souravbiswassanto/bit-torrent-client/peers"
+)
+
+// ProgressInterval is how often OnProgress is called during a download
+var ProgressInterval = time.Second
+
+// Progress is a snapshot of a running download
+type Progress struct {
+	PiecesDone  int
+	PiecesTotal int
+	// BytesDone is the size of the verified pieces
+	BytesDone  int
+	BytesTotal int
+	// Downloaded and Uploaded count every byte sent over peer connections
+	// and received from web seeds, protocol overhead included
+	Downloaded int64
+	Uploaded   int64
+	// DownloadRate and UploadRate are in bytes per second
+	DownloadRate float64
+	UploadRate   float64
+	// Peers is the number of connected peers, PeersTotal the number known
+	Peers      int
+	PeersTotal int
+	// Connected lists the connected peers by address
+	Connected []PeerInfo
+	// ETA is the estimated time left, zero when unknown
+	ETA time.Duration
+}
+
+// Percent returns the verified share of the torrent from 0 to 100
+func (p Progress) Percent() float64 {
+	if p.BytesTotal == 0 {
+		return 100
+	}
+	return float64(p.BytesDone) / float64(p.BytesTotal) * 100
+}
+
+// PeerInfo describes a connected peer
+type PeerInfo struct {
+	Addr   peers.Peer
+	Client peerid.Client
+}
+
+// stats are the counters behind Progress, updated by the workers
+type stats struct {
+	downloaded atomic.Int64
+	uploaded   atomic.Int64
+
+	mu        sync.Mutex
+	connected map[*PeerInfo]struct{}
+}
+
+// connect adds a peer to the connected ones until the returned function
+// is called
+func (s *stats) connect(info *PeerInfo) (disconnect func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.connected == nil {
+		s.connected = make(map[*PeerInfo]struct{})
+	}
+	s.connected[info] = struct{}{}
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.connected, info)
+	}
+}
+
+func (s *stats) connectedPeers() []PeerInfo {
+	s.mu.Lock()
+	list := make([]PeerInfo, 0, len(s.connected))
+	for info := range s.connected {
+		list = append(list, *info)
+	}
+	s.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Addr.String() < list[j].Addr.String()
+	})
+	return list
+}
+
+// countingConn adds the traffic of a peer connection to stats
+type countingConn struct {
+	net.Conn
+	stats *stats
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.stats.downloaded.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.stats.uploaded.Add(int64(n))
+	return n, err
+}
+
+// progressMeter turns the counters into rates. Rates are smoothed so a
+// single slow second doesn't make the ETA jump around.
+type progressMeter struct {
+	last           time.Time
+	lastDownloaded int64
+	lastUploaded   int64
+	downloadRate   float64
+	uploadRate     float64
+}
+
+func (m *progressMeter) update(s *stats, p *Progress) {
+	now := time.Now()
+	p.Downloaded = s.downloaded.Load()
+	p.Uploaded = s.uploaded.Load()
+	p.Connected = s.connectedPeers()
+	p.Peers = len(p.Connected)
+	if !m.last.IsZero() {
+		elapsed := now.Sub(m.last).Seconds()
+		if elapsed > 0 {
+			down := float64(p.Downloaded-m.lastDownloaded) / elapsed
+			up := float64(p.Uploaded-m.lastUploaded) / elapsed
+			m.downloadRate = 0.7*m.downloadRate + 0.3*down
+			m.uploadRate = 0.7*m.uploadRate + 0.3*up
+		}
+	}
+	m.last = now
+	m.lastDownloaded = p.Downloaded
+	m.lastUploaded = p.Uploaded
+	p.DownloadRate = m.downloadRate
+	p.UploadRate = m.uploadRate
+	p.ETA = 0
+	if left := p.BytesTotal - p.BytesDone; left > 0 && m.downloadRate >= 1 {
+		p.ETA = time.Duration(float64(left) / m.downloadRate * float64(time.Second))
+	}
+}
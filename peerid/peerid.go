@@ -0,0 +1,207 @@
+// Package peerid creates the peer ID this client announces itself with and
+// identifies the software of remote peers from theirs.
+//
+// Two conventions are understood. Azureus-style IDs start with a dash, a
+// two letter client code, four version characters and another dash, as in
+// "-qB4620-". Shadow-style IDs start with a one letter client code followed
+// by up to five version characters, padded with dashes to "---" at offset
+// 6, as in "T03I-----".
+package peerid
+
+import (
+	"crypto/rand"
+	"strconv"
+	"strings"
+)
+
+// Name and Version identify this client, Code is its Azureus-style code
+const (
+	Name    = "bit-torrent-client"
+	Version = "0.1.0"
+	Code    = "GO"
+)
+
+// Prefix starts every peer ID created by New, it encodes Code and Version
+const Prefix = "-" + Code + "0100-"
+
+// New returns a peer ID made of Prefix and random bytes
+func New() ([20]byte, error) {
+	var id [20]byte
+	n := copy(id[:], Prefix)
+	_, err := rand.Read(id[n:])
+	return id, err
+}
+
+// Client is the software a peer ID was created by
+type Client struct {
+	// Code is the client code found in the ID, "" if it follows neither
+	// convention
+	Code string
+	// Name is the client's name, or Code if the code is not known
+	Name    string
+	Version string
+}
+
+// String returns the name and version, "unknown" for an unrecognized ID
+func (c Client) String() string {
+	switch {
+	case c.Name == "":
+		return "unknown"
+	case c.Version == "":
+		return c.Name
+	}
+	return c.Name + " " + c.Version
+}
+
+// Matches reports whether any of the patterns names c. A pattern matches
+// the client code exactly or the client name regardless of case.
+func (c Client) Matches(patterns []string) bool {
+	if c.Code == "" {
+		return false
+	}
+	for _, p := range patterns {
+		if p == c.Code || strings.EqualFold(p, c.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+var azureusClients = map[string]string{
+	Code: Name,
+	"7T": "aTorrent",
+	"AG": "Ares",
+	"A~": "Ares",
+	"AX": "BitPump",
+	"AZ": "Azureus",
+	"BB": "BitBuddy",
+	"BC": "BitComet",
+	"BF": "Bitflu",
+	"BI": "BiglyBT",
+	"BT": "BitTorrent",
+	"BW": "BitWombat",
+	"CD": "Enhanced CTorrent",
+	"DE": "Deluge",
+	"FD": "Free Download Manager",
+	"FG": "FlashGet",
+	"FW": "FrostWire",
+	"HL": "Halite",
+	"KT": "KTorrent",
+	"LP": "Lphant",
+	"LT": "libtorrent",
+	"LW": "LimeWire",
+	"MG": "MediaGet",
+	"PI": "PicoTorrent",
+	"SD": "Thunder",
+	"ST": "SymTorrent",
+	"TL": "Tribler",
+	"TR": "Transmission",
+	"TT": "TuoTu",
+	"UE": "µTorrent Embedded",
+	"UM": "µTorrent Mac",
+	"UT": "µTorrent",
+	"UW": "µTorrent Web",
+	"VG": "Vagaa",
+	"WW": "WebTorrent",
+	"XL": "Xunlei",
+	"lt": "libTorrent",
+	"qB": "qBittorrent",
+}
+
+var shadowClients = map[byte]string{
+	'A': "ABC",
+	'O': "Osprey Permaseed",
+	'Q': "BTQueue",
+	'R': "Tribler",
+	'S': "Shadow",
+	'T': "BitTornado",
+	'U': "UPnP NAT Bit Torrent",
+}
+
+// shadowDigits are the characters of Shadow-style versions, each standing
+// for its index
+const shadowDigits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz."
+
+// Parse identifies the client that created id
+func Parse(id [20]byte) Client {
+	if c, ok := parseAzureus(id); ok {
+		return c
+	}
+	if c, ok := parseShadow(id); ok {
+		return c
+	}
+	return Client{}
+}
+
+func parseAzureus(id [20]byte) (Client, bool) {
+	if id[0] != '-' || id[7] != '-' || !isAlnum(id[1]) || !isAlnum(id[2]) && id[2] != '~' {
+		return Client{}, false
+	}
+	for _, b := range id[3:7] {
+		if !isAlnum(b) {
+			return Client{}, false
+		}
+	}
+	code := string(id[1:3])
+	c := Client{Code: code, Name: code}
+	if name, ok := azureusClients[code]; ok {
+		c.Name = name
+	}
+	v := id[3:7]
+	switch {
+	case code == "TR" && v[0] < '4':
+		// Transmission before 4.0 used two digits for the minor version
+		c.Version = string(v[0]) + "." + string(v[1:3])
+	default:
+		parts := []string{azureusDigit(v[0]), azureusDigit(v[1]), azureusDigit(v[2])}
+		// the last character is a build number or a release tag
+		if v[3] >= '1' && v[3] <= '9' {
+			parts = append(parts, string(v[3]))
+		}
+		c.Version = strings.Join(parts, ".")
+	}
+	return c, true
+}
+
+// azureusDigit reads a version character, letters continue after 9
+func azureusDigit(b byte) string {
+	switch {
+	case b >= '0' && b <= '9':
+		return string(b)
+	case b >= 'A' && b <= 'Z':
+		return strconv.Itoa(int(b-'A') + 10)
+	case b >= 'a' && b <= 'z':
+		return strconv.Itoa(int(b-'a') + 36)
+	}
+	return "?"
+}
+
+func parseShadow(id [20]byte) (Client, bool) {
+	name, ok := shadowClients[id[0]]
+	if !ok || string(id[6:9]) != "---" {
+		return Client{}, false
+	}
+	var parts []string
+	for i, b := range id[1:6] {
+		if b == '-' {
+			// the rest is padding
+			if strings.Trim(string(id[1+i:6]), "-") != "" {
+				return Client{}, false
+			}
+			break
+		}
+		n := strings.IndexByte(shadowDigits, b)
+		if n < 0 {
+			return Client{}, false
+		}
+		parts = append(parts, strconv.Itoa(n))
+	}
+	if len(parts) == 0 {
+		return Client{}, false
+	}
+	return Client{Code: string(id[0]), Name: name, Version: strings.Join(parts, ".")}, true
+}
+
+func isAlnum(b byte) bool {
+	return b >= '0' && b <= '9' || b >= 'A' && b <= 'Z' || b >= 'a' && b <= 'z'
+}
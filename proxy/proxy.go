@@ -0,0 +1,198 @@
+// Package proxy connects through SOCKS5 (RFC 1928) and HTTP CONNECT
+// proxies. TCP connections work with both kinds, UDP is relayed by SOCKS5
+// proxies only, using UDP ASSOCIATE.
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ErrUnavailable is wrapped by the errors of connections that failed
+// because the proxy could not be reached or cannot relay them, as opposed
+// to the proxy failing to reach the destination
+var ErrUnavailable = errors.New("proxy unavailable")
+
+// Dialer connects to destinations through a proxy
+type Dialer struct {
+	// URL is socks5://[user:password@]host:port or
+	// http://[user:password@]host:port
+	URL *url.URL
+	// FallbackDirect connects directly when the proxy is unavailable.
+	// Without it such connections fail.
+	FallbackDirect bool
+}
+
+// Parse returns a Dialer for the proxy at rawURL
+func Parse(rawURL string) (*Dialer, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h", "http":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q, want socks5 or http", u.Scheme)
+	}
+	if u.Hostname() == "" || u.Port() == "" {
+		return nil, fmt.Errorf("proxy url %q needs a host and a port", rawURL)
+	}
+	return &Dialer{URL: u}, nil
+}
+
+func (d *Dialer) socks() bool {
+	return d.URL.Scheme != "http"
+}
+
+// DialContext connects to addr over TCP through the proxy. The proxy
+// handshake is aborted when ctx is done.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("proxy: cannot dial %s", network)
+	}
+	conn, err := d.dialProxy(ctx)
+	if err != nil {
+		if d.FallbackDirect {
+			var nd net.Dialer
+			return nd.DialContext(ctx, network, addr)
+		}
+		return nil, err
+	}
+	tunnel := conn
+	err = handshake(ctx, conn, func(conn net.Conn) (err error) {
+		if d.socks() {
+			_, err = socksRequest(conn, cmdConnect, addr)
+			return err
+		}
+		tunnel, err = httpConnect(conn, addr, d.URL.User)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tunnel, nil
+}
+
+// Transport returns an HTTP transport sending requests through the proxy.
+// HTTP proxies get plain requests forwarded and tunnel HTTPS with CONNECT.
+func (d *Dialer) Transport() http.RoundTripper {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	if d.socks() {
+		t.DialContext = d.DialContext
+		return t
+	}
+	direct := t.Clone()
+	t.Proxy = http.ProxyURL(d.URL)
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		// the transport only dials the proxy itself
+		var nd net.Dialer
+		conn, err := nd.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrUnavailable, err)
+		}
+		return conn, nil
+	}
+	if !d.FallbackDirect {
+		return t
+	}
+	return fallbackTransport{t, direct}
+}
+
+// fallbackTransport retries requests without a body directly when the
+// proxy is unavailable
+type fallbackTransport struct {
+	proxied, direct http.RoundTripper
+}
+
+func (t fallbackTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.proxied.RoundTrip(req)
+	if err != nil && errors.Is(err, ErrUnavailable) && req.Body == nil && req.Context().Err() == nil {
+		return t.direct.RoundTrip(req)
+	}
+	return resp, err
+}
+
+// dialProxy opens the TCP connection to the proxy and authenticates with
+// SOCKS5 proxies
+func (d *Dialer) dialProxy(ctx context.Context) (net.Conn, error) {
+	var nd net.Dialer
+	conn, err := nd.DialContext(ctx, "tcp", d.URL.Host)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	if !d.socks() {
+		return conn, nil
+	}
+	err = handshake(ctx, conn, func(conn net.Conn) error {
+		return socksAuthenticate(conn, d.URL.User)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	return conn, nil
+}
+
+// httpConnect asks an HTTP proxy for a tunnel to addr
+func httpConnect(conn net.Conn, addr string, user *url.Userinfo) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	err := req.Write(conn)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("proxy refused to connect to %s: %s", addr, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{conn, br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn reads what the proxy sent after its response first
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// hostPort splits addr, rejecting an address without a port
+func hostPort(addr string) (string, uint16, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	p, err := net.LookupPort("tcp", port)
+	if err != nil {
+		return "", 0, err
+	}
+	return strings.Trim(host, "[]"), uint16(p), nil
+}
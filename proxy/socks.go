@@ -0,0 +1,293 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"time"
+)
+
+// SOCKS5 commands
+const (
+	cmdConnect      = 1
+	cmdUDPAssociate = 3
+)
+
+// SOCKS5 address types
+const (
+	atypIPv4   = 1
+	atypDomain = 3
+	atypIPv6   = 4
+)
+
+const (
+	socksVersion     = 5
+	methodNoAuth     = 0
+	methodPassword   = 2
+	methodNoneUsable = 0xff
+)
+
+var socksReplies = map[byte]string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// socksAuthenticate negotiates the authentication method, with a username
+// and password (RFC 1929) when user is set
+func socksAuthenticate(conn net.Conn, user *url.Userinfo) error {
+	method := byte(methodNoAuth)
+	if user != nil {
+		method = methodPassword
+	}
+	_, err := conn.Write([]byte{socksVersion, 1, method})
+	if err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return err
+	}
+	switch {
+	case reply[0] != socksVersion:
+		return fmt.Errorf("not a SOCKS5 proxy")
+	case reply[1] == methodNoneUsable || reply[1] != method:
+		return fmt.Errorf("SOCKS5 proxy refused the authentication method")
+	case method == methodNoAuth:
+		return nil
+	}
+
+	password, _ := user.Password()
+	if len(user.Username()) > 255 || len(password) > 255 {
+		return errors.New("SOCKS5 username or password too long")
+	}
+	req := []byte{1, byte(len(user.Username()))}
+	req = append(req, user.Username()...)
+	req = append(req, byte(len(password)))
+	req = append(req, password...)
+	_, err = conn.Write(req)
+	if err != nil {
+		return err
+	}
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		return errors.New("SOCKS5 authentication failed")
+	}
+	return nil
+}
+
+// appendAddr encodes addr as a SOCKS5 address, host names are left to the
+// proxy to resolve
+func appendAddr(b []byte, addr string) ([]byte, error) {
+	host, port, err := hostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case ip.To4() != nil:
+		b = append(b, atypIPv4)
+		b = append(b, ip.To4()...)
+	case ip != nil:
+		b = append(b, atypIPv6)
+		b = append(b, ip...)
+	default:
+		if len(host) > 255 {
+			return nil, fmt.Errorf("host name %q too long", host)
+		}
+		b = append(b, atypDomain, byte(len(host)))
+		b = append(b, host...)
+	}
+	return binary.BigEndian.AppendUint16(b, port), nil
+}
+
+// readAddr decodes a SOCKS5 address
+func readAddr(r io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	_, err := io.ReadFull(r, atyp)
+	if err != nil {
+		return "", err
+	}
+	var host []byte
+	switch atyp[0] {
+	case atypIPv4:
+		host = make([]byte, net.IPv4len)
+	case atypIPv6:
+		host = make([]byte, net.IPv6len)
+	case atypDomain:
+		n := make([]byte, 1)
+		_, err = io.ReadFull(r, n)
+		if err != nil {
+			return "", err
+		}
+		host = make([]byte, n[0])
+	default:
+		return "", fmt.Errorf("unknown SOCKS5 address type %d", atyp[0])
+	}
+	port := make([]byte, 2)
+	_, err = io.ReadFull(r, host)
+	if err == nil {
+		_, err = io.ReadFull(r, port)
+	}
+	if err != nil {
+		return "", err
+	}
+	name := string(host)
+	if atyp[0] != atypDomain {
+		name = net.IP(host).String()
+	}
+	return net.JoinHostPort(name, fmt.Sprint(binary.BigEndian.Uint16(port))), nil
+}
+
+// socksRequest sends a command for addr and returns the address the proxy
+// bound for it
+func socksRequest(conn net.Conn, cmd byte, addr string) (string, error) {
+	req, err := appendAddr([]byte{socksVersion, cmd, 0}, addr)
+	if err != nil {
+		return "", err
+	}
+	_, err = conn.Write(req)
+	if err != nil {
+		return "", err
+	}
+	reply := make([]byte, 3)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return "", err
+	}
+	if reply[0] != socksVersion {
+		return "", fmt.Errorf("not a SOCKS5 proxy")
+	}
+	if reply[1] != 0 {
+		reason, ok := socksReplies[reply[1]]
+		if !ok {
+			reason = fmt.Sprintf("error %d", reply[1])
+		}
+		return "", fmt.Errorf("SOCKS5 proxy could not reach %s: %s", addr, reason)
+	}
+	return readAddr(conn)
+}
+
+// DialUDP returns a connection exchanging datagrams with addr. Through a
+// SOCKS5 proxy they are relayed using UDP ASSOCIATE, HTTP proxies make the
+// connection fail with ErrUnavailable unless FallbackDirect is set.
+func (d *Dialer) DialUDP(ctx context.Context, addr string) (net.Conn, error) {
+	if !d.socks() {
+		if d.FallbackDirect {
+			var nd net.Dialer
+			return nd.DialContext(ctx, "udp", addr)
+		}
+		return nil, fmt.Errorf("%w: HTTP proxies cannot relay UDP", ErrUnavailable)
+	}
+	ctrl, err := d.dialProxy(ctx)
+	if err != nil {
+		if d.FallbackDirect {
+			var nd net.Dialer
+			return nd.DialContext(ctx, "udp", addr)
+		}
+		return nil, err
+	}
+	var relay string
+	err = handshake(ctx, ctrl, func(conn net.Conn) (err error) {
+		// the datagrams come from an address we don't know before sending
+		relay, err = socksRequest(conn, cmdUDPAssociate, "0.0.0.0:0")
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	relayAddr, err := net.ResolveUDPAddr("udp", relay)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	if relayAddr.IP.IsUnspecified() {
+		// the relay listens on the proxy's address
+		relayAddr.IP = ctrl.RemoteAddr().(*net.TCPAddr).IP
+	}
+	conn, err := net.DialUDP("udp", nil, relayAddr)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	header, err := appendAddr([]byte{0, 0, 0}, addr)
+	if err != nil {
+		ctrl.Close()
+		conn.Close()
+		return nil, err
+	}
+	return &udpConn{UDPConn: conn, ctrl: ctrl, header: header}, nil
+}
+
+// udpConn relays datagrams to one destination through a SOCKS5 proxy. The
+// association lasts as long as the control connection.
+type udpConn struct {
+	*net.UDPConn
+	ctrl   net.Conn
+	header []byte
+}
+
+func (c *udpConn) Write(p []byte) (int, error) {
+	_, err := c.UDPConn.Write(append(c.header[:len(c.header):len(c.header)], p...))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Read returns the payload of the next datagram, fragments are dropped
+func (c *udpConn) Read(p []byte) (int, error) {
+	buf := make([]byte, len(p)+len(c.header)+16)
+	for {
+		n, err := c.UDPConn.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+		if n < 4 || buf[2] != 0 {
+			continue
+		}
+		r := bytes.NewReader(buf[3:n])
+		if _, err = readAddr(r); err != nil {
+			continue
+		}
+		return copy(p, buf[n-r.Len():n]), nil
+	}
+}
+
+func (c *udpConn) Close() error {
+	c.ctrl.Close()
+	return c.UDPConn.Close()
+}
+
+// handshake runs step on conn and closes conn if it fails or ctx is done
+// meanwhile
+func handshake(ctx context.Context, conn net.Conn, step func(net.Conn) error) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	err := step(conn)
+	if !stop() {
+		return ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	return nil
+}
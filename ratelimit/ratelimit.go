@@ -0,0 +1,130 @@
+package ratelimit
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket shared by every reader or writer it wraps.
+// A nil *Limiter or a rate of zero means unlimited.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// New returns a limiter allowing bytesPerSec on average
+func New(bytesPerSec int) *Limiter {
+	l := &Limiter{last: time.Now()}
+	l.SetRate(bytesPerSec)
+	l.tokens = l.burst
+	return l
+}
+
+// SetRate changes the rate, zero removes the limit
+func (l *Limiter) SetRate(bytesPerSec int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = float64(bytesPerSec)
+	// allow a quarter of a second worth of data at once, but never less
+	// than a block so a single request can always go through
+	l.burst = l.rate / 4
+	if l.burst < 16384 {
+		l.burst = 16384
+	}
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+}
+
+// Rate returns the current limit in bytes per second, zero if unlimited
+func (l *Limiter) Rate() int {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.rate)
+}
+
+// WaitN blocks until n bytes may be transferred
+func (l *Limiter) WaitN(n int) {
+	if l == nil {
+		return
+	}
+	for n > 0 {
+		l.mu.Lock()
+		if l.rate == 0 {
+			l.mu.Unlock()
+			return
+		}
+		now := time.Now()
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		l.last = now
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+		chunk := float64(n)
+		if chunk > l.burst {
+			chunk = l.burst
+		}
+		if l.tokens >= chunk {
+			l.tokens -= chunk
+			n -= int(chunk)
+			l.mu.Unlock()
+			continue
+		}
+		wait := time.Duration((chunk - l.tokens) / l.rate * float64(time.Second))
+		l.mu.Unlock()
+		time.Sleep(wait)
+	}
+}
+
+// Reader limits reads from r
+func Reader(r io.Reader, l *Limiter) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &reader{r, l}
+}
+
+type reader struct {
+	r io.Reader
+	l *Limiter
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.l.WaitN(n)
+	return n, err
+}
+
+// Conn limits a connection, download applies to reads and upload to writes.
+// Either may be nil.
+func Conn(c net.Conn, download, upload *Limiter) net.Conn {
+	if download == nil && upload == nil {
+		return c
+	}
+	return &conn{Conn: c, download: download, upload: upload}
+}
+
+type conn struct {
+	net.Conn
+	download *Limiter
+	upload   *Limiter
+}
+
+func (c *conn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.download.WaitN(n)
+	return n, err
+}
+
+func (c *conn) Write(p []byte) (int, error) {
+	c.upload.WaitN(len(p))
+	return c.Conn.Write(p)
+}
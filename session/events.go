@@ -0,0 +1,54 @@
+package session
+
+// EventType says what happened to a torrent
+type EventType string
+
+const (
+	EventAdded    EventType = "added"
+	EventRemoved  EventType = "removed"
+	EventState    EventType = "state"
+	EventProgress EventType = "progress"
+)
+
+// Event reports a change to a torrent of the session
+type Event struct {
+	Type   EventType
+	Status Status
+}
+
+// eventBuffer is how many events a subscriber may lag behind before
+// further events are dropped for it
+const eventBuffer = 64
+
+// Subscribe returns a channel receiving the session's events and a
+// function to stop the subscription. A subscriber that doesn't keep up
+// misses events rather than stalling the session.
+func (s *Session) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, eventBuffer)
+	s.mu.Lock()
+	s.subs[ch] = struct{}{}
+	s.mu.Unlock()
+	cancel := func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if _, ok := s.subs[ch]; ok {
+			delete(s.subs, ch)
+			close(ch)
+		}
+	}
+	return ch, cancel
+}
+
+// emit sends an event about tr to every subscriber, s.mu must be held
+func (s *Session) emit(typ EventType, tr *torrent) {
+	if len(s.subs) == 0 {
+		return
+	}
+	ev := Event{Type: typ, Status: tr.snapshot()}
+	for ch := range s.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
@@ -0,0 +1,586 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/souravbiswassanto/bit-torrent-client/client"
+	"github.com/souravbiswassanto/bit-torrent-client/config"
+	"github.com/souravbiswassanto/bit-torrent-client/ipfilter"
+	"github.com/souravbiswassanto/bit-torrent-client/p2p"
+	"github.com/souravbiswassanto/bit-torrent-client/peerid"
+	"github.com/souravbiswassanto/bit-torrent-client/ratelimit"
+	tf "github.com/souravbiswassanto/bit-torrent-client/torrentfile"
+	"github.com/souravbiswassanto/bit-torrent-client/utp"
+)
+
+// State is the lifecycle state of a torrent in a session
+type State int
+
+const (
+	// Queued torrents are waiting to find peers
+	Queued State = iota
+	Downloading
+	Paused
+	// Done torrents were downloaded completely and written to disk
+	Done
+	// Failed torrents stopped with an error, see Status.Err. An
+	// incomplete download keeps its pieces and may be resumed.
+	Failed
+)
+
+func (s State) String() string {
+	switch s {
+	case Queued:
+		return "queued"
+	case Downloading:
+		return "downloading"
+	case Paused:
+		return "paused"
+	case Done:
+		return "done"
+	case Failed:
+		return "failed"
+	default:
+		return fmt.Sprintf("State(%d)", int(s))
+	}
+}
+
+// Priority is the download priority of a file
+type Priority int
+
+const (
+	// PrioritySkip files are neither downloaded nor written
+	PrioritySkip   Priority = -1
+	PriorityNormal Priority = 0
+	// PriorityHigh files are requested before the others
+	PriorityHigh Priority = 1
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PrioritySkip:
+		return "skip"
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	default:
+		return fmt.Sprintf("Priority(%d)", int(p))
+	}
+}
+
+// ParsePriority parses the names returned by Priority.String
+func ParsePriority(s string) (Priority, error) {
+	for _, p := range []Priority{PrioritySkip, PriorityNormal, PriorityHigh} {
+		if p.String() == s {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown priority %q", s)
+}
+
+// ErrUnknownTorrent is returned for info hashes not in the session
+var ErrUnknownTorrent = errors.New("torrent not in session")
+
+// Session downloads many torrents at once. The torrents share one peer ID,
+// one TCP listener and uTP socket taking incoming peers, one bandwidth
+// budget and one connection limit.
+//
+// The session has no DHT yet. Peers come from the trackers and from the
+// peer sources registered in torrentfile.PeerSources, which are asked for
+// every torrent; a DHT node shared by the session would be added as one.
+type Session struct {
+	config   config.Config
+	peerID   [20]byte
+	options  client.Options
+	slots    chan struct{}
+	socket   *utp.Socket
+	listener net.Listener
+	// serving counts the goroutines accepting incoming peers
+	serving  sync.WaitGroup
+	mu       sync.Mutex
+	torrents map[[20]byte]*torrent
+	subs     map[chan Event]struct{}
+	wg       sync.WaitGroup
+
+	// stopFilter ends the reloading of the IP filter
+	stopFilter context.CancelFunc
+}
+
+// Status describes a torrent of the session
+type Status struct {
+	InfoHash [20]byte
+	Name     string
+	Path     string
+	State    State
+	Progress p2p.Progress
+	Err      error
+	Files    []FileStatus
+}
+
+// FileStatus describes one of the torrent's Files
+type FileStatus struct {
+	tf.File
+	Priority Priority
+}
+
+type torrent struct {
+	file       tf.TorrentFile
+	path       string
+	swarm      *p2p.Torrent
+	status     Status
+	priorities []Priority
+	// cancel stops the current attempt of the download goroutine
+	cancel context.CancelFunc
+	// running is set while the download goroutine is alive
+	running    bool
+	removed    bool
+	deleteData bool
+}
+
+// New starts a session after validating cfg. The TCP listener and the uTP
+// socket are opened on cfg.Port right away so a port conflict is reported
+// here rather than per torrent. With ProxyOnly nothing is listened on over
+// TCP. The bandwidth limits, MaxPeers and HalfOpen apply to the session as
+// a whole.
+func New(cfg config.Config) (*Session, error) {
+	err := cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+	s := &Session{
+		config:   cfg,
+		torrents: make(map[[20]byte]*torrent),
+		subs:     make(map[chan Event]struct{}),
+	}
+	s.peerID, err = peerid.New()
+	if err != nil {
+		return nil, err
+	}
+	s.options.Encryption = cfg.Encryption
+	s.options.HandshakeTimeout = cfg.HandshakeTimeout
+	// the limiters always exist so the limits can be changed later
+	s.options.DownloadLimit = ratelimit.New(cfg.DownloadLimit)
+	s.options.UploadLimit = ratelimit.New(cfg.UploadLimit)
+	if cfg.MaxPeers > 0 {
+		s.slots = make(chan struct{}, cfg.MaxPeers)
+	}
+	if cfg.HalfOpen > 0 {
+		s.options.HalfOpen = make(chan struct{}, cfg.HalfOpen)
+	}
+	if len(cfg.IPFilter) > 0 {
+		s.options.IPFilter, err = ipfilter.Open(cfg.IPFilter...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.UseUTP {
+		s.socket, err = utp.Listen("udp", fmt.Sprintf(":%d", cfg.Port))
+		if err != nil {
+			return nil, err
+		}
+		s.options.UTP = s.socket
+	}
+	if !cfg.ProxyOnly {
+		s.listener, err = net.Listen(cfg.Network, fmt.Sprintf(":%d", cfg.Port))
+		if err != nil {
+			if s.socket != nil {
+				s.socket.Close()
+			}
+			return nil, err
+		}
+	}
+	var listeners []net.Listener
+	if s.listener != nil {
+		listeners = append(listeners, s.listener)
+	}
+	if s.socket != nil {
+		listeners = append(listeners, s.socket)
+	}
+	for _, ln := range listeners {
+		ln = s.options.IPFilter.Listener(ln)
+		s.serving.Add(1)
+		go func(ln net.Listener) {
+			defer s.serving.Done()
+			err := p2p.Serve(ln, s.options, s.swarms)
+			if err != nil {
+				log.Printf("Not accepting peers on %s anymore: %v\n", ln.Addr(), err)
+			}
+		}(ln)
+	}
+	if s.options.IPFilter != nil {
+		var ctx context.Context
+		ctx, s.stopFilter = context.WithCancel(context.Background())
+		go s.options.IPFilter.Watch(ctx, time.Minute)
+	}
+	return s, nil
+}
+
+// Config returns the configuration the session was started with
+func (s *Session) Config() config.Config {
+	return s.config
+}
+
+// PeerID returns the peer ID the session uses for every torrent
+func (s *Session) PeerID() [20]byte {
+	return s.peerID
+}
+
+// Add starts downloading t into path, which is a file for single file
+// torrents and a directory for multi-file ones
+func (s *Session) Add(t tf.TorrentFile, path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.torrents[t.InfoHash]; ok {
+		return fmt.Errorf("torrent %x is already in the session", t.InfoHash)
+	}
+	tr := &torrent{
+		file:       t,
+		path:       path,
+		priorities: make([]Priority, len(t.Files)),
+		status: Status{
+			InfoHash: t.InfoHash,
+			Name:     t.Name,
+			Path:     path,
+			State:    Queued,
+			Progress: p2p.Progress{BytesTotal: t.Length},
+		},
+	}
+	s.torrents[t.InfoHash] = tr
+	s.emit(EventAdded, tr)
+	s.start(tr)
+	return nil
+}
+
+// Pause stops a torrent, keeping the pieces downloaded so far
+func (s *Session) Pause(infoHash [20]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tr, ok := s.torrents[infoHash]
+	if !ok {
+		return ErrUnknownTorrent
+	}
+	switch tr.status.State {
+	case Queued, Downloading:
+		s.setState(tr, Paused, nil)
+		tr.stop()
+	}
+	return nil
+}
+
+// Resume continues a paused or failed torrent with fresh peers
+func (s *Session) Resume(infoHash [20]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tr, ok := s.torrents[infoHash]
+	if !ok {
+		return ErrUnknownTorrent
+	}
+	switch tr.status.State {
+	case Paused, Failed:
+		s.setState(tr, Queued, nil)
+		if !tr.running {
+			s.start(tr)
+		}
+	}
+	return nil
+}
+
+// Remove stops a torrent and drops it from the session. Its data on disk
+// is deleted as well if deleteData is set.
+func (s *Session) Remove(infoHash [20]byte, deleteData bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tr, ok := s.torrents[infoHash]
+	if !ok {
+		return ErrUnknownTorrent
+	}
+	tr.removed = true
+	tr.deleteData = deleteData
+	tr.stop()
+	delete(s.torrents, infoHash)
+	s.emit(EventRemoved, tr)
+	if !tr.running && deleteData {
+		return os.RemoveAll(tr.path)
+	}
+	return nil
+}
+
+// SetPriorities changes the priorities of the torrent's files, keyed by
+// their index in Files. A running download restarts to apply them, a
+// finished one resumes to fetch the files no longer skipped.
+func (s *Session) SetPriorities(infoHash [20]byte, priorities map[int]Priority) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tr, ok := s.torrents[infoHash]
+	if !ok {
+		return ErrUnknownTorrent
+	}
+	for i, p := range priorities {
+		if i < 0 || i >= len(tr.priorities) {
+			return fmt.Errorf("torrent has no file %d", i)
+		}
+		if p < PrioritySkip || p > PriorityHigh {
+			return fmt.Errorf("invalid priority %d", p)
+		}
+	}
+	for i, p := range priorities {
+		tr.priorities[i] = p
+	}
+	switch tr.status.State {
+	case Downloading:
+		s.setState(tr, Queued, nil)
+		tr.stop()
+	case Done:
+		s.setState(tr, Queued, nil)
+		if !tr.running {
+			s.start(tr)
+		}
+	}
+	return nil
+}
+
+// SetLimits changes the bandwidth budget in bytes per second, zero means
+// no limit
+func (s *Session) SetLimits(download, upload int) {
+	s.options.DownloadLimit.SetRate(download)
+	s.options.UploadLimit.SetRate(upload)
+}
+
+// Limits returns the bandwidth budget in bytes per second
+func (s *Session) Limits() (download, upload int) {
+	return s.options.DownloadLimit.Rate(), s.options.UploadLimit.Rate()
+}
+
+// Status returns the status of one torrent
+func (s *Session) Status(infoHash [20]byte) (Status, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tr, ok := s.torrents[infoHash]
+	if !ok {
+		return Status{}, ErrUnknownTorrent
+	}
+	return tr.snapshot(), nil
+}
+
+// List returns the status of every torrent in the session by name
+func (s *Session) List() []Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Status, 0, len(s.torrents))
+	for _, tr := range s.torrents {
+		list = append(list, tr.snapshot())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Close stops every torrent, waits for them and closes the listener and
+// the uTP socket
+func (s *Session) Close() error {
+	s.mu.Lock()
+	for _, tr := range s.torrents {
+		tr.removed = true
+		tr.stop()
+	}
+	s.torrents = make(map[[20]byte]*torrent)
+	for ch := range s.subs {
+		delete(s.subs, ch)
+		close(ch)
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	if s.stopFilter != nil {
+		s.stopFilter()
+	}
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	if s.socket != nil {
+		err = errors.Join(err, s.socket.Close())
+	}
+	s.serving.Wait()
+	return err
+}
+
+// swarms returns the torrents incoming peers may ask for
+func (s *Session) swarms() []*p2p.Torrent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var list []*p2p.Torrent
+	for _, tr := range s.torrents {
+		if tr.swarm != nil {
+			list = append(list, tr.swarm)
+		}
+	}
+	return list
+}
+
+// snapshot copies the status of tr, s.mu must be held
+func (tr *torrent) snapshot() Status {
+	st := tr.status
+	st.Files = make([]FileStatus, len(tr.file.Files))
+	for i, f := range tr.file.Files {
+		st.Files[i] = FileStatus{File: f, Priority: tr.priorities[i]}
+	}
+	return st
+}
+
+// setState changes the state of tr and tells the subscribers, s.mu must
+// be held
+func (s *Session) setState(tr *torrent, state State, err error) {
+	tr.status.State = state
+	tr.status.Err = err
+	s.emit(EventState, tr)
+}
+
+// stop cancels the current download attempt of tr, s.mu must be held
+func (tr *torrent) stop() {
+	if tr.cancel != nil {
+		tr.cancel()
+	}
+}
+
+// start runs the download goroutine of tr, s.mu must be held
+func (s *Session) start(tr *torrent) {
+	tr.running = true
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.run(tr)
+	}()
+}
+
+// run downloads tr until it is done, fails or is paused. A Resume that
+// arrives while run is finishing is picked up by looping again.
+func (s *Session) run(tr *torrent) {
+	defer func() {
+		s.mu.Lock()
+		tr.running = false
+		deleteData := tr.removed && tr.deleteData
+		s.mu.Unlock()
+		if deleteData {
+			err := os.RemoveAll(tr.path)
+			if err != nil {
+				log.Printf("Could not delete %s: %v\n", tr.path, err)
+			}
+		}
+	}()
+	for {
+		s.mu.Lock()
+		if tr.removed || tr.status.State != Queued {
+			s.mu.Unlock()
+			return
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		tr.cancel = cancel
+		s.mu.Unlock()
+
+		err := s.attempt(ctx, tr)
+		cancel()
+
+		s.mu.Lock()
+		switch {
+		case tr.removed:
+		case err == nil:
+			if tr.status.State == Downloading {
+				s.setState(tr, Done, nil)
+			}
+		case errors.Is(err, context.Canceled):
+			// paused, or restarted by Resume or SetPriorities
+		default:
+			log.Printf("Torrent %s failed: %v\n", tr.file.Name, err)
+			s.setState(tr, Failed, err)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// attempt announces tr, downloads the pieces still missing and writes the
+// wanted files. Cancelling ctx interrupts it.
+func (s *Session) attempt(ctx context.Context, tr *torrent) error {
+	swarm, err := tr.file.Prepare(ctx, s.config, s.peerID)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if tr.swarm == nil {
+		s.configure(tr, swarm)
+		tr.swarm = swarm
+	} else {
+		// keep the pieces we have, only the peers are new
+		tr.swarm.Peers = swarm.Peers
+		tr.swarm.AltPeers = swarm.AltPeers
+	}
+	tr.swarm.Priorities = tr.piecePriorities()
+	skip := make([]bool, len(tr.priorities))
+	for i, p := range tr.priorities {
+		skip[i] = p == PrioritySkip
+	}
+	if tr.status.State == Queued {
+		s.setState(tr, Downloading, nil)
+	}
+	s.mu.Unlock()
+
+	buf, err := tr.swarm.Download(ctx)
+	if err == nil || errors.Is(err, p2p.ErrIncomplete) {
+		werr := tr.file.WriteSelectedFiles(tr.path, buf, skip)
+		if werr != nil {
+			err = werr
+		}
+	}
+	return err
+}
+
+// piecePriorities maps the file priorities onto pieces. A piece shared by
+// several files gets the highest of their priorities, so skipping a file
+// never drops a piece another file needs. Pad files don't count.
+func (tr *torrent) piecePriorities() []int {
+	var pieces []int
+	for i, p := range tr.priorities {
+		if tr.file.Files[i].Padding {
+			continue
+		}
+		begin, end := tr.file.FilePieces(i)
+		for index := begin; index < end; index++ {
+			for len(pieces) <= index {
+				pieces = append(pieces, int(PrioritySkip))
+			}
+			if int(p) > pieces[index] {
+				pieces[index] = int(p)
+			}
+		}
+	}
+	return pieces
+}
+
+// configure applies the session's shared resources to a new swarm
+func (s *Session) configure(tr *torrent, swarm *p2p.Torrent) {
+	swarm.Options.DownloadLimit = s.options.DownloadLimit
+	swarm.Options.UploadLimit = s.options.UploadLimit
+	swarm.Options.UTP = s.options.UTP
+	swarm.Options.HalfOpen = s.options.HalfOpen
+	swarm.Options.IPFilter = s.options.IPFilter
+	swarm.SharedSlots = s.slots
+	for _, ws := range swarm.WebSeeds {
+		ws.Limiter = s.options.DownloadLimit
+	}
+	swarm.OnProgress = func(p p2p.Progress) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		tr.status.Progress = p
+		if !tr.removed {
+			s.emit(EventProgress, tr)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package session
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/souravbiswassanto/bit-torrent-client/config"
+	"github.com/souravbiswassanto/bit-torrent-client/swarmtest"
+)
+
+// newTestSession starts a session on a free port
+func newTestSession(t *testing.T) *Session {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Default()
+	cfg.Port = uint16(ln.Addr().(*net.TCPAddr).Port)
+	ln.Close()
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func newSwarm(t *testing.T, cfg swarmtest.Config) *swarmtest.Swarm {
+	t.Helper()
+	sw, err := swarmtest.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sw.Close() })
+	return sw
+}
+
+// waitState polls the torrent until it reaches state
+func waitState(t *testing.T, s *Session, infoHash [20]byte, state State) {
+	t.Helper()
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		st, err := s.Status(infoHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.State == state {
+			return
+		}
+		if st.State == Failed || time.Now().After(deadline) {
+			t.Fatalf("torrent %s is %v (%v), want %v", st.Name, st.State, st.Err, state)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSessionDownloadsMany(t *testing.T) {
+	s := newTestSession(t)
+	swarms := []*swarmtest.Swarm{
+		newSwarm(t, swarmtest.Config{Size: 128 << 10, Seeders: 1, Seed: 1}),
+		newSwarm(t, swarmtest.Config{Files: []int{50 << 10, 30 << 10}, Seeders: 2, Seed: 2}),
+		newSwarm(t, swarmtest.Config{Size: 64 << 10, Seeders: 1, UDPTracker: true, Seed: 3}),
+	}
+	paths := make([]string, len(swarms))
+	for i, sw := range swarms {
+		// every swarm names its torrent the same
+		paths[i] = filepath.Join(t.TempDir(), sw.Torrent.StorageName())
+		err := s.Add(sw.Torrent, paths[i])
+		if err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+	if n := len(s.List()); n != len(swarms) {
+		t.Errorf("List has %d torrents, want %d", n, len(swarms))
+	}
+	for i, sw := range swarms {
+		waitState(t, s, sw.Torrent.InfoHash, Done)
+		err := sw.Check(paths[i])
+		if err != nil {
+			t.Error(err)
+		}
+		st, _ := s.Status(sw.Torrent.InfoHash)
+		if st.Progress.PiecesDone != st.Progress.PiecesTotal || st.Path != paths[i] {
+			t.Errorf("done torrent has %d of %d pieces at %s", st.Progress.PiecesDone, st.Progress.PiecesTotal, st.Path)
+		}
+	}
+}
+
+func TestSessionLifecycle(t *testing.T) {
+	s := newTestSession(t)
+	sw := newSwarm(t, swarmtest.Config{Size: 128 << 10, Seeders: 1})
+	hash := sw.Torrent.InfoHash
+	path := filepath.Join(t.TempDir(), "download")
+	events, cancel := s.Subscribe()
+	defer cancel()
+
+	err := s.Add(sw.Torrent, path)
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := s.Add(sw.Torrent, path); err == nil {
+		t.Error("adding the torrent twice succeeded")
+	}
+	err = s.Pause(hash)
+	if err != nil {
+		t.Fatalf("Pause: %v", err)
+	}
+	// a paused torrent stays paused
+	time.Sleep(100 * time.Millisecond)
+	if st, _ := s.Status(hash); st.State != Paused {
+		t.Fatalf("paused torrent is %v", st.State)
+	}
+
+	err = s.Resume(hash)
+	if err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+	waitState(t, s, hash, Done)
+	err = sw.Check(path)
+	if err != nil {
+		t.Error(err)
+	}
+	// pausing or resuming a finished torrent changes nothing
+	s.Pause(hash)
+	s.Resume(hash)
+	if st, _ := s.Status(hash); st.State != Done {
+		t.Errorf("finished torrent is %v after Pause and Resume", st.State)
+	}
+
+	err = s.Remove(hash, true)
+	if err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	// the download goroutine deletes the data if it is still finishing
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		_, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("data of the removed torrent is still there: %v", err)
+		}
+	}
+	if len(s.List()) != 0 {
+		t.Error("removed torrent is still listed")
+	}
+	for name, err := range map[string]error{
+		"Pause":  s.Pause(hash),
+		"Resume": s.Resume(hash),
+		"Remove": s.Remove(hash, false),
+	} {
+		if !errors.Is(err, ErrUnknownTorrent) {
+			t.Errorf("%s of a removed torrent: %v, want ErrUnknownTorrent", name, err)
+		}
+	}
+	if _, err := s.Status(hash); !errors.Is(err, ErrUnknownTorrent) {
+		t.Errorf("Status of a removed torrent: %v, want ErrUnknownTorrent", err)
+	}
+
+	// the subscriber saw the torrent come and go
+	var types []EventType
+	for len(events) > 0 {
+		ev := <-events
+		if ev.Type != EventProgress {
+			types = append(types, ev.Type)
+		}
+	}
+	if len(types) < 2 || types[0] != EventAdded || types[len(types)-1] != EventRemoved {
+		t.Errorf("events %v, want added first and removed last", types)
+	}
+}
@@ -0,0 +1,331 @@
+package swarmtest
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/souravbiswassanto/bit-torrent-client/bitfield"
+	"github.com/souravbiswassanto/bit-torrent-client/handshake"
+	"github.com/souravbiswassanto/bit-torrent-client/message"
+	"github.com/souravbiswassanto/bit-torrent-client/mse"
+	"github.com/souravbiswassanto/bit-torrent-client/peers"
+	"github.com/souravbiswassanto/bit-torrent-client/utp"
+)
+
+// Misbehaviour is a protocol violation a simulated peer commits
+type Misbehaviour int
+
+const (
+	// Honest follows the protocol
+	Honest Misbehaviour = iota
+	// WrongInfoHash answers the handshake with another torrent's info hash
+	WrongInfoHash
+	// HangUp closes the connection right after the handshake
+	HangUp
+	// Garbage sends random bytes instead of a bitfield
+	Garbage
+	// NeverUnchoke keeps the downloader choked forever
+	NeverUnchoke
+	// Stall unchokes but never answers a request
+	Stall
+)
+
+// Behaviour controls how a simulated peer serves its connections
+type Behaviour struct {
+	// Latency delays every message the peer sends
+	Latency time.Duration
+	// DropRate is the probability that the peer closes the connection
+	// instead of answering a request
+	DropRate float64
+	// BadData is the probability that a block is served with a flipped byte
+	BadData float64
+	// Misbehaviour is committed on every connection
+	Misbehaviour Misbehaviour
+}
+
+// Peer is a simulated peer listening on loopback, over TCP or uTP. It
+// serves the pieces it has to any downloader, encrypted or not.
+type Peer struct {
+	// Addr is the address the peer is registered at with the tracker
+	Addr      peers.Peer
+	ID        [20]byte
+	Behaviour Behaviour
+
+	swarm *Swarm
+	have  []bool
+	ln    net.Listener
+	wg    sync.WaitGroup
+
+	mu     sync.Mutex
+	rnd    *rand.Rand
+	conns  map[net.Conn]bool
+	closed bool
+
+	uploaded    atomic.Int64
+	connections atomic.Int64
+}
+
+// newPeer starts a peer holding the pieces i for which have[i] is set,
+// listening over uTP if overUTP is set
+func newPeer(s *Swarm, have []bool, b Behaviour, seed int64, overUTP bool) (*Peer, error) {
+	var ln net.Listener
+	var err error
+	if overUTP {
+		ln, err = utp.Listen("udp", "127.0.0.1:0")
+	} else {
+		ln, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		return nil, err
+	}
+	var addr peers.Peer
+	switch a := ln.Addr().(type) {
+	case *net.TCPAddr:
+		addr = peers.Peer{IP: a.IP.To4(), Port: uint16(a.Port)}
+	case *net.UDPAddr:
+		addr = peers.Peer{IP: a.IP.To4(), Port: uint16(a.Port)}
+	}
+	p := &Peer{
+		Addr:      addr,
+		Behaviour: b,
+		swarm:     s,
+		have:      have,
+		ln:        ln,
+		rnd:       rand.New(rand.NewSource(seed)),
+		conns:     make(map[net.Conn]bool),
+	}
+	copy(p.ID[:], "-SIM000-")
+	p.rnd.Read(p.ID[8:])
+	p.wg.Add(1)
+	go p.serve()
+	return p, nil
+}
+
+// Uploaded returns the number of block bytes the peer has sent
+func (p *Peer) Uploaded() int64 {
+	return p.uploaded.Load()
+}
+
+// Connections returns the number of connections the peer has accepted
+func (p *Peer) Connections() int {
+	return int(p.connections.Load())
+}
+
+// Close stops listening and drops every connection
+func (p *Peer) Close() error {
+	err := p.ln.Close()
+	p.mu.Lock()
+	p.closed = true
+	for conn := range p.conns {
+		conn.Close()
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+	return err
+}
+
+func (p *Peer) serve() {
+	defer p.wg.Done()
+	for {
+		conn, err := p.ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) || errors.Is(err, utp.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if !p.track(conn, func() { p.handle(conn) }) {
+			return
+		}
+	}
+}
+
+// Connect dials the client listening at addr and serves it like the
+// clients that connect to the peer, to exercise incoming connections.
+// Only the plaintext handshake is used.
+func (p *Peer) Connect(addr string) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	infoHash := p.swarm.Torrent.InfoHash
+	hs := handshake.New(infoHash, p.ID)
+	_, err = conn.Write(hs.Serialize())
+	if err == nil {
+		hs, err = handshake.Read(conn)
+	}
+	if err == nil && hs.InfoHash != infoHash {
+		err = fmt.Errorf("client answered for info hash %x", hs.InfoHash)
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if !p.track(conn, func() { p.exchange(conn) }) {
+		return net.ErrClosed
+	}
+	return nil
+}
+
+// track runs handle for conn on its own goroutine until it returns, then
+// closes conn. It returns false if the peer was closed.
+func (p *Peer) track(conn net.Conn, handle func()) bool {
+	p.connections.Add(1)
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		conn.Close()
+		return false
+	}
+	p.conns[conn] = true
+	p.mu.Unlock()
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		handle()
+		conn.Close()
+		p.mu.Lock()
+		delete(p.conns, conn)
+		p.mu.Unlock()
+	}()
+	return true
+}
+
+// chance reports true with probability prob
+func (p *Peer) chance(prob float64) bool {
+	if prob <= 0 {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.rnd.Float64() < prob
+}
+
+// send writes msg after the simulated latency
+func (p *Peer) send(conn net.Conn, msg []byte) error {
+	if p.Behaviour.Latency > 0 {
+		time.Sleep(p.Behaviour.Latency)
+	}
+	_, err := conn.Write(msg)
+	return err
+}
+
+func (p *Peer) handle(raw net.Conn) {
+	infoHash := p.swarm.Torrent.InfoHash
+	conn, err := mse.Accept(raw, [][20]byte{infoHash}, mse.PolicyPreferred)
+	if err != nil {
+		return
+	}
+	hs, err := handshake.Read(conn)
+	if err != nil || hs.InfoHash != infoHash {
+		return
+	}
+	reply := handshake.New(infoHash, p.ID)
+	if p.Behaviour.Misbehaviour == WrongInfoHash {
+		reply.InfoHash[0] ^= 0xff
+	}
+	if p.send(conn, reply.Serialize()) != nil {
+		return
+	}
+
+	switch p.Behaviour.Misbehaviour {
+	case HangUp:
+		return
+	case Garbage:
+		junk := make([]byte, 256)
+		p.mu.Lock()
+		p.rnd.Read(junk)
+		p.mu.Unlock()
+		p.send(conn, junk)
+		return
+	}
+	p.exchange(conn)
+}
+
+// exchange sends the bitfield and answers messages once the handshakes
+// are done
+func (p *Peer) exchange(conn net.Conn) {
+	bf := &message.Message{ID: message.MsgBitfield, Payload: p.bitfield()}
+	if p.send(conn, bf.Serialize()) != nil {
+		return
+	}
+	for {
+		msg, err := message.Read(conn)
+		if err != nil {
+			return
+		}
+		if msg == nil {
+			continue
+		}
+		switch msg.ID {
+		case message.MsgInterested:
+			if p.Behaviour.Misbehaviour == NeverUnchoke {
+				continue
+			}
+			unchoke := &message.Message{ID: message.MsgUnchoke}
+			if p.send(conn, unchoke.Serialize()) != nil {
+				return
+			}
+		case message.MsgRequest:
+			if p.chance(p.Behaviour.DropRate) {
+				return
+			}
+			if p.Behaviour.Misbehaviour == Stall {
+				continue
+			}
+			piece := p.piece(msg.Payload)
+			if piece == nil {
+				return
+			}
+			if p.send(conn, piece.Serialize()) != nil {
+				return
+			}
+		}
+	}
+}
+
+// bitfield encodes the pieces the peer has, high bit first
+func (p *Peer) bitfield() []byte {
+	bf := bitfield.New(len(p.have))
+	for i, ok := range p.have {
+		if ok {
+			bf.SetPiece(i)
+		}
+	}
+	return bf
+}
+
+// piece answers the request in payload, nil if it is invalid or for a
+// piece the peer doesn't have
+func (p *Peer) piece(payload []byte) *message.Message {
+	if len(payload) != 12 {
+		return nil
+	}
+	index := int(binary.BigEndian.Uint32(payload[0:4]))
+	begin := int(binary.BigEndian.Uint32(payload[4:8]))
+	length := int(binary.BigEndian.Uint32(payload[8:12]))
+	if index >= len(p.have) || !p.have[index] {
+		return nil
+	}
+	pieceLength := p.swarm.Torrent.PieceLength
+	start := index*pieceLength + begin
+	end := start + length
+	if begin+length > pieceLength || end > len(p.swarm.Content) {
+		return nil
+	}
+
+	block := make([]byte, 8+length)
+	copy(block, payload[:8])
+	copy(block[8:], p.swarm.Content[start:end])
+	if p.chance(p.Behaviour.BadData) {
+		block[8] ^= 0xff
+	}
+	p.uploaded.Add(int64(length))
+	return &message.Message{ID: message.MsgPiece, Payload: block}
+}
@@ -0,0 +1,250 @@
+package swarmtest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// SOCKS5 is a SOCKS5 proxy stand-in on loopback. It accepts clients
+// without authentication and relays CONNECT streams and UDP ASSOCIATE
+// datagrams, counting both.
+type SOCKS5 struct {
+	// URL is the proxy URL to configure clients with
+	URL string
+
+	ln net.Listener
+	wg sync.WaitGroup
+
+	connects  atomic.Int64
+	datagrams atomic.Int64
+	mu        sync.Mutex
+	conns     map[io.Closer]bool
+}
+
+// NewSOCKS5 starts a proxy
+func NewSOCKS5() (*SOCKS5, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	p := &SOCKS5{
+		URL:   "socks5://" + ln.Addr().String(),
+		ln:    ln,
+		conns: make(map[io.Closer]bool),
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			p.wg.Add(1)
+			go func() {
+				defer p.wg.Done()
+				p.serve(conn)
+			}()
+		}
+	}()
+	return p, nil
+}
+
+// Connects returns the number of TCP connections relayed
+func (p *SOCKS5) Connects() int {
+	return int(p.connects.Load())
+}
+
+// Datagrams returns the number of UDP datagrams relayed to a destination
+func (p *SOCKS5) Datagrams() int {
+	return int(p.datagrams.Load())
+}
+
+// Close stops the proxy and the relays it runs
+func (p *SOCKS5) Close() error {
+	err := p.ln.Close()
+	p.mu.Lock()
+	for c := range p.conns {
+		c.Close()
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+	return err
+}
+
+// track registers c to be closed by Close and returns the function
+// releasing it
+func (p *SOCKS5) track(c io.Closer) func() {
+	p.mu.Lock()
+	p.conns[c] = true
+	p.mu.Unlock()
+	return func() {
+		p.mu.Lock()
+		delete(p.conns, c)
+		p.mu.Unlock()
+		c.Close()
+	}
+}
+
+func (p *SOCKS5) serve(conn net.Conn) {
+	defer p.track(conn)()
+	// greeting: version, methods
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(conn, head); err != nil || head[0] != 5 {
+		return
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	if _, err := conn.Write([]byte{5, 0}); err != nil {
+		return
+	}
+	// request: version, command, reserved, address
+	req := make([]byte, 3)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return
+	}
+	addr, err := readSOCKSAddr(conn)
+	if err != nil {
+		return
+	}
+	switch req[1] {
+	case 1:
+		p.connect(conn, addr)
+	case 3:
+		p.associate(conn)
+	default:
+		conn.Write(socksReply(7, nil))
+	}
+}
+
+func (p *SOCKS5) connect(conn net.Conn, addr string) {
+	target, err := net.Dial("tcp", addr)
+	if err != nil {
+		conn.Write(socksReply(5, nil))
+		return
+	}
+	defer p.track(target)()
+	p.connects.Add(1)
+	if _, err = conn.Write(socksReply(0, target.LocalAddr())); err != nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		io.Copy(target, conn)
+		target.Close()
+		close(done)
+	}()
+	io.Copy(conn, target)
+	conn.Close()
+	<-done
+}
+
+// associate relays datagrams from the client to the destinations in their
+// headers and back, until the control connection closes
+func (p *SOCKS5) associate(conn net.Conn) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		conn.Write(socksReply(1, nil))
+		return
+	}
+	defer p.track(pc)()
+	if _, err = conn.Write(socksReply(0, pc.LocalAddr())); err != nil {
+		return
+	}
+	go func() {
+		io.Copy(io.Discard, conn)
+		pc.Close()
+	}()
+	var client net.Addr
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if client == nil || from.String() == client.String() {
+			// from the client: strip the header and forward
+			if n < 4 || buf[2] != 0 {
+				continue
+			}
+			r := bytes.NewReader(buf[3:n])
+			addr, err := readSOCKSAddr(r)
+			if err != nil {
+				continue
+			}
+			dest, err := net.ResolveUDPAddr("udp", addr)
+			if err != nil {
+				continue
+			}
+			client = from
+			p.datagrams.Add(1)
+			pc.WriteTo(buf[n-r.Len():n], dest)
+			continue
+		}
+		// from a destination: add its address and pass it to the client
+		header := socksReply(0, from)
+		header[0] = 0
+		pc.WriteTo(append(header, buf[:n]...), client)
+	}
+}
+
+// socksReply encodes a reply with the bound address, 0.0.0.0:0 if nil.
+// Its first three bytes double as the header of a relayed datagram.
+func socksReply(code byte, bound net.Addr) []byte {
+	ip, port := net.IPv4zero, 0
+	switch a := bound.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+	reply := []byte{5, code, 0}
+	if ip4 := ip.To4(); ip4 != nil {
+		reply = append(append(reply, 1), ip4...)
+	} else {
+		reply = append(append(reply, 4), ip.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(reply, uint16(port))
+}
+
+func readSOCKSAddr(r io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", err
+	}
+	var host []byte
+	switch atyp[0] {
+	case 1:
+		host = make([]byte, 4)
+	case 4:
+		host = make([]byte, 16)
+	case 3:
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(r, n); err != nil {
+			return "", err
+		}
+		host = make([]byte, n[0])
+	default:
+		return "", fmt.Errorf("address type %d", atyp[0])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, host); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	name := string(host)
+	if atyp[0] != 3 {
+		name = net.IP(host).String()
+	}
+	return net.JoinHostPort(name, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
@@ -0,0 +1,217 @@
+// Package swarmtest runs a simulated BitTorrent swarm on loopback: a
+// tracker stand-in speaking HTTP and UDP plus seeders and leechers whose
+// latency, reliability and honesty are configurable. It lets downloads be
+// exercised end to end without network access.
+//
+// A typical use creates a swarm, points the download at it and checks the
+// result:
+//
+//	s, err := swarmtest.New(swarmtest.Config{Size: 1 << 20, Seeders: 3})
+//	...
+//	defer s.Close()
+//	err = s.Torrent.Download(ctx, config.Default(), path, nil)
+//	...
+//	err = s.Check(path)
+package swarmtest
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+
+	tf "github.com/souravbiswassanto/bit-torrent-client/torrentfile"
+)
+
+// Config describes the swarm to simulate
+type Config struct {
+	// Size is the length of the random content. Files, if set, splits it
+	// into a multi-file torrent with these file lengths instead.
+	Size  int
+	Files []int
+	// PieceLength must be a power of two, zero picks one automatically
+	PieceLength int
+	// Seeders have every piece, Leechers a random half of them
+	Seeders  int
+	Leechers int
+	// Behaviour applies to every peer of the swarm
+	Behaviour Behaviour
+	// UDPTracker announces the torrent on the tracker's UDP endpoint
+	// instead of the HTTP one
+	UDPTracker bool
+	// Private sets the private flag of the torrent (BEP 27)
+	Private bool
+	// UTP makes the peers listen over uTP instead of TCP
+	UTP bool
+	// Seed makes the content and the peers' random choices reproducible
+	Seed int64
+}
+
+// Swarm is a running simulated swarm sharing one torrent
+type Swarm struct {
+	// Torrent announces to Tracker, which knows every peer of the swarm
+	Torrent tf.TorrentFile
+	Content []byte
+	Tracker *Tracker
+	Peers   []*Peer
+
+	rnd       *rand.Rand
+	dir       string
+	multiFile bool
+	utp       bool
+}
+
+// New creates random content, builds its torrent and starts the tracker
+// and the peers
+func New(cfg Config) (*Swarm, error) {
+	s := &Swarm{rnd: rand.New(rand.NewSource(cfg.Seed)), utp: cfg.UTP}
+	var err error
+	s.Tracker, err = NewTracker()
+	if err != nil {
+		return nil, err
+	}
+	err = s.createTorrent(cfg)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	for i := 0; i < cfg.Seeders+cfg.Leechers; i++ {
+		have := make([]bool, len(s.Torrent.PieceHashes))
+		for j := range have {
+			have[j] = i < cfg.Seeders || s.rnd.Intn(2) == 0
+		}
+		_, err = s.AddPeer(have, cfg.Behaviour)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// createTorrent writes the content to a temporary directory and creates
+// the torrent from it, exactly as the create command would
+func (s *Swarm) createTorrent(cfg Config) error {
+	sizes := cfg.Files
+	if len(sizes) == 0 {
+		sizes = []int{cfg.Size}
+	}
+	total := 0
+	for _, n := range sizes {
+		total += n
+	}
+	if total <= 0 {
+		return fmt.Errorf("swarm has no content")
+	}
+	s.Content = make([]byte, total)
+	s.rnd.Read(s.Content)
+
+	var err error
+	s.dir, err = os.MkdirTemp("", "swarmtest")
+	if err != nil {
+		return err
+	}
+	root := filepath.Join(s.dir, "content")
+	s.multiFile = len(cfg.Files) > 0
+	if !s.multiFile {
+		err = os.WriteFile(root, s.Content, 0644)
+	} else {
+		err = writeFiles(root, s.Content, cfg.Files)
+	}
+	if err != nil {
+		return err
+	}
+
+	announce := s.Tracker.HTTPURL
+	if cfg.UDPTracker {
+		announce = s.Tracker.UDPURL
+	}
+	data, err := tf.Create(root, tf.CreateOptions{
+		PieceLength: cfg.PieceLength,
+		Announce:    announce,
+		CreatedBy:   "swarmtest",
+		Private:     cfg.Private,
+	})
+	if err != nil {
+		return err
+	}
+	s.Torrent, err = tf.Parse(data)
+	return err
+}
+
+// writeFiles splits content into files named 0000, 0001, ... below dir, in an
+// order matching the sorted paths of a created torrent
+func writeFiles(dir string, content []byte, sizes []int) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	offset := 0
+	for i, n := range sizes {
+		name := filepath.Join(dir, fmt.Sprintf("%04d", i))
+		err = os.WriteFile(name, content[offset:offset+n], 0644)
+		if err != nil {
+			return err
+		}
+		offset += n
+	}
+	return nil
+}
+
+// AddPeer starts another peer with the pieces i for which have[i] is set
+// and registers it with the tracker
+func (s *Swarm) AddPeer(have []bool, b Behaviour) (*Peer, error) {
+	if len(have) != len(s.Torrent.PieceHashes) {
+		return nil, fmt.Errorf("have covers %d pieces, the torrent has %d", len(have), len(s.Torrent.PieceHashes))
+	}
+	p, err := newPeer(s, have, b, s.rnd.Int63(), s.utp)
+	if err != nil {
+		return nil, err
+	}
+	s.Peers = append(s.Peers, p)
+	s.Tracker.Register(s.Torrent.InfoHash, p.Addr)
+	return p, nil
+}
+
+// Check compares the download at path, a file or a directory for
+// multi-file torrents, with the swarm's content
+func (s *Swarm) Check(path string) error {
+	var got []byte
+	if !s.multiFile {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		got = data
+	} else {
+		for _, f := range s.Torrent.Files {
+			data, err := os.ReadFile(filepath.Join(append([]string{path}, f.Path...)...))
+			if err != nil {
+				return err
+			}
+			got = append(got, data...)
+		}
+	}
+	if len(got) != len(s.Content) {
+		return fmt.Errorf("downloaded %d bytes, want %d", len(got), len(s.Content))
+	}
+	for i := range got {
+		if got[i] != s.Content[i] {
+			return fmt.Errorf("content differs at byte %d", i)
+		}
+	}
+	return nil
+}
+
+// Close stops the peers and the tracker and removes the content
+func (s *Swarm) Close() error {
+	for _, p := range s.Peers {
+		p.Close()
+	}
+	err := s.Tracker.Close()
+	if s.dir != "" {
+		os.RemoveAll(s.dir)
+	}
+	return err
+}
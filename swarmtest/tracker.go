@@ -0,0 +1,220 @@
+package swarmtest
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/souravbiswassanto/bit-torrent-client/bencode"
+	"github.com/souravbiswassanto/bit-torrent-client/peers"
+)
+
+// udpProtocolID is the magic connection ID of a BEP 15 connect request
+const udpProtocolID = 0x41727101980
+
+// Tracker is an HTTP and UDP tracker stand-in on loopback. It answers
+// announces with the peers registered for the info hash and scrapes with
+// their count. Announcing clients are not added to the swarm.
+type Tracker struct {
+	// HTTPURL and UDPURL are the announce URLs of the two endpoints
+	HTTPURL string
+	UDPURL  string
+
+	http *http.Server
+	udp  net.PacketConn
+	wg   sync.WaitGroup
+
+	announces atomic.Int64
+	mu        sync.Mutex
+	peers     map[[20]byte][]peers.Peer
+	// conns holds the connection IDs handed out over UDP
+	conns map[uint64]bool
+}
+
+// NewTracker starts both endpoints of a tracker
+func NewTracker() (*Tracker, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	tr := &Tracker{
+		HTTPURL: "http://" + ln.Addr().String() + "/announce",
+		UDPURL:  "udp://" + pc.LocalAddr().String() + "/announce",
+		udp:     pc,
+		peers:   make(map[[20]byte][]peers.Peer),
+		conns:   make(map[uint64]bool),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/announce", tr.serveAnnounce)
+	mux.HandleFunc("/scrape", tr.serveScrape)
+	tr.http = &http.Server{Handler: mux}
+	tr.wg.Add(2)
+	go func() {
+		defer tr.wg.Done()
+		tr.http.Serve(ln)
+	}()
+	go func() {
+		defer tr.wg.Done()
+		tr.serveUDP()
+	}()
+	return tr, nil
+}
+
+// Register adds a peer to the swarm of infoHash
+func (tr *Tracker) Register(infoHash [20]byte, p peers.Peer) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.peers[infoHash] = append(tr.peers[infoHash], p)
+}
+
+// Announces returns the number of announces answered on both endpoints
+func (tr *Tracker) Announces() int {
+	return int(tr.announces.Load())
+}
+
+// Close stops both endpoints
+func (tr *Tracker) Close() error {
+	err := tr.http.Close()
+	tr.udp.Close()
+	tr.wg.Wait()
+	return err
+}
+
+func (tr *Tracker) compactPeers(infoHash [20]byte) []byte {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	var buf []byte
+	for _, p := range tr.peers[infoHash] {
+		buf = append(buf, p.IP.To4()...)
+		buf = binary.BigEndian.AppendUint16(buf, p.Port)
+	}
+	return buf
+}
+
+func (tr *Tracker) count(infoHash [20]byte) int {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return len(tr.peers[infoHash])
+}
+
+func (tr *Tracker) serveAnnounce(w http.ResponseWriter, r *http.Request) {
+	var infoHash [20]byte
+	hash := r.URL.Query().Get("info_hash")
+	if len(hash) != len(infoHash) {
+		writeBencode(w, map[string]interface{}{"failure reason": "invalid info_hash"})
+		return
+	}
+	copy(infoHash[:], hash)
+	tr.announces.Add(1)
+	writeBencode(w, map[string]interface{}{
+		"interval": 1800,
+		"peers":    string(tr.compactPeers(infoHash)),
+	})
+}
+
+func (tr *Tracker) serveScrape(w http.ResponseWriter, r *http.Request) {
+	files := make(map[string]interface{})
+	for _, hash := range r.URL.Query()["info_hash"] {
+		var infoHash [20]byte
+		copy(infoHash[:], hash)
+		files[hash] = map[string]interface{}{
+			"complete":   tr.count(infoHash),
+			"incomplete": 0,
+			"downloaded": 0,
+		}
+	}
+	writeBencode(w, map[string]interface{}{"files": files})
+}
+
+func writeBencode(w http.ResponseWriter, v interface{}) {
+	data, err := bencode.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(data)
+}
+
+// serveUDP answers BEP 15 connect, announce and scrape requests until the
+// socket is closed
+func (tr *Tracker) serveUDP() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := tr.udp.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		reply, err := tr.handleUDP(buf[:n])
+		if err != nil {
+			continue
+		}
+		tr.udp.WriteTo(reply, addr)
+	}
+}
+
+func (tr *Tracker) handleUDP(req []byte) ([]byte, error) {
+	if len(req) < 16 {
+		return nil, fmt.Errorf("request too short")
+	}
+	connID := binary.BigEndian.Uint64(req[0:8])
+	action := binary.BigEndian.Uint32(req[8:12])
+	trxID := req[12:16]
+	reply := binary.BigEndian.AppendUint32(nil, action)
+	reply = append(reply, trxID...)
+
+	if action == 0 {
+		if connID != udpProtocolID {
+			return nil, fmt.Errorf("bad protocol id")
+		}
+		id := rand.Uint64()
+		tr.mu.Lock()
+		tr.conns[id] = true
+		tr.mu.Unlock()
+		return binary.BigEndian.AppendUint64(reply, id), nil
+	}
+	tr.mu.Lock()
+	known := tr.conns[connID]
+	tr.mu.Unlock()
+	if !known {
+		return nil, fmt.Errorf("unknown connection id")
+	}
+
+	var infoHash [20]byte
+	switch action {
+	case 1:
+		if len(req) < 98 {
+			return nil, fmt.Errorf("announce too short")
+		}
+		copy(infoHash[:], req[16:36])
+		tr.announces.Add(1)
+		compact := tr.compactPeers(infoHash)
+		seeders := len(compact) / peers.PeerSize
+		reply = binary.BigEndian.AppendUint32(reply, 1800)
+		reply = binary.BigEndian.AppendUint32(reply, 0)
+		reply = binary.BigEndian.AppendUint32(reply, uint32(seeders))
+		return append(reply, compact...), nil
+	case 2:
+		for hashes := req[16:]; len(hashes) >= 20; hashes = hashes[20:] {
+			copy(infoHash[:], hashes[:20])
+			reply = binary.BigEndian.AppendUint32(reply, uint32(tr.count(infoHash)))
+			reply = binary.BigEndian.AppendUint32(reply, 0)
+			reply = binary.BigEndian.AppendUint32(reply, 0)
+		}
+		return reply, nil
+	}
+	return nil, fmt.Errorf("unknown action %d", action)
+}
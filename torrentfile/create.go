@@ -0,0 +1,253 @@
+package torrentfile
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/souravbiswassanto/bit-torrent-client/bencode"
+)
+
+const (
+	// MinPieceLength is the smallest piece length picked automatically
+	MinPieceLength = 16 * 1024
+	// MaxPieceLength is the largest piece length picked automatically
+	MaxPieceLength = 16 * 1024 * 1024
+	// targetPieces is the piece count auto selection aims for
+	targetPieces = 1500
+)
+
+// CreateOptions describes the metadata written into a new .torrent file.
+// Every field is optional, a zero PieceLength selects one based on the
+// total size of the content. Announce defaults to the first tracker of
+// AnnounceList, and a torrent without either is trackerless, found only
+// through web seeds or other peer sources.
+type CreateOptions struct {
+	Name         string
+	PieceLength  int
+	Announce     string
+	AnnounceList [][]string
+	Comment      string
+	CreatedBy    string
+	CreationDate time.Time
+	Private      bool
+	WebSeeds     []string
+	Source       string
+}
+
+type createTorrent struct {
+	Announce     string     `bencode:"announce,omitempty"`
+	AnnounceList [][]string `bencode:"announce-list,omitempty"`
+	Comment      string     `bencode:"comment,omitempty"`
+	CreatedBy    string     `bencode:"created by,omitempty"`
+	CreationDate int64      `bencode:"creation date,omitempty"`
+	URLList      []string   `bencode:"url-list,omitempty"`
+	Info         createInfo `bencode:"info"`
+}
+
+type createInfo struct {
+	Name        string       `bencode:"name"`
+	PieceLength int          `bencode:"piece length"`
+	Pieces      string       `bencode:"pieces"`
+	Length      int          `bencode:"length,omitempty"`
+	Files       []createFile `bencode:"files,omitempty"`
+	Private     int          `bencode:"private,omitempty"`
+	Source      string       `bencode:"source,omitempty"`
+}
+
+type createFile struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
+}
+
+// sourceFile is a file on disk together with its path inside the torrent
+type sourceFile struct {
+	diskPath string
+	path     []string
+	length   int
+}
+
+// Create hashes the file or directory tree at root and returns the
+// bencoded content of a .torrent describing it.
+func Create(root string, opts CreateOptions) ([]byte, error) {
+	root = filepath.Clean(root)
+	st, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	files, err := collectFiles(root, st)
+	if err != nil {
+		return nil, err
+	}
+
+	total := 0
+	for _, f := range files {
+		total += f.length
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("%s has no content to share", root)
+	}
+
+	pieceLength := opts.PieceLength
+	if pieceLength == 0 {
+		pieceLength = AutoPieceLength(total)
+	}
+	if pieceLength <= 0 || pieceLength&(pieceLength-1) != 0 {
+		return nil, fmt.Errorf("piece length %d must be a positive power of two", pieceLength)
+	}
+
+	pieces, err := hashPieces(files, pieceLength)
+	if err != nil {
+		return nil, err
+	}
+
+	name := opts.Name
+	if name == "" {
+		name = st.Name()
+	}
+	info := createInfo{
+		Name:        name,
+		PieceLength: pieceLength,
+		Pieces:      string(pieces),
+		Source:      opts.Source,
+	}
+	if opts.Private {
+		info.Private = 1
+	}
+	if st.IsDir() {
+		for _, f := range files {
+			info.Files = append(info.Files, createFile{Length: f.length, Path: f.path})
+		}
+	} else {
+		info.Length = total
+	}
+
+	ct := createTorrent{
+		Announce:     opts.Announce,
+		AnnounceList: opts.AnnounceList,
+		Comment:      opts.Comment,
+		CreatedBy:    opts.CreatedBy,
+		URLList:      opts.WebSeeds,
+		Info:         info,
+	}
+	if ct.Announce == "" && len(ct.AnnounceList) > 0 && len(ct.AnnounceList[0]) > 0 {
+		ct.Announce = ct.AnnounceList[0][0]
+	}
+	if !opts.CreationDate.IsZero() {
+		ct.CreationDate = opts.CreationDate.Unix()
+	}
+
+	return bencode.Marshal(ct)
+}
+
+// CreateFile is like Create but writes the torrent to outPath
+func CreateFile(root, outPath string, opts CreateOptions) error {
+	data, err := Create(root, opts)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(outPath, data, 0644)
+}
+
+// AutoPieceLength picks a power of two piece length that splits total
+// bytes into roughly targetPieces pieces
+func AutoPieceLength(total int) int {
+	pieceLength := MinPieceLength
+	for pieceLength < MaxPieceLength && total/pieceLength > targetPieces {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+// collectFiles lists the regular files under root in the order they are
+// laid out in the torrent. Paths are sorted so the result is reproducible.
+func collectFiles(root string, st fs.FileInfo) ([]sourceFile, error) {
+	if !st.IsDir() {
+		return []sourceFile{{diskPath: root, path: []string{st.Name()}, length: int(st.Size())}}, nil
+	}
+	var files []sourceFile
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, sourceFile{
+			diskPath: p,
+			path:     splitPath(rel),
+			length:   int(info.Size()),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return lessPath(files[i].path, files[j].path)
+	})
+	return files, nil
+}
+
+func splitPath(rel string) []string {
+	return strings.Split(filepath.ToSlash(rel), "/")
+}
+
+func lessPath(a, b []string) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return len(a) < len(b)
+}
+
+// hashPieces streams the files back to back and returns the concatenated
+// SHA-1 hash of every piece
+func hashPieces(files []sourceFile, pieceLength int) ([]byte, error) {
+	var pieces []byte
+	buf := make([]byte, pieceLength)
+	filled := 0
+	for _, f := range files {
+		file, err := os.Open(f.diskPath)
+		if err != nil {
+			return nil, err
+		}
+		for {
+			n, err := io.ReadFull(file, buf[filled:])
+			filled += n
+			if filled == pieceLength {
+				h := sha1.Sum(buf)
+				pieces = append(pieces, h[:]...)
+				filled = 0
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				file.Close()
+				return nil, err
+			}
+		}
+		file.Close()
+	}
+	if filled > 0 {
+		h := sha1.Sum(buf[:filled])
+		pieces = append(pieces, h[:]...)
+	}
+	return pieces, nil
+}
@@ -0,0 +1,153 @@
+package torrentfile_test
+
+import (
+	"crypto/sha1"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	tf "github.com/souravbiswassanto/bit-torrent-client/torrentfile"
+)
+
+func TestCreateRoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	content := func(n int) []byte {
+		b := make([]byte, n)
+		rnd.Read(b)
+		return b
+	}
+	// files maps slash separated paths below the root to their content,
+	// a single file root is named by the empty path
+	tests := []struct {
+		name  string
+		files map[string][]byte
+		opts  tf.CreateOptions
+		// want are the paths of the parsed torrent's files in order
+		want [][]string
+	}{
+		{
+			name:  "single file",
+			files: map[string][]byte{"": content(40000)},
+			opts:  tf.CreateOptions{PieceLength: 16384},
+			want:  [][]string{{"root"}},
+		},
+		{
+			name: "directory with every option",
+			files: map[string][]byte{
+				"b.bin":       content(20000),
+				"a/nested.go": content(5),
+				"a/z.txt":     content(16384),
+				"empty":       {},
+			},
+			opts: tf.CreateOptions{
+				Name:         "custom",
+				AnnounceList: [][]string{{"http://a.example/announce", "udp://b.example:80"}, {"http://c.example/announce"}},
+				Comment:      "a comment",
+				CreatedBy:    "test",
+				CreationDate: time.Unix(1700000000, 0).UTC(),
+				Private:      true,
+				WebSeeds:     []string{"http://seed.example/"},
+				Source:       "src",
+			},
+			want: [][]string{{"a", "nested.go"}, {"a", "z.txt"}, {"b.bin"}, {"empty"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := filepath.Join(t.TempDir(), "root")
+			for path, data := range tt.files {
+				full := filepath.Join(root, filepath.FromSlash(path))
+				err := os.MkdirAll(filepath.Dir(full), 0755)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = os.WriteFile(full, data, 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			data, err := tf.Create(root, tt.opts)
+			if err != nil {
+				t.Fatalf("Create: %v", err)
+			}
+			torrent, err := tf.Parse(data)
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+
+			name := tt.opts.Name
+			if name == "" {
+				name = "root"
+			}
+			var all []byte
+			var paths [][]string
+			for _, f := range torrent.Files {
+				paths = append(paths, f.Path)
+				key := filepath.ToSlash(filepath.Join(f.Path...))
+				if len(tt.files) == 1 {
+					key = ""
+				}
+				if f.Length != len(tt.files[key]) {
+					t.Errorf("file %v is %d bytes, want %d", f.Path, f.Length, len(tt.files[key]))
+				}
+				all = append(all, tt.files[key]...)
+			}
+			if !reflect.DeepEqual(paths, tt.want) {
+				t.Errorf("files = %q, want %q", paths, tt.want)
+			}
+			if torrent.Name != name || torrent.Length != len(all) {
+				t.Errorf("torrent %q of %d bytes, want %q of %d", torrent.Name, torrent.Length, name, len(all))
+			}
+			for i, hash := range torrent.PieceHashes {
+				end := (i + 1) * torrent.PieceLength
+				if end > len(all) {
+					end = len(all)
+				}
+				if hash != sha1.Sum(all[i*torrent.PieceLength:end]) {
+					t.Errorf("hash of piece %d does not match the content", i)
+				}
+			}
+			if want := (len(all) + torrent.PieceLength - 1) / torrent.PieceLength; len(torrent.PieceHashes) != want {
+				t.Errorf("%d piece hashes, want %d", len(torrent.PieceHashes), want)
+			}
+
+			opts := tt.opts
+			if len(opts.AnnounceList) > 0 && torrent.Announce != opts.AnnounceList[0][0] {
+				t.Errorf("Announce = %q, want the first tracker %q", torrent.Announce, opts.AnnounceList[0][0])
+			}
+			if opts.PieceLength != 0 && torrent.PieceLength != opts.PieceLength {
+				t.Errorf("PieceLength = %d, want %d", torrent.PieceLength, opts.PieceLength)
+			}
+			// Name and PieceLength are checked above
+			got := tf.CreateOptions{
+				Name:         opts.Name,
+				PieceLength:  opts.PieceLength,
+				AnnounceList: torrent.AnnounceList,
+				Comment:      torrent.Comment,
+				CreatedBy:    torrent.CreatedBy,
+				CreationDate: torrent.CreationDate,
+				Private:      torrent.Private,
+				WebSeeds:     torrent.URLList,
+				Source:       torrent.Source,
+			}
+			if !reflect.DeepEqual(got, opts) {
+				t.Errorf("parsed metadata %+v, want %+v", got, opts)
+			}
+
+			// the content the torrent was created from verifies against it
+			have, err := torrent.Verify(root)
+			if err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+			for i, ok := range have {
+				if !ok {
+					t.Errorf("piece %d does not verify", i)
+				}
+			}
+		})
+	}
+}
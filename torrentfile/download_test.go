@@ -0,0 +1,108 @@
+package torrentfile_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/souravbiswassanto/bit-torrent-client/config"
+	"github.com/souravbiswassanto/bit-torrent-client/mse"
+	"github.com/souravbiswassanto/bit-torrent-client/swarmtest"
+)
+
+func TestDownload(t *testing.T) {
+	tests := []struct {
+		name  string
+		swarm swarmtest.Config
+		// corrupt adds a seeder that flips a byte of every block
+		corrupt bool
+		// proxy sends every connection through a SOCKS5 proxy
+		proxy bool
+		cfg   func(*config.Config)
+	}{
+		{
+			name:  "single seeder",
+			swarm: swarmtest.Config{Size: 256 << 10, Seeders: 1},
+		},
+		{
+			name:    "corrupt peer",
+			swarm:   swarmtest.Config{Size: 256 << 10, Seeders: 1, PieceLength: 16 << 10},
+			corrupt: true,
+		},
+		{
+			name:  "plain",
+			swarm: swarmtest.Config{Size: 256 << 10, Seeders: 2},
+			cfg:   func(c *config.Config) { c.Encryption = mse.PolicyDisabled },
+		},
+		{
+			name:  "encrypted",
+			swarm: swarmtest.Config{Size: 256 << 10, Seeders: 2},
+			cfg:   func(c *config.Config) { c.Encryption = mse.PolicyRequired },
+		},
+		{
+			name:  "utp",
+			swarm: swarmtest.Config{Size: 256 << 10, Seeders: 2, UTP: true},
+		},
+		{
+			name:  "proxy",
+			swarm: swarmtest.Config{Size: 256 << 10, Seeders: 1},
+			proxy: true,
+		},
+		{
+			name:  "multi-file over the udp tracker",
+			swarm: swarmtest.Config{Files: []int{100 << 10, 1, 60 << 10}, Seeders: 1, Leechers: 2, UDPTracker: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := swarmtest.New(tt.swarm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			var corrupt *swarmtest.Peer
+			if tt.corrupt {
+				have := make([]bool, len(s.Torrent.PieceHashes))
+				for i := range have {
+					have[i] = true
+				}
+				corrupt, err = s.AddPeer(have, swarmtest.Behaviour{BadData: 1})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			cfg := testConfig(t)
+			if tt.cfg != nil {
+				tt.cfg(&cfg)
+			}
+			var proxy *swarmtest.SOCKS5
+			if tt.proxy {
+				proxy, err = swarmtest.NewSOCKS5()
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer proxy.Close()
+				cfg.Proxy = proxy.URL
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			path := filepath.Join(t.TempDir(), "download")
+			err = s.Torrent.Download(ctx, cfg, path, nil)
+			if err != nil {
+				t.Fatalf("Download: %v", err)
+			}
+			err = s.Check(path)
+			if err != nil {
+				t.Error(err)
+			}
+			if corrupt != nil && corrupt.Uploaded() == 0 {
+				t.Error("corrupt peer served no blocks")
+			}
+			if proxy != nil && proxy.Connects() == 0 {
+				t.Error("no connection went through the proxy")
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package torrentfile
+
+import (
+	"encoding/hex"
+	"time"
+)
+
+// Metadata summarizes a torrent for display. Its JSON form is what the
+// info command prints with -json.
+type Metadata struct {
+	Name string `json:"name"`
+	// InfoHash is the hex SHA-1 info hash, empty for v2-only torrents.
+	// InfoHashV2 is the hex SHA-256 info hash, empty for v1 torrents.
+	InfoHash    string `json:"info_hash,omitempty"`
+	InfoHashV2  string `json:"info_hash_v2,omitempty"`
+	MetaVersion int    `json:"meta_version"`
+	Hybrid      bool   `json:"hybrid"`
+	Size        int    `json:"size"`
+	PieceLength int    `json:"piece_length"`
+	Pieces      int    `json:"pieces"`
+	// Files is the content as a tree rooted at the torrent's name, pad
+	// files left out
+	Files FileNode `json:"files"`
+	// Trackers are grouped in tiers tried in order
+	Trackers     [][]string `json:"trackers"`
+	WebSeeds     []string   `json:"web_seeds"`
+	Comment      string     `json:"comment,omitempty"`
+	CreatedBy    string     `json:"created_by,omitempty"`
+	CreationDate *time.Time `json:"creation_date,omitempty"`
+	Private      bool       `json:"private"`
+	Source       string     `json:"source,omitempty"`
+}
+
+// FileNode is a file, or a directory when it has Children. The size of a
+// directory is the total of its files.
+type FileNode struct {
+	Name     string     `json:"name"`
+	Size     int        `json:"size"`
+	Children []FileNode `json:"children,omitempty"`
+}
+
+// Metadata returns the description of the torrent
+func (t *TorrentFile) Metadata() Metadata {
+	m := Metadata{
+		Name:        t.Name,
+		MetaVersion: t.MetaVersion,
+		Hybrid:      t.IsHybrid(),
+		Size:        t.Length,
+		PieceLength: t.PieceLength,
+		Pieces:      len(t.PieceHashes),
+		Files:       t.fileTree(),
+		Trackers:    t.trackerTiers(),
+		WebSeeds:    append([]string{}, t.URLList...),
+		Comment:     t.Comment,
+		CreatedBy:   t.CreatedBy,
+		Private:     t.Private,
+		Source:      t.Source,
+	}
+	if t.MetaVersion != 2 || t.IsHybrid() {
+		m.InfoHash = hex.EncodeToString(t.InfoHash[:])
+	}
+	if t.MetaVersion == 2 {
+		m.InfoHashV2 = hex.EncodeToString(t.InfoHashV2[:])
+		if !t.IsHybrid() {
+			m.Pieces = len(t.v2Pieces())
+		}
+	}
+	if !t.CreationDate.IsZero() {
+		date := t.CreationDate
+		m.CreationDate = &date
+	}
+	return m
+}
+
+// trackerTiers returns the announce-list, or Announce as the only tier
+func (t *TorrentFile) trackerTiers() [][]string {
+	if len(t.AnnounceList) > 0 {
+		return t.AnnounceList
+	}
+	if t.Announce != "" {
+		return [][]string{{t.Announce}}
+	}
+	return [][]string{}
+}
+
+// fileTree nests the files below the torrent's name, in the order they are
+// laid out in
+func (t *TorrentFile) fileTree() FileNode {
+	root := FileNode{Name: t.Name}
+	if !t.multiFile {
+		root.Size = t.Length
+		return root
+	}
+	root.Children = []FileNode{}
+	for _, f := range t.Files {
+		if f.Padding {
+			continue
+		}
+		root.add(f.Path, f.Length)
+	}
+	return root
+}
+
+func (n *FileNode) add(path []string, size int) {
+	n.Size += size
+	if len(path) == 0 {
+		return
+	}
+	for i := range n.Children {
+		if n.Children[i].Name == path[0] && (len(path) > 1) == (n.Children[i].Children != nil) {
+			n.Children[i].add(path[1:], size)
+			return
+		}
+	}
+	child := FileNode{Name: path[0]}
+	if len(path) > 1 {
+		child.Children = []FileNode{}
+	}
+	child.add(path[1:], size)
+	n.Children = append(n.Children, child)
+}
@@ -0,0 +1,50 @@
+package torrentfile
+
+import (
+	"encoding/hex"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Magnet returns a magnet link for the torrent. It names the swarm by its
+// v1 info hash and, for v2 and hybrid torrents, its v2 multihash, followed
+// by the name, the size, every tracker of every tier and the web seeds.
+func (t *TorrentFile) Magnet() string {
+	var params []string
+	add := func(key, value string) {
+		params = append(params, key+"="+magnetEscape(value))
+	}
+	if t.MetaVersion != 2 || t.IsHybrid() {
+		params = append(params, "xt=urn:btih:"+hex.EncodeToString(t.InfoHash[:]))
+	}
+	if t.MetaVersion == 2 {
+		// 0x12 is SHA-256 in the multihash table, 0x20 its length
+		params = append(params, "xt=urn:btmh:1220"+hex.EncodeToString(t.InfoHashV2[:]))
+	}
+	if t.Name != "" {
+		add("dn", t.Name)
+	}
+	if t.Length > 0 {
+		add("xl", strconv.Itoa(t.Length))
+	}
+	seen := make(map[string]bool)
+	for _, tier := range t.trackerTiers() {
+		for _, tracker := range tier {
+			if !seen[tracker] {
+				seen[tracker] = true
+				add("tr", tracker)
+			}
+		}
+	}
+	for _, ws := range t.URLList {
+		add("ws", ws)
+	}
+	return "magnet:?" + strings.Join(params, "&")
+}
+
+// magnetEscape escapes a parameter value, with spaces as %20 rather than +
+// which not every client decodes
+func magnetEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
@@ -0,0 +1,114 @@
+package torrentfile_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/souravbiswassanto/bit-torrent-client/bencode"
+	tf "github.com/souravbiswassanto/bit-torrent-client/torrentfile"
+)
+
+// encodeTorrent bencodes a torrent with the given info dictionary
+func encodeTorrent(t *testing.T, info map[string]interface{}) []byte {
+	t.Helper()
+	data, err := bencode.Marshal(map[string]interface{}{
+		"announce": "http://tracker.example/announce",
+		"info":     info,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// v1Info returns the info dictionary of a multi-file torrent of one piece
+func v1Info(files ...map[string]interface{}) map[string]interface{} {
+	list := make([]interface{}, len(files))
+	for i, f := range files {
+		list[i] = f
+	}
+	return map[string]interface{}{
+		"name":         "name",
+		"piece length": 16384,
+		"pieces":       strings.Repeat("x", 20),
+		"files":        list,
+	}
+}
+
+func v1File(length int, path ...string) map[string]interface{} {
+	elems := make([]interface{}, len(path))
+	for i, p := range path {
+		elems[i] = p
+	}
+	return map[string]interface{}{"length": length, "path": elems}
+}
+
+// v2Info returns the info dictionary of a v2 torrent with one empty file
+// at path
+func v2Info(path ...string) map[string]interface{} {
+	var node interface{} = map[string]interface{}{"": map[string]interface{}{"length": 0}}
+	for i := len(path) - 1; i >= 0; i-- {
+		node = map[string]interface{}{path[i]: node}
+	}
+	return map[string]interface{}{
+		"name":         "name",
+		"piece length": 16384,
+		"meta version": 2,
+		"file tree":    node,
+	}
+}
+
+func TestParseRejectsUnsafeFiles(t *testing.T) {
+	tests := []struct {
+		name string
+		info map[string]interface{}
+	}{
+		{"parent directory", v1Info(v1File(1, "..", "evil"))},
+		{"nested parent directory", v1Info(v1File(1, "dir", "..", "..", "evil"))},
+		{"current directory", v1Info(v1File(1, ".", "evil"))},
+		{"absolute", v1Info(v1File(1, "/etc", "passwd"))},
+		{"separator", v1Info(v1File(1, "a/../../evil"))},
+		{"backslash", v1Info(v1File(1, `..\evil`))},
+		{"empty element", v1Info(v1File(1, "dir", "", "evil"))},
+		{"empty path", v1Info(v1File(1))},
+		{"negative file length", v1Info(v1File(1, "a"), v1File(-5, "b"))},
+		{"negative length", map[string]interface{}{
+			"name":         "name",
+			"piece length": 16384,
+			"pieces":       strings.Repeat("x", 20),
+			"length":       -1,
+		}},
+		{"v2 parent directory", v2Info("..", "evil")},
+		{"v2 separator", v2Info("dir/evil")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			torrent, err := tf.Parse(encodeTorrent(t, tt.info))
+			if err == nil {
+				t.Errorf("Parse succeeded with files %+v", torrent.Files)
+			}
+		})
+	}
+}
+
+func TestParseAcceptsSafeFiles(t *testing.T) {
+	tests := []struct {
+		name  string
+		info  map[string]interface{}
+		files int
+	}{
+		{"v1", v1Info(v1File(1, "dir", "a.txt"), v1File(0, ".hidden"), v1File(2, "..dots..")), 3},
+		{"v2", v2Info("dir", "a.txt"), 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			torrent, err := tf.Parse(encodeTorrent(t, tt.info))
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if len(torrent.Files) != tt.files {
+				t.Errorf("Parse found %d files, want %d", len(torrent.Files), tt.files)
+			}
+		})
+	}
+}
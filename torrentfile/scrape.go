@@ -0,0 +1,159 @@
+package torrentfile
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	rnd "math/rand"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/souravbiswassanto/bit-torrent-client/bencode"
+	"github.com/souravbiswassanto/bit-torrent-client/config"
+)
+
+// ScrapeResult is the swarm summary a tracker reports for a torrent
+type ScrapeResult struct {
+	Seeders   int
+	Leechers  int
+	Completed int
+}
+
+// Scrape asks the torrent's trackers for the size of the swarm without
+// announcing ourselves. Like an announce it walks the tiers of the
+// announce-list and returns the answer of the first tracker that gives
+// one, or the error of the last tracker tried.
+func (t *TorrentFile) Scrape(ctx context.Context, cfg config.Config) (ScrapeResult, error) {
+	err := errNoTrackers
+	for _, tier := range t.trackerTiers() {
+		for _, announce := range tier {
+			var res ScrapeResult
+			res, err = t.scrapeTracker(ctx, cfg, announce)
+			if err == nil {
+				return res, nil
+			}
+			if ctx.Err() != nil {
+				return ScrapeResult{}, ctx.Err()
+			}
+		}
+	}
+	return ScrapeResult{}, err
+}
+
+// scrapeTracker asks a single tracker for the size of the swarm
+func (t *TorrentFile) scrapeTracker(ctx context.Context, cfg config.Config, announce string) (ScrapeResult, error) {
+	tracker, err := url.Parse(announce)
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+	switch tracker.Scheme {
+	case "http", "https":
+		return t.scrapeHTTP(ctx, cfg, tracker)
+	case "udp":
+		return t.scrapeUDP(ctx, cfg, tracker)
+	default:
+		return ScrapeResult{}, fmt.Errorf("unsupported protocol scheme")
+	}
+}
+
+// scrapeHTTP uses the scrape convention: the last path element of the
+// announce url must start with "announce", which is replaced by "scrape"
+func (t *TorrentFile) scrapeHTTP(ctx context.Context, cfg config.Config, tracker *url.URL) (ScrapeResult, error) {
+	i := strings.LastIndex(tracker.Path, "/")
+	if !strings.HasPrefix(tracker.Path[i+1:], "announce") {
+		return ScrapeResult{}, fmt.Errorf("tracker %s does not support scraping", tracker.Host)
+	}
+	scrape := *tracker
+	scrape.Path = tracker.Path[:i+1] + "scrape" + strings.TrimPrefix(tracker.Path[i+1:], "announce")
+	query := scrape.Query()
+	query.Set("info_hash", string(t.InfoHash[:]))
+	scrape.RawQuery = query.Encode()
+
+	body, err := trackerGet(ctx, cfg, scrape.String())
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+	raw, err := bencode.Decode(body)
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+	dict, _ := raw.(map[string]interface{})
+	if reason, ok := dict["failure reason"].(string); ok {
+		return ScrapeResult{}, fmt.Errorf("tracker failure: %s", reason)
+	}
+	files, _ := dict["files"].(map[string]interface{})
+	stats, ok := files[string(t.InfoHash[:])].(map[string]interface{})
+	if !ok {
+		return ScrapeResult{}, fmt.Errorf("tracker does not know this torrent")
+	}
+	count := func(key string) int {
+		n, _ := stats[key].(int64)
+		return int(n)
+	}
+	return ScrapeResult{
+		Seeders:   count("complete"),
+		Leechers:  count("incomplete"),
+		Completed: count("downloaded"),
+	}, nil
+}
+
+// scrapeUDP implements the scrape action of BEP 15
+func (t *TorrentFile) scrapeUDP(ctx context.Context, cfg config.Config, tracker *url.URL) (ScrapeResult, error) {
+	var res ScrapeResult
+	err := withUDPTracker(ctx, cfg, tracker, func(conn net.Conn) (err error) {
+		res, err = t.scrapeUDPConn(conn, cfg.TrackerTimeout)
+		return err
+	})
+	return res, err
+}
+
+func (t *TorrentFile) scrapeUDPConn(conn net.Conn, timeout time.Duration) (ScrapeResult, error) {
+	trxID := rnd.Int31()
+	_, err := conn.Write(buildConnectRequest(trxID))
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+	response := make([]byte, 16)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	_, err = conn.Read(response)
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+	connectionID, err := parseConnectResponse(response, trxID)
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+
+	trxID = rnd.Int31()
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, connectionID)
+	binary.Write(&buf, binary.BigEndian, int32(2)) // Action (2 for scrape)
+	binary.Write(&buf, binary.BigEndian, trxID)
+	buf.Write(t.InfoHash[:])
+	_, err = conn.Write(buf.Bytes())
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+	scrapeResponse := make([]byte, 20)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	n, err := conn.Read(scrapeResponse)
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+	if n < 20 {
+		return ScrapeResult{}, fmt.Errorf("scrape response too short")
+	}
+	action := binary.BigEndian.Uint32(scrapeResponse[0:4])
+	resTrxID := binary.BigEndian.Uint32(scrapeResponse[4:8])
+	if action != 2 || int32(resTrxID) != trxID {
+		return ScrapeResult{}, fmt.Errorf("invalid scrape response")
+	}
+	return ScrapeResult{
+		Seeders:   int(binary.BigEndian.Uint32(scrapeResponse[8:12])),
+		Completed: int(binary.BigEndian.Uint32(scrapeResponse[12:16])),
+		Leechers:  int(binary.BigEndian.Uint32(scrapeResponse[16:20])),
+	}, nil
+}
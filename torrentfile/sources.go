@@ -0,0 +1,43 @@
+package torrentfile
+
+import (
+	"context"
+	"log"
+
+	"github.com/souravbiswassanto/bit-torrent-client/peers"
+)
+
+// PeerSource discovers peers outside of the torrent's trackers, such as
+// the DHT, peer exchange or local service discovery
+type PeerSource interface {
+	Name() string
+	Peers(ctx context.Context, infoHash [20]byte, port uint16) ([]peers.Peer, error)
+}
+
+// PeerSources are asked for peers in addition to the trackers. Private
+// torrents never contact them.
+var PeerSources []PeerSource
+
+// peerSources returns the sources t may use. This is the single place
+// where the private flag (BEP 27) gates peer discovery.
+func (t *TorrentFile) peerSources() []PeerSource {
+	if t.Private {
+		return nil
+	}
+	return PeerSources
+}
+
+// discoverPeers collects peers for infoHash from every allowed source.
+// A failing source is logged and skipped, trackers remain authoritative.
+func (t *TorrentFile) discoverPeers(ctx context.Context, infoHash [20]byte, port uint16) []peers.Peer {
+	var found []peers.Peer
+	for _, src := range t.peerSources() {
+		ps, err := src.Peers(ctx, infoHash, port)
+		if err != nil {
+			log.Printf("Peer source %s failed: %v\n", src.Name(), err)
+			continue
+		}
+		found = append(found, ps...)
+	}
+	return found
+}
@@ -0,0 +1,70 @@
+package torrentfile_test
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/souravbiswassanto/bit-torrent-client/config"
+	"github.com/souravbiswassanto/bit-torrent-client/peers"
+	"github.com/souravbiswassanto/bit-torrent-client/swarmtest"
+	tf "github.com/souravbiswassanto/bit-torrent-client/torrentfile"
+)
+
+// countingSource is a peer source that finds nothing and counts the
+// times it was asked
+type countingSource struct {
+	calls atomic.Int64
+}
+
+func (s *countingSource) Name() string { return "counting" }
+
+func (s *countingSource) Peers(ctx context.Context, infoHash [20]byte, port uint16) ([]peers.Peer, error) {
+	s.calls.Add(1)
+	return nil, nil
+}
+
+// testConfig returns the default config listening on a free port
+func testConfig(t *testing.T) config.Config {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	cfg := config.Default()
+	cfg.Port = uint16(ln.Addr().(*net.TCPAddr).Port)
+	return cfg
+}
+
+func TestPrivateTorrentSkipsPeerSources(t *testing.T) {
+	src := &countingSource{}
+	saved := tf.PeerSources
+	tf.PeerSources = []tf.PeerSource{src}
+	defer func() { tf.PeerSources = saved }()
+
+	for _, private := range []bool{true, false} {
+		s, err := swarmtest.New(swarmtest.Config{Size: 64 << 10, Seeders: 1, Private: private})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		path := filepath.Join(t.TempDir(), "download")
+		src.calls.Store(0)
+		err = s.Torrent.Download(ctx, testConfig(t), path, nil)
+		cancel()
+		s.Close()
+		if err != nil {
+			t.Fatalf("private %v: Download: %v", private, err)
+		}
+		switch calls := src.calls.Load(); {
+		case private && calls != 0:
+			t.Errorf("peer source asked %d times for a private torrent", calls)
+		case !private && calls == 0:
+			t.Error("peer source never asked for a public torrent")
+		}
+	}
+}
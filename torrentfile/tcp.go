@@ -1,25 +1,23 @@
 package torrentfile
 
 import (
-	"net/http"
+	"context"
 	"net/url"
-	"time"
 
-	bencode "github.com/jackpal/bencode-go"
+	"github.com/souravbiswassanto/bit-torrent-client/bencode"
+	"github.com/souravbiswassanto/bit-torrent-client/config"
 	"github.com/souravbiswassanto/bit-torrent-client/peers"
 )
 
-func (t *TorrentFile) RequestPeersHTTP(tracker *url.URL, peerId [20]byte, port uint16) ([]peers.Peer, error) {
+func (t *TorrentFile) RequestPeersHTTP(ctx context.Context, tracker *url.URL, peerId [20]byte, cfg config.Config) ([]peers.Peer, error) {
 
-	httpClient := &http.Client{Timeout: time.Second * 15}
 	// make a get request to the tracker for peers for this torrent file
-	resp, err := httpClient.Get(tracker.String())
+	body, err := trackerGet(ctx, cfg, tracker.String())
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
 	trackerResponse := bencodeTrackerResp{}
-	err = bencode.Unmarshal(resp.Body, &trackerResponse)
+	err = bencode.Unmarshal(body, &trackerResponse)
 	if err != nil {
 		return nil, err
 	}
@@ -1,82 +1,235 @@
 package torrentfile
 
 import (
-	"bytes"
-	"crypto/rand"
+	"context"
 	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"log"
+	"net"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
-	bencode "github.com/jackpal/bencode-go"
+	"github.com/souravbiswassanto/bit-torrent-client/bencode"
+	"github.com/souravbiswassanto/bit-torrent-client/client"
+	"github.com/souravbiswassanto/bit-torrent-client/config"
+	"github.com/souravbiswassanto/bit-torrent-client/ipfilter"
 	"github.com/souravbiswassanto/bit-torrent-client/p2p"
+	"github.com/souravbiswassanto/bit-torrent-client/peerid"
+	"github.com/souravbiswassanto/bit-torrent-client/peers"
+	"github.com/souravbiswassanto/bit-torrent-client/ratelimit"
+	"github.com/souravbiswassanto/bit-torrent-client/utp"
 )
 
-// Port to listen on
-const Port uint16 = 6881
-
 type bencodeTorrent struct {
-	Announce string      `bencode:"announce"`
-	Info     bencodeInfo `bencode:"info"`
+	Announce string `bencode:"announce"`
+	// Info is kept encoded as the info hashes are taken over its bytes
+	Info bencode.RawMessage `bencode:"info"`
 }
 
 type bencodeInfo struct {
-	Name        string `bencode:"name"`
-	Pieces      string `bencode:"pieces"`
-	PieceLength int    `bencode:"piece length"`
-	Length      int    `bencode:"length"`
+	Name        string        `bencode:"name"`
+	Pieces      string        `bencode:"pieces"`
+	PieceLength int           `bencode:"piece length"`
+	Length      int           `bencode:"length"`
+	Files       []bencodeFile `bencode:"files"`
+	MetaVersion int           `bencode:"meta version"`
+	Private     int           `bencode:"private"`
+}
+
+type bencodeFile struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
+	Attr   string   `bencode:"attr"`
 }
 
 type TorrentFile struct {
-	Announce    string
+	Announce string
+	// InfoHash identifies the swarm. It is the SHA-1 info hash for v1 and
+	// hybrid torrents and the truncated v2 info hash for v2-only torrents.
 	InfoHash    [20]byte
 	PieceHashes [][20]byte
 	PieceLength int
 	Length      int
 	Name        string
+	// Files lists the content in the order it is laid out in pieces.
+	// Single file torrents have one entry named after the torrent.
+	Files []File
+	// MetaVersion is 2 for v2 and hybrid torrents (BEP 52), 1 otherwise
+	MetaVersion int
+	// InfoHashV2 is the SHA-256 info hash of v2 and hybrid torrents
+	InfoHashV2 [32]byte
+	// PieceLayers maps a file's pieces root to the merkle hashes of its pieces
+	PieceLayers map[[32]byte][][32]byte
+	// URLList holds the web seeds of the torrent (BEP 19)
+	URLList []string
+	// Private torrents only get peers from their own trackers (BEP 27)
+	Private bool
+	// AnnounceList holds the tiers of trackers (BEP 12), nil when the
+	// torrent only has Announce
+	AnnounceList [][]string
+	// Comment, CreatedBy, CreationDate and Source are informational and
+	// zero when missing. Source is part of the info dictionary, it makes
+	// the info hash unique to a tracker.
+	Comment      string
+	CreatedBy    string
+	CreationDate time.Time
+	Source       string
+	// multiFile is set when Name is a directory holding Files
+	multiFile bool
+}
+
+// File is a single file inside a torrent
+type File struct {
+	Path   []string
+	Length int
+	// PiecesRoot is the root of the file's v2 merkle tree, zero for v1
+	// torrents and empty files
+	PiecesRoot [32]byte
+	// Padding marks BEP 47 pad files used to align hybrid torrents
+	Padding bool
 }
 
 func Open(filePath string) (TorrentFile, error) {
-	file, err := os.Open(filePath)
+	data, err := os.ReadFile(filePath)
 	if err != nil {
 		return TorrentFile{}, err
 	}
+	return Parse(data)
+}
+
+// Parse reads a torrent from the contents of a .torrent file
+func Parse(data []byte) (TorrentFile, error) {
 	bt := bencodeTorrent{}
 
-	err = bencode.Unmarshal(file, &bt)
+	err := bencode.Unmarshal(data, &bt)
 	if err != nil {
 		return TorrentFile{}, err
 	}
-	return bt.toTorrentFile()
+	raw, err := bencode.Decode(data)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	dict, ok := raw.(map[string]interface{})
+	if !ok {
+		return TorrentFile{}, fmt.Errorf("torrent is not a dictionary")
+	}
+	return bt.toTorrentFile(dict)
 }
 
-func (t *bencodeTorrent) toTorrentFile() (TorrentFile, error) {
-	infoHash, err := t.Info.hash()
+func (t *bencodeTorrent) toTorrentFile(raw map[string]interface{}) (TorrentFile, error) {
+	info, ok := raw["info"].(map[string]interface{})
+	if !ok {
+		return TorrentFile{}, fmt.Errorf("torrent has no info dictionary")
+	}
+	var bi bencodeInfo
+	err := bencode.Unmarshal(t.Info, &bi)
 	if err != nil {
-		return TorrentFile{}, nil
+		return TorrentFile{}, err
 	}
-	pieceHashes, err := t.Info.splitPieceHashes()
+	pieceHashes, err := bi.splitPieceHashes()
 	if err != nil {
 		return TorrentFile{}, err
 	}
-	return TorrentFile{
+	if bi.Length < 0 {
+		return TorrentFile{}, fmt.Errorf("torrent has a negative length")
+	}
+	tf := TorrentFile{
 		Announce:    t.Announce,
-		Length:      t.Info.Length,
+		Length:      bi.Length,
 		PieceHashes: pieceHashes,
-		InfoHash:    infoHash,
-		PieceLength: t.Info.PieceLength,
-		Name:        t.Info.Name,
-	}, nil
+		InfoHash:    sha1.Sum(t.Info),
+		PieceLength: bi.PieceLength,
+		Name:        bi.Name,
+		MetaVersion: 1,
+		Private:     bi.Private == 1,
+	}
+	tf.URLList = parseURLList(raw["url-list"])
+	// the optional keys are read leniently, a malformed one is ignored
+	tf.AnnounceList = parseAnnounceList(raw["announce-list"])
+	tf.Comment, _ = raw["comment"].(string)
+	tf.CreatedBy, _ = raw["created by"].(string)
+	if date, ok := raw["creation date"].(int64); ok && date > 0 {
+		tf.CreationDate = time.Unix(date, 0).UTC()
+	}
+	tf.Source, _ = info["source"].(string)
+	tf.multiFile = len(bi.Files) > 0
+	for _, f := range bi.Files {
+		if f.Length < 0 {
+			return TorrentFile{}, fmt.Errorf("file %q has a negative length", f.Path)
+		}
+		err = checkPath(f.Path)
+		if err != nil {
+			return TorrentFile{}, err
+		}
+		tf.Files = append(tf.Files, File{
+			Path:    f.Path,
+			Length:  f.Length,
+			Padding: strings.Contains(f.Attr, "p"),
+		})
+		tf.Length += f.Length
+	}
+	if len(bi.Files) == 0 && bi.Length > 0 {
+		tf.Files = []File{{Path: []string{bi.Name}, Length: bi.Length}}
+	}
+	if bi.MetaVersion == 2 {
+		err = tf.parseV2(info, raw, sha256.Sum256(t.Info))
+		if err != nil {
+			return TorrentFile{}, err
+		}
+	}
+	return tf, nil
 
 }
 
-func (i *bencodeInfo) hash() ([20]byte, error) {
-	var buf bytes.Buffer
-	err := bencode.Marshal(&buf, *i)
-	if err != nil {
-		return [20]byte{}, err
+// checkPath rejects file paths that could be written outside of the
+// download directory: a path must not be empty, and none of its elements
+// may be empty, "." or "..", or hold a separator or volume name
+func checkPath(path []string) error {
+	if len(path) == 0 {
+		return fmt.Errorf("torrent has a file with an empty path")
+	}
+	for _, elem := range path {
+		if elem == "" || elem == "." || elem == ".." ||
+			strings.ContainsAny(elem, `/\`) || filepath.VolumeName(elem) != "" {
+			return fmt.Errorf("file path %q has an invalid element %q", path, elem)
+		}
+	}
+	return nil
+}
+
+// StorageName returns the name the content is stored under inside a
+// download directory: Name, or the hex info hash if Name is empty, "." or
+// "..", or holds a separator, any of which would point outside of it
+func (t *TorrentFile) StorageName() string {
+	if checkPath([]string{t.Name}) != nil {
+		return hex.EncodeToString(t.InfoHash[:])
 	}
-	h := sha1.Sum(buf.Bytes())
-	return h, nil
+	return t.Name
+}
+
+// parseAnnounceList reads the announce-list key, dropping empty tiers and
+// entries that aren't strings
+func parseAnnounceList(v interface{}) [][]string {
+	list, _ := v.([]interface{})
+	var tiers [][]string
+	for _, t := range list {
+		entries, _ := t.([]interface{})
+		var tier []string
+		for _, e := range entries {
+			if s, ok := e.(string); ok && s != "" {
+				tier = append(tier, s)
+			}
+		}
+		if len(tier) > 0 {
+			tiers = append(tiers, tier)
+		}
+	}
+	return tiers
 }
 
 func (i *bencodeInfo) splitPieceHashes() ([][20]byte, error) {
@@ -94,31 +247,239 @@ func (i *bencodeInfo) splitPieceHashes() ([][20]byte, error) {
 	return sph, nil
 }
 
-func (t *TorrentFile) Download(writePath string) error {
-	var peerId [20]byte
-	_, err := rand.Read(peerId[:])
+// Download fetches the torrent into writePath with the options of cfg,
+// of which MaxPeersPerTorrent applies to the torrent and MaxPeers and
+// Listen are ignored. onProgress, if not nil, receives progress reports.
+// Cancelling ctx stops the tracker requests and peer connections, the
+// pieces downloaded by then are still written and ctx.Err() is returned.
+func (t *TorrentFile) Download(ctx context.Context, cfg config.Config, writePath string, onProgress func(p2p.Progress)) error {
+	err := cfg.Validate()
+	if err != nil {
+		return err
+	}
+	peerId, err := peerid.New()
 	if err != nil {
 		return err
 	}
-	peers, err := t.requestPeers(peerId, Port)
+	var filter *ipfilter.Filter
+	if len(cfg.IPFilter) > 0 {
+		filter, err = ipfilter.Open(cfg.IPFilter...)
+		if err != nil {
+			return err
+		}
+		log.Printf("IP filter blocks %d ranges\n", filter.Len())
+	}
+	torrent, err := t.Prepare(ctx, cfg, peerId)
 	if err != nil {
 		return err
 	}
-	fmt.Println(len(peers), peers)
-	// fmt.Print(peers)
-	torrent := p2p.Torrent{
-		Peers:       peers,
+	torrent.OnProgress = onProgress
+	if cfg.DownloadLimit > 0 {
+		torrent.Options.DownloadLimit = ratelimit.New(cfg.DownloadLimit)
+		for _, ws := range torrent.WebSeeds {
+			ws.Limiter = torrent.Options.DownloadLimit
+		}
+	}
+	if cfg.UploadLimit > 0 {
+		torrent.Options.UploadLimit = ratelimit.New(cfg.UploadLimit)
+	}
+	if cfg.HalfOpen > 0 {
+		torrent.Options.HalfOpen = make(chan struct{}, cfg.HalfOpen)
+	}
+	if filter != nil {
+		torrent.Options.IPFilter = filter
+		ctx, stop := context.WithCancel(ctx)
+		defer stop()
+		go filter.Watch(ctx, time.Minute)
+	}
+	// peers connecting to us can only ask for this torrent
+	swarms := func() []*p2p.Torrent { return []*p2p.Torrent{torrent} }
+	if cfg.UseUTP {
+		socket, err := utp.Listen("udp", fmt.Sprintf(":%d", cfg.Port))
+		if err != nil {
+			log.Printf("uTP disabled: %v\n", err)
+		} else {
+			defer socket.Close()
+			torrent.Options.UTP = socket
+			go p2p.Serve(filter.Listener(socket), torrent.Options, swarms)
+		}
+	}
+	if !cfg.ProxyOnly {
+		ln, err := net.Listen(cfg.Network, fmt.Sprintf(":%d", cfg.Port))
+		if err != nil {
+			log.Printf("Not accepting incoming peers: %v\n", err)
+		} else {
+			defer ln.Close()
+			go p2p.Serve(filter.Listener(ln), torrent.Options, swarms)
+		}
+	}
+	buf, err := torrent.Download(ctx)
+	if err != nil && !errors.Is(err, p2p.ErrIncomplete) && ctx.Err() == nil {
+		return err
+	}
+
+	// an incomplete download still keeps the pieces we got
+	werr := t.WriteFiles(writePath, buf)
+	if werr != nil {
+		return werr
+	}
+	return err
+}
+
+// Prepare finds peers for the torrent and returns it ready to download,
+// with the connection options of cfg. Bandwidth limits, the half-open
+// limit, the IP filter and the uTP socket are left to the caller as they
+// are usually shared. Prepare fails only when neither trackers nor web
+// seeds are available.
+func (t *TorrentFile) Prepare(ctx context.Context, cfg config.Config, peerId [20]byte) (*p2p.Torrent, error) {
+	proxy, err := cfg.ProxyDialer()
+	if err != nil {
+		return nil, err
+	}
+	webSeeds := t.webSeeds()
+	for _, ws := range webSeeds {
+		ws.UserAgent = cfg.UserAgent
+		if proxy != nil {
+			ws.HTTPClient.Transport = proxy.Transport()
+		}
+	}
+	found, alt, err := t.announce(ctx, cfg, peerId)
+	if err != nil {
+		if len(webSeeds) == 0 || ctx.Err() != nil {
+			return nil, err
+		}
+		log.Printf("Could not get peers, downloading from web seeds only: %v\n", err)
+	}
+	log.Printf("Found %d peers\n", len(found)+len(alt))
+	torrent := &p2p.Torrent{
+		Peers:       found,
+		AltPeers:    alt,
 		PeerID:      peerId,
 		InfoHash:    t.InfoHash,
 		PieceHashes: t.PieceHashes,
 		PieceLength: t.PieceLength,
 		Length:      t.Length,
 		Name:        t.Name,
+		WebSeeds:    webSeeds,
+		Options: client.Options{
+			Encryption:        cfg.Encryption,
+			Network:           cfg.Network,
+			DialTimeout:       cfg.DialTimeout,
+			HandshakeTimeout:  cfg.HandshakeTimeout,
+			IdleTimeout:       cfg.IdleTimeout,
+			RequestTimeout:    cfg.RequestTimeout,
+			KeepAliveInterval: cfg.KeepAlive,
+			BlockClients:      cfg.BlockClients,
+			V2:                t.MetaVersion == 2,
+		},
+		MaxPeers:    cfg.MaxPeersPerTorrent,
+		TargetPeers: cfg.TargetPeers,
+		BlockSize:   cfg.BlockSize,
+		Backlog:     cfg.Backlog,
+		Announce: func(ctx context.Context) (found, alt []peers.Peer, err error) {
+			return t.announce(ctx, cfg, peerId)
+		},
 	}
-	err = torrent.Download()
-	if err != nil {
-		return nil
+	if proxy != nil {
+		// peers are only dialed over TCP, uTP can't go through the proxy
+		torrent.Options.Dialer = client.ProxyDialer{Proxy: proxy, Timeout: cfg.DialTimeout}
 	}
+	if t.MetaVersion == 2 {
+		torrent.PieceLayers = t.PieceLayers
+	}
+	switch {
+	case t.IsHybrid():
+		torrent.AltInfoHash = t.TruncatedInfoHashV2()
+	case t.MetaVersion == 2:
+		torrent.V2Pieces = t.v2Pieces()
+	}
+	return torrent, nil
+}
+
+// announce asks the trackers and peer sources for peers, for both swarms
+// of a hybrid torrent. The error is the one of the trackers of the v1
+// swarm, the peer sources are asked even when they fail.
+func (t *TorrentFile) announce(ctx context.Context, cfg config.Config, peerId [20]byte) (found, alt []peers.Peer, err error) {
+	found, err = t.requestPeers(ctx, cfg, peerId)
+	found = append(found, t.discoverPeers(ctx, t.InfoHash, cfg.Port)...)
+	if t.IsHybrid() {
+		// join the v2 swarm as well, it is announced under the truncated v2 hash
+		v2 := *t
+		v2.InfoHash = t.TruncatedInfoHashV2()
+		var v2err error
+		alt, v2err = v2.requestPeers(ctx, cfg, peerId)
+		if v2err != nil && ctx.Err() == nil {
+			log.Printf("Could not get v2 swarm peers: %v\n", v2err)
+		}
+		alt = append(alt, t.discoverPeers(ctx, v2.InfoHash, cfg.Port)...)
+	}
+	if ctx.Err() != nil {
+		return nil, nil, ctx.Err()
+	}
+	return found, alt, err
+}
+
+// WriteFiles stores the downloaded content. Single file torrents are
+// written to writePath, multi-file torrents below the writePath directory.
+func (t *TorrentFile) WriteFiles(writePath string, buf []byte) error {
+	return t.WriteSelectedFiles(writePath, buf, nil)
+}
 
+// WriteSelectedFiles is like WriteFiles but leaves out the files i of a
+// multi-file torrent for which skip[i] is set
+func (t *TorrentFile) WriteSelectedFiles(writePath string, buf []byte, skip []bool) error {
+	if !t.multiFile {
+		if len(skip) > 0 && skip[0] {
+			return nil
+		}
+		return os.WriteFile(writePath, buf, 0644)
+	}
+	offset := 0
+	for i, f := range t.Files {
+		data := buf[offset : offset+f.Length]
+		offset += f.Length
+		if f.Padding || (i < len(skip) && skip[i]) {
+			continue
+		}
+		// Parse already rejects these, but Files may have been set directly
+		err := checkPath(f.Path)
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(append([]string{writePath}, f.Path...)...)
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(path, data, 0644)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
+
+// FilePieces returns the range [begin, end) of the pieces holding Files[i]
+func (t *TorrentFile) FilePieces(i int) (begin, end int) {
+	offset := 0
+	for _, f := range t.Files[:i] {
+		offset += f.Length
+	}
+	length := t.Files[i].Length
+	if length == 0 {
+		return 0, 0
+	}
+	if t.MetaVersion == 2 && !t.IsHybrid() {
+		begin = -1
+		for index, p := range t.v2Pieces() {
+			if p.Offset < offset+length && p.Offset+p.Length > offset {
+				if begin < 0 {
+					begin = index
+				}
+				end = index + 1
+			}
+		}
+		return begin, end
+	}
+	return offset / t.PieceLength, (offset+length-1)/t.PieceLength + 1
+}
@@ -1,43 +1,112 @@
 package torrentfile
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"net/url"
 	"strconv"
 
+	"github.com/souravbiswassanto/bit-torrent-client/config"
+	"github.com/souravbiswassanto/bit-torrent-client/metrics"
 	"github.com/souravbiswassanto/bit-torrent-client/peers"
 )
 
+var announces = metrics.NewCounterVec("bittorrent_tracker_announces_total",
+	"Tracker announces, by tracker and result", "tracker", "result")
+
 type bencodeTrackerResp struct {
 	Interval int    `bencode:"interval"`
 	Peers    string `bencode:"peers"`
 }
 
-// requestPeers this requests the available peers from tracker.
+// errNoTrackers is returned when announcing a trackerless torrent
+var errNoTrackers = errors.New("torrent has no trackers")
+
+// requestPeers asks the trackers for peers tier by tier, as BEP 12 has
+// it: the first tracker that answers is used, and the trackers of the
+// next tier are only tried once all those of a tier failed. The error is
+// the one of the last tracker tried.
+func (t *TorrentFile) requestPeers(ctx context.Context, cfg config.Config, peerId [20]byte) ([]peers.Peer, error) {
+	err := errNoTrackers
+	for _, tier := range t.trackerTiers() {
+		for _, announce := range tier {
+			var found []peers.Peer
+			found, err = t.requestTrackerPeers(ctx, cfg, announce, peerId)
+			if err == nil {
+				return found, nil
+			}
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+		}
+	}
+	return nil, err
+}
+
+// requestTrackerPeers this requests the available peers from tracker.
 // it first builds tracker urls and then make a http get request
 // to the tracker. Tracker then returns the peer list in the response's body
-func (t *TorrentFile) requestPeers(peerId [20]byte, port uint16) ([]peers.Peer, error) {
-	tracker, err := t.buildTrackerUrl(peerId, port)
+func (t *TorrentFile) requestTrackerPeers(ctx context.Context, cfg config.Config, announce string, peerId [20]byte) ([]peers.Peer, error) {
+	tracker, err := t.buildTrackerUrl(announce, peerId, cfg.Port)
 	if err != nil {
 		return nil, err
 	}
 
+	var found []peers.Peer
 	switch tracker.Scheme {
 	case "http", "https":
-		return t.RequestPeersHTTP(tracker, peerId, port)
+		found, err = t.RequestPeersHTTP(ctx, tracker, peerId, cfg)
 	case "udp":
-		return t.RequestPeersUDP(tracker, peerId, port)
+		found, err = t.RequestPeersUDP(ctx, tracker, peerId, cfg)
 	default:
 		return nil, fmt.Errorf("unsupported protocol scheme")
 
 	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	name := tracker.Scheme + "://" + tracker.Host
+	if err != nil {
+		announces.With(name, "failure").Inc()
+		return nil, err
+	}
+	announces.With(name, "success").Inc()
+	return found, nil
 }
 
-// buildTrackerUrls builds a tracker urls from announce part of the
+// maxTrackerResponse bounds the size of an HTTP tracker's response
+const maxTrackerResponse = 4 << 20
+
+// trackerGet sends a GET request to an HTTP tracker with the configured
+// timeout, user agent and proxy and returns the response body
+func trackerGet(ctx context.Context, cfg config.Config, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.UserAgent != "" {
+		req.Header.Set("User-Agent", cfg.UserAgent)
+	}
+	httpClient := &http.Client{Timeout: cfg.TrackerTimeout}
+	if d, _ := cfg.ProxyDialer(); d != nil {
+		httpClient.Transport = d.Transport()
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(io.LimitReader(resp.Body, maxTrackerResponse))
+}
+
+// buildTrackerUrls builds a tracker urls from an announce url of the
 // TorrentFile. It lets tracker to know which file we want and announce
 // our presence in the peerlist by queries params part
-func (t *TorrentFile) buildTrackerUrl(peerId [20]byte, port uint16) (*url.URL, error) {
-	tracker, err := url.Parse(t.Announce)
+func (t *TorrentFile) buildTrackerUrl(announce string, peerId [20]byte, port uint16) (*url.URL, error) {
+	tracker, err := url.Parse(announce)
 	if err != nil {
 		return nil, err
 	}
@@ -55,40 +124,3 @@ func (t *TorrentFile) buildTrackerUrl(peerId [20]byte, port uint16) (*url.URL, e
 
 	return tracker, nil
 }
-
-// func (t *TorrentFile) solve(tracker *url.URL) {
-// 	server, err := net.ResolveUDPAddr("udp", tracker.Host)
-// 	if err != nil {
-// 		fmt.Printf("failed to resolve UDP address: %w", err)
-// 		return
-// 	}
-// 	fmt.Println(server.String())
-// 	conn, err := net.DialUDP("udp", nil, server)
-// 	if err != nil {
-// 		fmt.Printf("failed to dial UDP: %w", err)
-// 		return
-// 	}
-// 	defer conn.Close()
-// 	rn := rnd.Int31()
-// 	_, err = conn.Write(buildConnectRequest(rn))
-// 	if err != nil {
-// 		log.Fatalln(err)
-// 	}
-
-// 	// Read the connect response
-// 	response := make([]byte, 16)
-// 	conn.SetReadDeadline(time.Now().Add(15 * time.Second))
-// 	_, err = conn.Read(response)
-// 	if err != nil {
-// 		fmt.Printf("failed to read connect response: %w", err)
-// 	}
-// 	fmt.Println(string(response))
-
-// 	var bt []byte
-// 	conn.SetReadDeadline(time.Now().Add(15 * time.Second))
-// 	_, err = conn.Read(bt)
-// 	if err != nil {
-// 		log.Fatalln("second ", err)
-// 	}
-// 	fmt.Println("dkdl ", string(bt))
-// }
@@ -0,0 +1,72 @@
+package torrentfile_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/souravbiswassanto/bit-torrent-client/swarmtest"
+)
+
+// deadTracker refuses every connection
+const deadTracker = "http://127.0.0.1:1/announce"
+
+func TestTrackerTiers(t *testing.T) {
+	s, err := swarmtest.New(swarmtest.Config{Size: 64 << 10, Seeders: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	live := s.Tracker.HTTPURL
+
+	tests := []struct {
+		name         string
+		announce     string
+		announceList [][]string
+		wantErr      bool
+	}{
+		{"announce only", live, nil, false},
+		{"dead first tier", deadTracker, [][]string{{deadTracker}, {live}}, false},
+		{"dead tracker first in tier", deadTracker, [][]string{{deadTracker, live}}, false},
+		{"announce-list over announce", live, [][]string{{deadTracker}}, true},
+		{"no trackers", "", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			torrent := s.Torrent
+			torrent.Announce = tt.announce
+			torrent.AnnounceList = tt.announceList
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+
+			res, err := torrent.Scrape(ctx, testConfig(t))
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Scrape = %+v, want an error", res)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Scrape: %v", err)
+			}
+			if res.Seeders != 1 {
+				t.Errorf("Scrape found %d seeders, want 1", res.Seeders)
+			}
+
+			announces := s.Tracker.Announces()
+			path := filepath.Join(t.TempDir(), "download")
+			err = torrent.Download(ctx, testConfig(t), path, nil)
+			if err != nil {
+				t.Fatalf("Download: %v", err)
+			}
+			if s.Tracker.Announces() == announces {
+				t.Error("Download never announced to the live tracker")
+			}
+			err = s.Check(path)
+			if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package torrentfile
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	rnd "math/rand"
@@ -9,29 +10,55 @@ import (
 	"net/url"
 	"time"
 
+	"github.com/souravbiswassanto/bit-torrent-client/config"
 	"github.com/souravbiswassanto/bit-torrent-client/peers"
 )
 
 // requestPeersUDP requests the peer list from udp server
 // http://bittorrent.org/beps/bep_0015.html this explains how to do it
-func (t *TorrentFile) RequestPeersUDP(tracker *url.URL, peerID [20]byte, port uint16) ([]peers.Peer, error) {
-	server, err := net.ResolveUDPAddr("udp", tracker.Host)
-	if err != nil {
-		return nil, err
+func (t *TorrentFile) RequestPeersUDP(ctx context.Context, tracker *url.URL, peerID [20]byte, cfg config.Config) ([]peers.Peer, error) {
+	var found []peers.Peer
+	err := withUDPTracker(ctx, cfg, tracker, func(conn net.Conn) (err error) {
+		found, err = t.announceUDP(conn, peerID, cfg.Port, cfg.TrackerTimeout)
+		return err
+	})
+	return found, err
+}
+
+// withUDPTracker connects to the tracker, through the configured proxy if
+// any, and runs exchange on the connection. The connection is closed when
+// ctx is done, which fails the exchange with ctx.Err().
+func withUDPTracker(ctx context.Context, cfg config.Config, tracker *url.URL, exchange func(conn net.Conn) error) error {
+	var conn net.Conn
+	var err error
+	if d, _ := cfg.ProxyDialer(); d != nil {
+		conn, err = d.DialUDP(ctx, tracker.Host)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "udp", tracker.Host)
 	}
-	conn, err := net.DialUDP("udp", nil, server)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	err = exchange(conn)
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func (t *TorrentFile) announceUDP(conn net.Conn, peerID [20]byte, port uint16, timeout time.Duration) ([]peers.Peer, error) {
 	trxID := rnd.Int31()
 	connReq := buildConnectRequest(trxID)
-	_, err = conn.Write(connReq)
+	_, err := conn.Write(connReq)
 	if err != nil {
 		return nil, err
 	}
 	response := make([]byte, 16)
-	conn.SetReadDeadline(time.Now().Add(15 * time.Second))
+	conn.SetReadDeadline(time.Now().Add(timeout))
 	_, err = conn.Read(response)
 	if err != nil {
 		return nil, err
@@ -50,7 +77,7 @@ func (t *TorrentFile) RequestPeersUDP(tracker *url.URL, peerID [20]byte, port ui
 		return nil, err
 	}
 	announceResponse := make([]byte, 4096)
-	conn.SetDeadline(time.Now().Add(15 * time.Second))
+	conn.SetDeadline(time.Now().Add(timeout))
 	n, err := conn.Read(announceResponse)
 	if err != nil {
 		return nil, err
@@ -64,7 +91,6 @@ func buildConnectRequest(transactionID int32) []byte {
 	binary.Write(&buf, binary.BigEndian, int64(0x41727101980)) // Connection ID
 	binary.Write(&buf, binary.BigEndian, int32(0))             // Action (0 for connect)
 	binary.Write(&buf, binary.BigEndian, transactionID)        // Transaction ID
-	fmt.Println(buf.Bytes())
 	return buf.Bytes()
 }
 
@@ -0,0 +1,220 @@
+package torrentfile
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/souravbiswassanto/bit-torrent-client/merkle"
+	"github.com/souravbiswassanto/bit-torrent-client/p2p"
+)
+
+// parseV2 fills in the BEP 52 fields from the raw torrent dictionary.
+// Hybrid torrents keep their v1 file list and only gain pieces roots.
+func (t *TorrentFile) parseV2(info, raw map[string]interface{}, infoHashV2 [32]byte) error {
+	t.MetaVersion = 2
+	t.InfoHashV2 = infoHashV2
+	if t.PieceLength < merkle.BlockSize || t.PieceLength&(t.PieceLength-1) != 0 {
+		return fmt.Errorf("v2 piece length %d must be a power of two >= %d", t.PieceLength, merkle.BlockSize)
+	}
+
+	tree, ok := info["file tree"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("v2 torrent has no file tree")
+	}
+	files, err := parseFileTree(tree, nil)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("v2 torrent has an empty file tree")
+	}
+
+	t.PieceLayers, err = parsePieceLayers(raw["piece layers"])
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		err = t.checkPieceLayer(f)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !t.IsHybrid() {
+		t.InfoHash = t.TruncatedInfoHashV2()
+		t.Files = files
+		t.multiFile = len(files) > 1 || len(files[0].Path) > 1 || files[0].Path[0] != t.Name
+		t.Length = 0
+		for _, f := range files {
+			t.Length += f.Length
+		}
+		return nil
+	}
+
+	// paths are keyed with every element quoted, so neither spaces nor
+	// slashes inside a name can make two paths collide
+	roots := make(map[string][32]byte, len(files))
+	for _, f := range files {
+		roots[fmt.Sprintf("%q", f.Path)] = f.PiecesRoot
+	}
+	for i, f := range t.Files {
+		if f.Padding {
+			continue
+		}
+		root, ok := roots[fmt.Sprintf("%q", f.Path)]
+		if !ok {
+			return fmt.Errorf("hybrid torrent file %v is missing from the file tree", f.Path)
+		}
+		t.Files[i].PiecesRoot = root
+	}
+	return nil
+}
+
+// parseFileTree flattens a BEP 52 file tree. Directory keys are visited in
+// sorted order which is the order files are laid out in.
+func parseFileTree(tree map[string]interface{}, prefix []string) ([]File, error) {
+	names := make([]string, 0, len(tree))
+	for name := range tree {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var files []File
+	for _, name := range names {
+		node, ok := tree[name].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("file tree entry %q is not a dictionary", name)
+		}
+		path := append(append([]string{}, prefix...), name)
+		err := checkPath(path)
+		if err != nil {
+			return nil, err
+		}
+		if leaf, ok := node[""].(map[string]interface{}); ok {
+			f, err := parseFileTreeLeaf(leaf, path)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, f)
+			continue
+		}
+		sub, err := parseFileTree(node, path)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, sub...)
+	}
+	return files, nil
+}
+
+func parseFileTreeLeaf(leaf map[string]interface{}, path []string) (File, error) {
+	length, ok := leaf["length"].(int64)
+	if !ok || length < 0 {
+		return File{}, fmt.Errorf("file %v has an invalid length", path)
+	}
+	f := File{Path: path, Length: int(length)}
+	if length == 0 {
+		return f, nil
+	}
+	root, ok := leaf["pieces root"].(string)
+	if !ok || len(root) != merkle.HashSize {
+		return File{}, fmt.Errorf("file %v has an invalid pieces root", path)
+	}
+	copy(f.PiecesRoot[:], root)
+	return f, nil
+}
+
+func parsePieceLayers(v interface{}) (map[[32]byte][][32]byte, error) {
+	layers := make(map[[32]byte][][32]byte)
+	if v == nil {
+		return layers, nil
+	}
+	dict, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("piece layers is not a dictionary")
+	}
+	for key, value := range dict {
+		hashes, ok := value.(string)
+		if len(key) != merkle.HashSize || !ok || len(hashes)%merkle.HashSize != 0 {
+			return nil, fmt.Errorf("malformed piece layer")
+		}
+		var root [32]byte
+		copy(root[:], key)
+		layer := make([][32]byte, len(hashes)/merkle.HashSize)
+		for i := range layer {
+			copy(layer[i][:], hashes[i*merkle.HashSize:])
+		}
+		layers[root] = layer
+	}
+	return layers, nil
+}
+
+// checkPieceLayer verifies that the piece layer of a file larger than one
+// piece hashes up to its pieces root
+func (t *TorrentFile) checkPieceLayer(f File) error {
+	if f.Length <= t.PieceLength {
+		return nil
+	}
+	layer, ok := t.PieceLayers[f.PiecesRoot]
+	if !ok {
+		return fmt.Errorf("file %v has no piece layer", f.Path)
+	}
+	pieces := (f.Length + t.PieceLength - 1) / t.PieceLength
+	if len(layer) != pieces {
+		return fmt.Errorf("file %v has %d piece hashes, expected %d", f.Path, len(layer), pieces)
+	}
+	pad := merkle.PadHash(t.PieceLength / merkle.BlockSize)
+	if merkle.Root(layer, merkle.NextPowerOfTwo(pieces), pad) != f.PiecesRoot {
+		return fmt.Errorf("piece layer of file %v does not match its pieces root", f.Path)
+	}
+	return nil
+}
+
+// IsHybrid reports whether the torrent can be joined in both v1 and v2 swarms
+func (t *TorrentFile) IsHybrid() bool {
+	return t.MetaVersion == 2 && len(t.PieceHashes) > 0
+}
+
+// TruncatedInfoHashV2 returns the v2 info hash truncated to 20 bytes as it
+// is used in handshakes and tracker announces
+func (t *TorrentFile) TruncatedInfoHashV2() [20]byte {
+	var h [20]byte
+	copy(h[:], t.InfoHashV2[:])
+	return h
+}
+
+// v2Pieces lays out the pieces of a v2-only torrent. Pieces never span two
+// files, so the last piece of every file may be short.
+func (t *TorrentFile) v2Pieces() []p2p.V2Piece {
+	var pieces []p2p.V2Piece
+	offset := 0
+	for _, f := range t.Files {
+		if f.Length == 0 {
+			continue
+		}
+		if f.Length <= t.PieceLength {
+			pieces = append(pieces, p2p.V2Piece{
+				Offset: offset,
+				Length: f.Length,
+				Root:   f.PiecesRoot,
+				Leaves: merkle.NextPowerOfTwo((f.Length + merkle.BlockSize - 1) / merkle.BlockSize),
+			})
+			offset += f.Length
+			continue
+		}
+		for i, root := range t.PieceLayers[f.PiecesRoot] {
+			length := t.PieceLength
+			if rest := f.Length - i*t.PieceLength; rest < length {
+				length = rest
+			}
+			pieces = append(pieces, p2p.V2Piece{
+				Offset: offset + i*t.PieceLength,
+				Length: length,
+				Root:   root,
+				Leaves: t.PieceLength / merkle.BlockSize,
+			})
+		}
+		offset += f.Length
+	}
+	return pieces
+}
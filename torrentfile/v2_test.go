@@ -0,0 +1,208 @@
+package torrentfile_test
+
+import (
+	"crypto/sha1"
+	"math/rand"
+	"testing"
+
+	"github.com/souravbiswassanto/bit-torrent-client/bencode"
+	"github.com/souravbiswassanto/bit-torrent-client/merkle"
+	tf "github.com/souravbiswassanto/bit-torrent-client/torrentfile"
+)
+
+// v2PieceLength covers two merkle leaves
+const v2PieceLength = 2 * merkle.BlockSize
+
+// v2File returns the pieces root and piece layer of data, the layer is nil
+// for a file of at most one piece
+func v2File(data []byte) ([32]byte, [][32]byte) {
+	leaves := v2PieceLength / merkle.BlockSize
+	if len(data) <= v2PieceLength {
+		blocks := (len(data) + merkle.BlockSize - 1) / merkle.BlockSize
+		return merkle.DataRoot(data, merkle.NextPowerOfTwo(blocks)), nil
+	}
+	var layer [][32]byte
+	for begin := 0; begin < len(data); begin += v2PieceLength {
+		end := begin + v2PieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		layer = append(layer, merkle.DataRoot(data[begin:end], leaves))
+	}
+	root := merkle.Root(layer, merkle.NextPowerOfTwo(len(layer)), merkle.PadHash(leaves))
+	return root, layer
+}
+
+// v2Torrent holds the pieces of a v2 torrent that the tests pick apart
+type v2Torrent struct {
+	info   map[string]interface{}
+	layers map[string]interface{}
+}
+
+// newV2Torrent returns a v2 torrent over a big file of five pieces and a
+// small file of less than one piece. hybrid adds the v1 keys for the same
+// content.
+func newV2Torrent(big, small []byte, hybrid bool) v2Torrent {
+	bigRoot, bigLayer := v2File(big)
+	smallRoot, _ := v2File(small)
+	var layer []byte
+	for _, h := range bigLayer {
+		layer = append(layer, h[:]...)
+	}
+	leaf := func(length int, root [32]byte) map[string]interface{} {
+		return map[string]interface{}{"": map[string]interface{}{
+			"length":      length,
+			"pieces root": string(root[:]),
+		}}
+	}
+	info := map[string]interface{}{
+		"name":         "name",
+		"piece length": v2PieceLength,
+		"meta version": 2,
+		"file tree": map[string]interface{}{
+			"big": leaf(len(big), bigRoot),
+			"dir": map[string]interface{}{"small": leaf(len(small), smallRoot)},
+		},
+	}
+	if hybrid {
+		// the big file ends on a piece boundary so no padding is needed
+		var pieces []byte
+		all := append(append([]byte{}, big...), small...)
+		for begin := 0; begin < len(all); begin += v2PieceLength {
+			end := begin + v2PieceLength
+			if end > len(all) {
+				end = len(all)
+			}
+			h := sha1.Sum(all[begin:end])
+			pieces = append(pieces, h[:]...)
+		}
+		info["pieces"] = string(pieces)
+		info["files"] = []interface{}{v1File(len(big), "big"), v1File(len(small), "dir", "small")}
+	}
+	return v2Torrent{
+		info:   info,
+		layers: map[string]interface{}{string(bigRoot[:]): string(layer)},
+	}
+}
+
+func (v v2Torrent) encode(t *testing.T) []byte {
+	t.Helper()
+	data, err := bencode.Marshal(map[string]interface{}{
+		"announce":     "http://tracker.example/announce",
+		"info":         v.info,
+		"piece layers": v.layers,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestParseV2(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	big := make([]byte, 5*v2PieceLength)
+	small := make([]byte, 100)
+	rnd.Read(big)
+	rnd.Read(small)
+
+	for _, hybrid := range []bool{false, true} {
+		name := "v2"
+		if hybrid {
+			name = "hybrid"
+		}
+		t.Run(name, func(t *testing.T) {
+			torrent, err := tf.Parse(newV2Torrent(big, small, hybrid).encode(t))
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if torrent.MetaVersion != 2 || torrent.IsHybrid() != hybrid {
+				t.Errorf("meta version %d, hybrid %t, want 2 and %t", torrent.MetaVersion, torrent.IsHybrid(), hybrid)
+			}
+			if torrent.Length != len(big)+len(small) {
+				t.Errorf("Length = %d, want %d", torrent.Length, len(big)+len(small))
+			}
+			if !hybrid && torrent.InfoHash != torrent.TruncatedInfoHashV2() {
+				t.Error("v2 torrent is not identified by its truncated v2 info hash")
+			}
+			bigRoot, bigLayer := v2File(big)
+			smallRoot, _ := v2File(small)
+			want := []struct {
+				path   string
+				length int
+				root   [32]byte
+			}{{"big", len(big), bigRoot}, {"dir/small", len(small), smallRoot}}
+			if len(torrent.Files) != len(want) {
+				t.Fatalf("Parse found %d files, want %d", len(torrent.Files), len(want))
+			}
+			for i, f := range torrent.Files {
+				path := f.Path[0]
+				if len(f.Path) > 1 {
+					path += "/" + f.Path[1]
+				}
+				if path != want[i].path || f.Length != want[i].length || f.PiecesRoot != want[i].root {
+					t.Errorf("file %d is %s of %d bytes with root %x, want %s of %d bytes with root %x",
+						i, path, f.Length, f.PiecesRoot, want[i].path, want[i].length, want[i].root)
+				}
+			}
+			if got := torrent.PieceLayers[bigRoot]; len(got) != len(bigLayer) {
+				t.Errorf("piece layer of the big file has %d hashes, want %d", len(got), len(bigLayer))
+			}
+		})
+	}
+}
+
+func TestParseV2Rejects(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	big := make([]byte, 5*v2PieceLength)
+	rnd.Read(big)
+	small := []byte("small")
+	bigRoot, bigLayer := v2File(big)
+	key := string(bigRoot[:])
+
+	tests := []struct {
+		name   string
+		hybrid bool
+		modify func(v v2Torrent)
+	}{
+		{"piece layer does not match the root", false, func(v v2Torrent) {
+			layer := []byte(v.layers[key].(string))
+			layer[0] ^= 1
+			v.layers[key] = string(layer)
+		}},
+		{"missing piece layer", false, func(v v2Torrent) {
+			delete(v.layers, key)
+		}},
+		{"short piece layer", false, func(v v2Torrent) {
+			v.layers[key] = v.layers[key].(string)[:len(bigLayer)*merkle.HashSize-merkle.HashSize]
+		}},
+		{"malformed piece layer", false, func(v v2Torrent) {
+			v.layers[key] = "x"
+		}},
+		{"piece length not a power of two", false, func(v v2Torrent) {
+			v.info["piece length"] = 3 * merkle.BlockSize
+		}},
+		{"piece length below the block size", false, func(v v2Torrent) {
+			v.info["piece length"] = merkle.BlockSize / 2
+		}},
+		{"no file tree", false, func(v v2Torrent) {
+			delete(v.info, "file tree")
+		}},
+		{"invalid pieces root", false, func(v v2Torrent) {
+			tree := v.info["file tree"].(map[string]interface{})
+			tree["big"].(map[string]interface{})[""].(map[string]interface{})["pieces root"] = "short"
+		}},
+		{"hybrid file missing from the file tree", true, func(v v2Torrent) {
+			delete(v.info["file tree"].(map[string]interface{}), "dir")
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newV2Torrent(big, small, tt.hybrid)
+			tt.modify(v)
+			torrent, err := tf.Parse(v.encode(t))
+			if err == nil {
+				t.Errorf("Parse succeeded with files %+v", torrent.Files)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package torrentfile
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/souravbiswassanto/bit-torrent-client/merkle"
+)
+
+// Verify checks the data stored at path, the same path Download writes
+// to, and reports for every piece whether it is complete and intact.
+// Missing or short files only fail the pieces they belong to.
+func (t *TorrentFile) Verify(path string) ([]bool, error) {
+	_, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	cr := &contentReader{t: t, root: path, files: make(map[int]*os.File)}
+	defer cr.close()
+
+	if t.MetaVersion == 2 && !t.IsHybrid() {
+		pieces := t.v2Pieces()
+		good := make([]bool, len(pieces))
+		for i, p := range pieces {
+			buf := make([]byte, p.Length)
+			if cr.readAt(buf, p.Offset) == nil {
+				good[i] = merkle.DataRoot(buf, p.Leaves) == p.Root
+			}
+		}
+		return good, nil
+	}
+
+	good := make([]bool, len(t.PieceHashes))
+	for i, hash := range t.PieceHashes {
+		begin := i * t.PieceLength
+		end := begin + t.PieceLength
+		if end > t.Length {
+			end = t.Length
+		}
+		buf := make([]byte, end-begin)
+		if cr.readAt(buf, begin) == nil {
+			sum := sha1.Sum(buf)
+			good[i] = bytes.Equal(sum[:], hash[:])
+		}
+	}
+	return good, nil
+}
+
+// contentReader reads the torrent's content back from the files on disk
+type contentReader struct {
+	t     *TorrentFile
+	root  string
+	files map[int]*os.File
+}
+
+func (cr *contentReader) path(f File) string {
+	if !cr.t.multiFile {
+		return cr.root
+	}
+	return filepath.Join(append([]string{cr.root}, f.Path...)...)
+}
+
+func (cr *contentReader) open(i int) (*os.File, error) {
+	if file, ok := cr.files[i]; ok {
+		return file, nil
+	}
+	file, err := os.Open(cr.path(cr.t.Files[i]))
+	if err != nil {
+		return nil, err
+	}
+	cr.files[i] = file
+	return file, nil
+}
+
+// readAt fills buf with the content at offset off, which may span files
+func (cr *contentReader) readAt(buf []byte, off int) error {
+	fileStart := 0
+	filled := 0
+	for i, f := range cr.t.Files {
+		fileEnd := fileStart + f.Length
+		if filled < len(buf) && off+filled >= fileStart && off+filled < fileEnd {
+			begin := off + filled - fileStart
+			n := f.Length - begin
+			if n > len(buf)-filled {
+				n = len(buf) - filled
+			}
+			chunk := buf[filled : filled+n]
+			if f.Padding {
+				for j := range chunk {
+					chunk[j] = 0
+				}
+			} else {
+				file, err := cr.open(i)
+				if err != nil {
+					return err
+				}
+				_, err = file.ReadAt(chunk, int64(begin))
+				if err != nil {
+					return err
+				}
+			}
+			filled += n
+		}
+		fileStart = fileEnd
+	}
+	if filled != len(buf) {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+func (cr *contentReader) close() {
+	for _, file := range cr.files {
+		file.Close()
+	}
+}
@@ -0,0 +1,44 @@
+package torrentfile
+
+import (
+	"log"
+
+	"github.com/souravbiswassanto/bit-torrent-client/webseed"
+)
+
+// parseURLList reads the url-list key, which may be a single url or a list
+func parseURLList(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		if v != "" {
+			return []string{v}
+		}
+	case []interface{}:
+		var urls []string
+		for _, u := range v {
+			if s, ok := u.(string); ok && s != "" {
+				urls = append(urls, s)
+			}
+		}
+		return urls
+	}
+	return nil
+}
+
+// webSeeds returns a client for every usable entry of the url-list
+func (t *TorrentFile) webSeeds() []*webseed.Client {
+	files := make([]webseed.File, len(t.Files))
+	for i, f := range t.Files {
+		files[i] = webseed.File{Path: f.Path, Length: f.Length, Padding: f.Padding}
+	}
+	var seeds []*webseed.Client
+	for _, u := range t.URLList {
+		ws, err := webseed.New(u, t.Name, files, t.multiFile)
+		if err != nil {
+			log.Printf("Skipping web seed %s: %v\n", u, err)
+			continue
+		}
+		seeds = append(seeds, ws)
+	}
+	return seeds
+}
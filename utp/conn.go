@@ -0,0 +1,548 @@
+package utp
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// maxPayload keeps packets below common path MTUs
+	maxPayload = 1200
+	// recvWindow is the most unread data buffered per connection
+	recvWindow = 1 << 20
+	// minRTO is the lower bound of the retransmission timeout
+	minRTO = 500 * time.Millisecond
+	// maxTransmissions is how often a packet is sent before giving up
+	maxTransmissions = 8
+	// keepAliveInterval is the idle time after which an empty ack is sent
+	keepAliveInterval = 29 * time.Second
+	// idleTimeout drops connections we have not heard from
+	idleTimeout = 60 * time.Second
+	// finTimeout bounds how long a closed connection lingers
+	finTimeout = 10 * time.Second
+)
+
+const (
+	stateSynSent = iota
+	stateConnected
+	stateClosing
+	stateDone
+)
+
+type outPacket struct {
+	typ           uint8
+	seq           uint16
+	payload       []byte
+	sentAt        time.Time
+	transmissions int
+}
+
+// Conn is a single uTP connection. It satisfies net.Conn.
+type Conn struct {
+	s      *Socket
+	remote net.Addr
+	recvID uint16
+	sendID uint16
+
+	mu      sync.Mutex
+	changed chan struct{}
+	state   int
+	err     error
+
+	seq      uint16 // next sequence number to send
+	ack      uint16 // last sequence number received in order
+	inflight []*outPacket
+	peerWnd  int
+	dupAcks  int
+	cc       ledbat
+	// while recovering from a loss every partial ack retransmits the next
+	// missing packet, until recoverSeq is acknowledged
+	recovering bool
+	recoverSeq uint16
+
+	rtt    time.Duration
+	rttVar time.Duration
+	rto    time.Duration
+
+	replyDiff uint32
+	readBuf   []byte
+	pending   map[uint16]*outPacket
+	gotFin    bool
+	eofSeq    uint16
+	eof       bool
+
+	lastRecv  time.Time
+	lastSend  time.Time
+	closedAt  time.Time
+	readDL    time.Time
+	writeDL   time.Time
+	smallWnd  bool
+	localAddr net.Addr
+}
+
+func newConn(s *Socket, remote net.Addr, recvID, sendID uint16) *Conn {
+	now := time.Now()
+	return &Conn{
+		s:         s,
+		remote:    remote,
+		recvID:    recvID,
+		sendID:    sendID,
+		changed:   make(chan struct{}),
+		peerWnd:   recvWindow,
+		cc:        newLedbat(),
+		rto:       time.Second,
+		pending:   make(map[uint16]*outPacket),
+		lastRecv:  now,
+		lastSend:  now,
+		localAddr: s.Addr(),
+	}
+}
+
+// connect sends the SYN of an outgoing connection
+func (c *Conn) connect() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state = stateSynSent
+	c.seq = 1
+	c.queue(stSyn, nil, c.recvID)
+}
+
+// accepted answers the SYN of an incoming connection
+func (c *Conn) accepted(syn header) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state = stateConnected
+	c.seq = uint16(rand.Intn(1 << 16))
+	c.ack = syn.seq
+	c.replyDiff = timestamp(time.Now()) - syn.timestamp
+	c.sendState()
+}
+
+func (c *Conn) waitConnected() error {
+	for {
+		c.mu.Lock()
+		if c.err != nil {
+			err := c.err
+			c.mu.Unlock()
+			return err
+		}
+		if c.state != stateSynSent {
+			c.mu.Unlock()
+			return nil
+		}
+		ch := c.changed
+		c.mu.Unlock()
+		<-ch
+	}
+}
+
+// signal wakes up everyone waiting for a state change. Callers hold mu.
+func (c *Conn) signal() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func wait(ch <-chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		<-ch
+		return nil
+	}
+	d := time.Until(deadline)
+	if d <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ch:
+		return nil
+	case <-t.C:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// fail tears the connection down with err
+func (c *Conn) fail(err error) {
+	c.mu.Lock()
+	if c.state != stateDone {
+		c.state = stateDone
+		if c.err == nil {
+			c.err = err
+		}
+		c.signal()
+	}
+	c.mu.Unlock()
+	c.s.remove(c)
+}
+
+func (c *Conn) window() int {
+	wnd := int(c.cc.cwnd)
+	if c.peerWnd < wnd {
+		wnd = c.peerWnd
+	}
+	return wnd
+}
+
+func (c *Conn) inflightBytes() int {
+	n := 0
+	for _, p := range c.inflight {
+		n += len(p.payload)
+	}
+	return n
+}
+
+// queue assigns the next sequence number to a packet and sends it. Callers
+// hold mu.
+func (c *Conn) queue(typ uint8, payload []byte, connID uint16) {
+	p := &outPacket{typ: typ, seq: c.seq, payload: payload}
+	c.seq++
+	c.inflight = append(c.inflight, p)
+	c.transmit(p, connID)
+}
+
+func (c *Conn) transmit(p *outPacket, connID uint16) {
+	now := time.Now()
+	p.sentAt = now
+	p.transmissions++
+	h := header{
+		typ:           p.typ,
+		connID:        connID,
+		timestamp:     timestamp(now),
+		timestampDiff: c.replyDiff,
+		wndSize:       c.advertisedWindow(),
+		seq:           p.seq,
+		ack:           c.ack,
+	}
+	c.lastSend = now
+	c.s.pc.WriteTo(h.marshal(p.payload), c.remote)
+}
+
+// sendState sends an ack. STATE packets don't consume a sequence number.
+func (c *Conn) sendState() {
+	now := time.Now()
+	h := header{
+		typ:           stState,
+		connID:        c.sendID,
+		timestamp:     timestamp(now),
+		timestampDiff: c.replyDiff,
+		wndSize:       c.advertisedWindow(),
+		seq:           c.seq,
+		ack:           c.ack,
+	}
+	c.lastSend = now
+	c.s.pc.WriteTo(h.marshal(nil), c.remote)
+}
+
+func (c *Conn) advertisedWindow() uint32 {
+	wnd := recvWindow - len(c.readBuf)
+	if wnd < 0 {
+		wnd = 0
+	}
+	c.smallWnd = wnd < maxPayload
+	return uint32(wnd)
+}
+
+// handle processes a packet addressed to this connection
+func (c *Conn) handle(h header, payload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == stateDone {
+		return
+	}
+	now := time.Now()
+	c.lastRecv = now
+	c.replyDiff = timestamp(now) - h.timestamp
+
+	switch h.typ {
+	case stReset:
+		c.state = stateDone
+		c.err = errors.New("utp: connection reset by peer")
+		c.signal()
+		go c.s.remove(c)
+		return
+	case stSyn:
+		// our answer got lost
+		c.sendState()
+		return
+	}
+
+	if c.state == stateSynSent {
+		if h.typ != stState {
+			return
+		}
+		c.state = stateConnected
+		c.ack = h.seq - 1
+	}
+
+	c.peerWnd = int(h.wndSize)
+	c.processAck(h, now)
+
+	if h.typ == stData || h.typ == stFin {
+		c.receive(h, payload)
+		c.sendState()
+	}
+	c.signal()
+}
+
+// processAck drops acknowledged packets from the send queue and feeds
+// the congestion controller. Callers hold mu.
+func (c *Conn) processAck(h header, now time.Time) {
+	acked := 0
+	n := 0
+	for _, p := range c.inflight {
+		if seqLess(h.ack, p.seq) {
+			break
+		}
+		acked += len(p.payload)
+		if p.transmissions == 1 {
+			c.updateRTT(now.Sub(p.sentAt))
+		}
+		n++
+	}
+	if n == 0 {
+		if h.typ == stState && len(c.inflight) > 0 && h.ack == c.inflight[0].seq-1 {
+			c.dupAcks++
+			if c.dupAcks == 3 {
+				c.cc.onLoss()
+				c.startRecovery()
+				c.transmit(c.inflight[0], c.sendID)
+			}
+		}
+		return
+	}
+	c.dupAcks = 0
+	c.inflight = c.inflight[n:]
+	if c.rtt > 0 {
+		c.rto = c.rtt + 4*c.rttVar
+		if c.rto < minRTO {
+			c.rto = minRTO
+		}
+	}
+	if c.recovering {
+		if seqLess(h.ack, c.recoverSeq) && len(c.inflight) > 0 {
+			c.transmit(c.inflight[0], c.sendID)
+		} else {
+			c.recovering = false
+		}
+	}
+	c.cc.onAck(acked, h.timestampDiff, c.inflightBytes()+acked, now)
+}
+
+// startRecovery remembers the last packet in flight at the time of a loss.
+// Callers hold mu.
+func (c *Conn) startRecovery() {
+	c.recovering = true
+	c.recoverSeq = c.seq - 1
+}
+
+func (c *Conn) updateRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rttVar = sample / 2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+	c.rto = c.rtt + 4*c.rttVar
+	if c.rto < minRTO {
+		c.rto = minRTO
+	}
+}
+
+// receive delivers data in sequence order, holding back packets that
+// arrive early. Callers hold mu.
+func (c *Conn) receive(h header, payload []byte) {
+	if !seqLess(c.ack, h.seq) {
+		return // duplicate
+	}
+	if int(h.seq-c.ack) > recvWindow/maxPayload+1 {
+		return // far outside anything we could have asked for
+	}
+	c.pending[h.seq] = &outPacket{typ: h.typ, seq: h.seq, payload: payload}
+	for {
+		p, ok := c.pending[c.ack+1]
+		if !ok {
+			break
+		}
+		delete(c.pending, c.ack+1)
+		c.ack++
+		c.readBuf = append(c.readBuf, p.payload...)
+		if p.typ == stFin {
+			c.gotFin = true
+			c.eofSeq = p.seq
+		}
+	}
+	if c.gotFin && c.ack == c.eofSeq {
+		c.eof = true
+	}
+}
+
+// tick runs timers: SYN and data retransmission, keep-alives and timeouts
+func (c *Conn) tick(now time.Time) {
+	c.mu.Lock()
+	if c.state == stateDone {
+		c.mu.Unlock()
+		return
+	}
+	if c.state == stateClosing && (len(c.inflight) == 0 || now.Sub(c.closedAt) > finTimeout) {
+		c.mu.Unlock()
+		c.fail(ErrClosed)
+		return
+	}
+	if now.Sub(c.lastRecv) > idleTimeout {
+		c.mu.Unlock()
+		c.fail(os.ErrDeadlineExceeded)
+		return
+	}
+	if len(c.inflight) > 0 && now.Sub(c.inflight[0].sentAt) > c.rto {
+		p := c.inflight[0]
+		if p.transmissions >= maxTransmissions {
+			c.mu.Unlock()
+			c.fail(errors.New("utp: peer stopped acknowledging"))
+			return
+		}
+		c.cc.onTimeout()
+		c.startRecovery()
+		c.rto *= 2
+		connID := c.sendID
+		if p.typ == stSyn {
+			connID = c.recvID
+		}
+		c.transmit(p, connID)
+	} else if c.state == stateConnected && now.Sub(c.lastSend) > keepAliveInterval {
+		c.sendState()
+	}
+	c.mu.Unlock()
+}
+
+// Read reads data from the connection
+func (c *Conn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if len(c.readBuf) > 0 {
+			n := copy(b, c.readBuf)
+			c.readBuf = c.readBuf[n:]
+			if c.smallWnd && recvWindow-len(c.readBuf) >= maxPayload {
+				// let the peer know the window opened again
+				c.sendState()
+			}
+			c.mu.Unlock()
+			return n, nil
+		}
+		if c.eof {
+			c.mu.Unlock()
+			return 0, io.EOF
+		}
+		if c.err != nil {
+			err := c.err
+			c.mu.Unlock()
+			return 0, err
+		}
+		ch, deadline := c.changed, c.readDL
+		c.mu.Unlock()
+		err := wait(ch, deadline)
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write sends b, blocking while the congestion window is full
+func (c *Conn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		c.mu.Lock()
+		if c.err != nil || c.state >= stateClosing {
+			err := c.err
+			c.mu.Unlock()
+			if err == nil {
+				err = ErrClosed
+			}
+			return written, err
+		}
+		size := len(b) - written
+		if size > maxPayload {
+			size = maxPayload
+		}
+		inflight := c.inflightBytes()
+		if inflight == 0 || inflight+size <= c.window() {
+			payload := append([]byte{}, b[written:written+size]...)
+			c.queue(stData, payload, c.sendID)
+			written += size
+			c.mu.Unlock()
+			continue
+		}
+		ch, deadline := c.changed, c.writeDL
+		c.mu.Unlock()
+		err := wait(ch, deadline)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Close sends a FIN once queued data is out and releases the connection
+// when it is acknowledged
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch c.state {
+	case stateConnected:
+		c.state = stateClosing
+		c.closedAt = time.Now()
+		c.queue(stFin, nil, c.sendID)
+		if c.err == nil {
+			c.err = ErrClosed
+		}
+		c.signal()
+	case stateSynSent:
+		c.state = stateDone
+		c.err = ErrClosed
+		c.signal()
+		go c.s.remove(c)
+	}
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDL = t
+	c.writeDL = t
+	c.signal()
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDL = t
+	c.signal()
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDL = t
+	c.signal()
+	return nil
+}
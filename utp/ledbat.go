@@ -0,0 +1,106 @@
+package utp
+
+import "time"
+
+const (
+	// targetDelay is the queuing delay LEDBAT aims to add to the path.
+	// Above it the window shrinks so that other traffic gets through.
+	targetDelay = 100000 // microseconds
+	// maxCwndIncrease is the largest growth of the window per round trip
+	maxCwndIncrease = 3000
+	// minCwnd always allows a couple of packets in flight
+	minCwnd = 2 * maxPayload
+	// baseDelayWindow is how long a base delay sample is remembered
+	baseDelayWindow = time.Minute
+)
+
+// ledbat is the delay based congestion controller of BEP 29. It compares
+// the one way delay reported by the peer with the lowest delay seen
+// recently; growth of that difference means we are filling queues.
+type ledbat struct {
+	cwnd float64
+	// slowStart doubles the window every round trip until the delay
+	// target or ssthresh is reached
+	slowStart bool
+	ssthresh  float64
+	// baseDelays holds the minimum delay of the current and previous minute
+	baseDelays [2]uint32
+	haveBase   [2]bool
+	rotatedAt  time.Time
+}
+
+func newLedbat() ledbat {
+	return ledbat{cwnd: minCwnd * 2, slowStart: true, ssthresh: recvWindow, rotatedAt: time.Now()}
+}
+
+func (l *ledbat) baseDelay() uint32 {
+	switch {
+	case l.haveBase[0] && l.haveBase[1]:
+		if l.baseDelays[1] < l.baseDelays[0] {
+			return l.baseDelays[1]
+		}
+		return l.baseDelays[0]
+	case l.haveBase[0]:
+		return l.baseDelays[0]
+	default:
+		return l.baseDelays[1]
+	}
+}
+
+func (l *ledbat) addDelaySample(delay uint32, now time.Time) {
+	if now.Sub(l.rotatedAt) > baseDelayWindow {
+		l.baseDelays[1], l.haveBase[1] = l.baseDelays[0], l.haveBase[0]
+		l.haveBase[0] = false
+		l.rotatedAt = now
+	}
+	if !l.haveBase[0] || delay < l.baseDelays[0] {
+		l.baseDelays[0] = delay
+		l.haveBase[0] = true
+	}
+}
+
+// onAck adjusts the window after acked bytes were acknowledged. delay is the
+// peer's timestamp difference and flight the bytes that were outstanding.
+func (l *ledbat) onAck(acked int, delay uint32, flight int, now time.Time) {
+	if acked == 0 || delay == 0 {
+		return
+	}
+	l.addDelaySample(delay, now)
+	ourDelay := float64(delay - l.baseDelay())
+	offTarget := (targetDelay - ourDelay) / targetDelay
+	if l.slowStart {
+		if offTarget > 0.5 && l.cwnd < l.ssthresh {
+			l.cwnd += float64(acked)
+			return
+		}
+		l.slowStart = false
+	}
+	windowFactor := float64(acked) / l.cwnd
+	if float64(flight) > l.cwnd {
+		windowFactor = float64(acked) / float64(flight)
+	}
+	l.cwnd += maxCwndIncrease * offTarget * windowFactor
+	if l.cwnd < minCwnd {
+		l.cwnd = minCwnd
+	}
+}
+
+// onLoss halves the window after a loss detected by duplicate acks
+func (l *ledbat) onLoss() {
+	l.ssthresh = l.cwnd / 2
+	l.cwnd = l.ssthresh
+	if l.cwnd < minCwnd {
+		l.cwnd = minCwnd
+	}
+	l.slowStart = false
+}
+
+// onTimeout collapses the window after a packet timed out
+func (l *ledbat) onTimeout() {
+	l.ssthresh = l.cwnd / 2
+	if l.ssthresh < minCwnd {
+		l.ssthresh = minCwnd
+	}
+	l.cwnd = minCwnd
+	l.slowStart = true
+}
@@ -0,0 +1,92 @@
+package utp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// packet types
+const (
+	stData  = 0
+	stFin   = 1
+	stState = 2
+	stReset = 3
+	stSyn   = 4
+)
+
+const (
+	version    = 1
+	headerSize = 20
+)
+
+// header is the fixed part of every uTP packet (BEP 29)
+type header struct {
+	typ           uint8
+	connID        uint16
+	timestamp     uint32
+	timestampDiff uint32
+	wndSize       uint32
+	seq           uint16
+	ack           uint16
+}
+
+func (h *header) marshal(payload []byte) []byte {
+	buf := make([]byte, headerSize+len(payload))
+	buf[0] = h.typ<<4 | version
+	buf[1] = 0 // no extensions
+	binary.BigEndian.PutUint16(buf[2:4], h.connID)
+	binary.BigEndian.PutUint32(buf[4:8], h.timestamp)
+	binary.BigEndian.PutUint32(buf[8:12], h.timestampDiff)
+	binary.BigEndian.PutUint32(buf[12:16], h.wndSize)
+	binary.BigEndian.PutUint16(buf[16:18], h.seq)
+	binary.BigEndian.PutUint16(buf[18:20], h.ack)
+	copy(buf[headerSize:], payload)
+	return buf
+}
+
+// isPacket reports whether b looks like a uTP packet rather than another
+// protocol sharing the socket, such as bencoded DHT messages
+func isPacket(b []byte) bool {
+	return len(b) >= headerSize && b[0]&0x0f == version && b[0]>>4 <= stSyn
+}
+
+// parsePacket splits b into header and payload, skipping extensions
+func parsePacket(b []byte) (header, []byte, error) {
+	if !isPacket(b) {
+		return header{}, nil, fmt.Errorf("utp: not a uTP packet")
+	}
+	h := header{
+		typ:           b[0] >> 4,
+		connID:        binary.BigEndian.Uint16(b[2:4]),
+		timestamp:     binary.BigEndian.Uint32(b[4:8]),
+		timestampDiff: binary.BigEndian.Uint32(b[8:12]),
+		wndSize:       binary.BigEndian.Uint32(b[12:16]),
+		seq:           binary.BigEndian.Uint16(b[16:18]),
+		ack:           binary.BigEndian.Uint16(b[18:20]),
+	}
+	ext := b[1]
+	idx := headerSize
+	for ext != 0 {
+		if idx+2 > len(b) {
+			return header{}, nil, fmt.Errorf("utp: truncated extension")
+		}
+		ext = b[idx]
+		length := int(b[idx+1])
+		idx += 2 + length
+		if idx > len(b) {
+			return header{}, nil, fmt.Errorf("utp: truncated extension")
+		}
+	}
+	return h, b[idx:], nil
+}
+
+// timestamp returns the current time in microseconds as carried in headers
+func timestamp(now time.Time) uint32 {
+	return uint32(now.UnixMicro())
+}
+
+// seqLess compares sequence numbers taking wrap around into account
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
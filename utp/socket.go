@@ -0,0 +1,292 @@
+package utp
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// tickInterval is how often connections check their timers
+const tickInterval = 50 * time.Millisecond
+
+// acceptBacklog is the number of incoming connections queued for Accept.
+// Peers connecting while it is full are reset.
+const acceptBacklog = 64
+
+// ErrClosed is returned when using a closed socket or connection
+var ErrClosed = errors.New("utp: use of closed connection")
+
+type connKey struct {
+	addr string
+	id   uint16
+}
+
+type datagram struct {
+	b    []byte
+	addr net.Addr
+}
+
+// Socket multiplexes uTP connections over a single UDP socket. It is a
+// net.Listener for incoming connections and dials outgoing ones. Packets
+// that are not uTP are handed to PacketConn so that other protocols, such
+// as the DHT, can share the port.
+type Socket struct {
+	pc      net.PacketConn
+	mu      sync.Mutex
+	conns   map[connKey]*Conn
+	accept  chan *Conn
+	packets chan datagram
+	closed  chan struct{}
+	once    sync.Once
+}
+
+// Listen opens a UDP socket on addr and starts serving uTP on it
+func Listen(network, addr string) (*Socket, error) {
+	pc, err := net.ListenPacket(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewSocket(pc), nil
+}
+
+// NewSocket serves uTP on an existing packet connection
+func NewSocket(pc net.PacketConn) *Socket {
+	s := &Socket{
+		pc:      pc,
+		conns:   make(map[connKey]*Conn),
+		accept:  make(chan *Conn, acceptBacklog),
+		packets: make(chan datagram, 256),
+		closed:  make(chan struct{}),
+	}
+	go s.readLoop()
+	go s.tickLoop()
+	return s
+}
+
+// Addr returns the local address of the socket
+func (s *Socket) Addr() net.Addr {
+	return s.pc.LocalAddr()
+}
+
+// Accept waits for the next incoming uTP connection
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.accept:
+		return c, nil
+	case <-s.closed:
+		return nil, ErrClosed
+	}
+}
+
+// Close closes the socket and resets every connection on it
+func (s *Socket) Close() error {
+	s.once.Do(func() {
+		close(s.closed)
+		s.mu.Lock()
+		conns := make([]*Conn, 0, len(s.conns))
+		for _, c := range s.conns {
+			conns = append(conns, c)
+		}
+		s.mu.Unlock()
+		for _, c := range conns {
+			c.fail(ErrClosed)
+		}
+		s.pc.Close()
+	})
+	return nil
+}
+
+// DialTimeout connects to addr over uTP
+func (s *Socket) DialTimeout(addr string, timeout time.Duration) (*Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return s.DialContext(ctx, addr)
+}
+
+// DialContext connects to addr over uTP, giving up when ctx is done
+func (s *Socket) DialContext(ctx context.Context, addr string) (*Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	var id uint16
+	for {
+		id = uint16(rand.Intn(1 << 16))
+		_, taken := s.conns[connKey{raddr.String(), id}]
+		if !taken {
+			break
+		}
+	}
+	c := newConn(s, raddr, id, id+1)
+	s.conns[connKey{raddr.String(), id}] = c
+	s.mu.Unlock()
+
+	c.connect()
+	stop := context.AfterFunc(ctx, func() { c.fail(ctx.Err()) })
+	defer stop()
+	err = c.waitConnected()
+	if err != nil {
+		c.fail(err)
+		return nil, err
+	}
+	return c, nil
+}
+
+// PacketConn returns a view of the socket that reads the datagrams which
+// are not uTP and writes raw datagrams. Closing it does not close the socket.
+func (s *Socket) PacketConn() net.PacketConn {
+	return &rawConn{s: s}
+}
+
+func (s *Socket) readLoop() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			s.Close()
+			return
+		}
+		b := append([]byte{}, buf[:n]...)
+		if !isPacket(b) {
+			select {
+			case s.packets <- datagram{b, addr}:
+			default: // nobody reads fast enough, drop like the network would
+			}
+			continue
+		}
+		h, payload, err := parsePacket(b)
+		if err != nil {
+			continue
+		}
+		s.dispatch(h, payload, addr)
+	}
+}
+
+func (s *Socket) dispatch(h header, payload []byte, addr net.Addr) {
+	s.mu.Lock()
+	c, ok := s.conns[connKey{addr.String(), h.connID}]
+	if !ok && h.typ == stSyn {
+		// retransmitted SYNs find the connection under the id + 1
+		c, ok = s.conns[connKey{addr.String(), h.connID + 1}]
+	}
+	if !ok {
+		if h.typ == stSyn {
+			if len(s.accept) == cap(s.accept) {
+				// nobody accepts fast enough, refuse the peer rather than
+				// leave it with a half open connection
+				s.mu.Unlock()
+				s.reset(h, addr)
+				return
+			}
+			c = newConn(s, addr, h.connID+1, h.connID)
+			s.conns[connKey{addr.String(), c.recvID}] = c
+			s.mu.Unlock()
+			c.accepted(h)
+			// only this goroutine queues, so the room checked above is left
+			s.accept <- c
+			return
+		}
+		s.mu.Unlock()
+		if h.typ != stReset {
+			s.reset(h, addr)
+		}
+		return
+	}
+	s.mu.Unlock()
+	c.handle(h, payload)
+}
+
+// reset answers a packet for an unknown connection
+func (s *Socket) reset(h header, addr net.Addr) {
+	r := header{typ: stReset, connID: h.connID, timestamp: timestamp(time.Now()), ack: h.seq}
+	s.pc.WriteTo(r.marshal(nil), addr)
+}
+
+func (s *Socket) remove(c *Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := connKey{c.remote.String(), c.recvID}
+	if s.conns[key] == c {
+		delete(s.conns, key)
+	}
+}
+
+func (s *Socket) tickLoop() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			s.mu.Lock()
+			conns := make([]*Conn, 0, len(s.conns))
+			for _, c := range s.conns {
+				conns = append(conns, c)
+			}
+			s.mu.Unlock()
+			for _, c := range conns {
+				c.tick(now)
+			}
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// rawConn exposes the non-uTP traffic of a Socket
+type rawConn struct {
+	s        *Socket
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+func (r *rawConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	r.mu.Lock()
+	deadline := r.deadline
+	r.mu.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case d := <-r.s.packets:
+		return copy(b, d.b), d.addr, nil
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	case <-r.s.closed:
+		return 0, nil, ErrClosed
+	}
+}
+
+func (r *rawConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return r.s.pc.WriteTo(b, addr)
+}
+
+func (r *rawConn) Close() error {
+	return nil
+}
+
+func (r *rawConn) LocalAddr() net.Addr {
+	return r.s.Addr()
+}
+
+func (r *rawConn) SetDeadline(t time.Time) error {
+	return r.SetReadDeadline(t)
+}
+
+func (r *rawConn) SetReadDeadline(t time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.deadline = t
+	return nil
+}
+
+func (r *rawConn) SetWriteDeadline(t time.Time) error {
+	return r.s.pc.SetWriteDeadline(t)
+}
@@ -0,0 +1,171 @@
+// Package webseed downloads torrent content from the web seeds of BEP 19.
+// Only HTTP and HTTPS seeds are supported. FTP seeds, which the url-list
+// may also hold, are out of scope: the standard library has no FTP client
+// and the seeds we run are HTTP servers, so New rejects them.
+package webseed
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/souravbiswassanto/bit-torrent-client/ratelimit"
+)
+
+// File is a file of the torrent as it is laid out on the web seed
+type File struct {
+	Path    []string
+	Length  int
+	Padding bool
+}
+
+// Client downloads byte ranges of a torrent's content from an HTTP server
+// following the url-list layout of BEP 19
+type Client struct {
+	URL        string
+	Name       string
+	Files      []File
+	MultiFile  bool
+	HTTPClient *http.Client
+	// Limiter caps the download rate, nil means unlimited
+	Limiter *ratelimit.Limiter
+	// UserAgent is sent with every request if set
+	UserAgent string
+}
+
+// New returns a web seed client for seedURL. Only http and https seeds
+// are supported, the ftp seeds BEP 19 also allows are rejected.
+func New(seedURL, name string, files []File, multiFile bool) (*Client, error) {
+	u, err := url.Parse(seedURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported web seed scheme %q, only http and https are supported", u.Scheme)
+	}
+	return &Client{
+		URL:        seedURL,
+		Name:       name,
+		Files:      files,
+		MultiFile:  multiFile,
+		HTTPClient: &http.Client{Timeout: 60 * time.Second},
+	}, nil
+}
+
+func (c *Client) String() string {
+	return c.URL
+}
+
+// ReadAt fills buf with the content starting at offset off. A range that
+// spans several files is fetched with one request per file. The requests
+// are aborted when ctx is done.
+func (c *Client) ReadAt(ctx context.Context, buf []byte, off int) error {
+	fileStart := 0
+	filled := 0
+	for _, f := range c.Files {
+		fileEnd := fileStart + f.Length
+		if filled < len(buf) && off+filled < fileEnd && off+filled >= fileStart {
+			begin := off + filled - fileStart
+			n := f.Length - begin
+			if n > len(buf)-filled {
+				n = len(buf) - filled
+			}
+			chunk := buf[filled : filled+n]
+			if f.Padding {
+				for i := range chunk {
+					chunk[i] = 0
+				}
+			} else {
+				err := c.fetch(ctx, f, begin, chunk)
+				if err != nil {
+					return err
+				}
+			}
+			filled += n
+		}
+		fileStart = fileEnd
+	}
+	if filled != len(buf) {
+		return fmt.Errorf("range %d+%d is beyond the end of the torrent", off, len(buf))
+	}
+	return nil
+}
+
+// fileURL builds the address of f. Single file seeds ending in a slash get
+// the torrent name appended, multi-file seeds get name and path appended.
+func (c *Client) fileURL(f File) string {
+	if !c.MultiFile {
+		if strings.HasSuffix(c.URL, "/") {
+			return c.URL + url.PathEscape(c.Name)
+		}
+		return c.URL
+	}
+	parts := []string{strings.TrimSuffix(c.URL, "/"), url.PathEscape(c.Name)}
+	for _, p := range f.Path {
+		parts = append(parts, url.PathEscape(p))
+	}
+	return strings.Join(parts, "/")
+}
+
+// fetch reads len(buf) bytes of f starting at begin with a Range request
+func (c *Client) fetch(ctx context.Context, f File, begin int, buf []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.fileURL(f), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", begin, begin+len(buf)-1))
+	if c.UserAgent != "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		err = checkContentRange(resp.Header.Get("Content-Range"), begin, len(buf), f.Length)
+		if err != nil {
+			return fmt.Errorf("web seed %s: %w", c.URL, err)
+		}
+	case http.StatusOK:
+		// the server ignored the range, skip to the part we asked for
+		if resp.ContentLength >= 0 && resp.ContentLength != int64(f.Length) {
+			return fmt.Errorf("web seed %s sent %d bytes for a file of %d", c.URL, resp.ContentLength, f.Length)
+		}
+		_, err = io.CopyN(io.Discard, resp.Body, int64(begin))
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("web seed %s returned %s", c.URL, resp.Status)
+	}
+	_, err = io.ReadFull(ratelimit.Reader(resp.Body, c.Limiter), buf)
+	return err
+}
+
+// checkContentRange verifies that the Content-Range of a partial response
+// is the range of length bytes at begin that was asked for, out of a file
+// of size bytes. A server answering with another range would otherwise
+// have its bytes written at the wrong place of the piece.
+func checkContentRange(header string, begin, length, size int) error {
+	var first, last int
+	var total string
+	_, err := fmt.Sscanf(header, "bytes %d-%d/%s", &first, &last, &total)
+	if err != nil {
+		return fmt.Errorf("malformed Content-Range %q", header)
+	}
+	if first != begin || last != begin+length-1 {
+		return fmt.Errorf("got range %d-%d, asked for %d-%d", first, last, begin, begin+length-1)
+	}
+	if total != "*" && total != strconv.Itoa(size) {
+		return fmt.Errorf("got a file of %s bytes, expected %d", total, size)
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package webseed
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// server serves content by path, with range support unless ignoreRange
+// is set, and records the requests it got
+type server struct {
+	content     map[string][]byte
+	ignoreRange bool
+
+	mu       sync.Mutex
+	requests []string
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r.URL.Path+" "+r.Header.Get("Range"))
+	s.mu.Unlock()
+	data, ok := s.content[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if s.ignoreRange {
+		w.Write(data)
+		return
+	}
+	http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(data))
+}
+
+func TestReadAt(t *testing.T) {
+	single := []byte("0123456789abcdefghij")
+	a, b := []byte("first file"), []byte("the second file")
+	multiFiles := []File{
+		{Path: []string{"dir", "a.txt"}, Length: len(a)},
+		{Path: []string{".pad", "6"}, Length: 6, Padding: true},
+		{Path: []string{"b.txt"}, Length: len(b)},
+	}
+	multiContent := map[string][]byte{"/name/dir/a.txt": a, "/name/b.txt": b}
+	multiData := append(append(append([]byte{}, a...), make([]byte, 6)...), b...)
+
+	tests := []struct {
+		name        string
+		content     map[string][]byte
+		ignoreRange bool
+		seedPath    string
+		files       []File
+		multiFile   bool
+		off, length int
+		want        []byte
+		// requests are the paths and ranges the server should get
+		requests []string
+	}{
+		{
+			name:     "single file range",
+			content:  map[string][]byte{"/file": single},
+			seedPath: "/file",
+			files:    []File{{Length: len(single)}},
+			off:      5,
+			length:   10,
+			want:     single[5:15],
+			requests: []string{"/file bytes=5-14"},
+		},
+		{
+			name:     "single file seed directory",
+			content:  map[string][]byte{"/seed/name": single},
+			seedPath: "/seed/",
+			files:    []File{{Length: len(single)}},
+			off:      0,
+			length:   len(single),
+			want:     single,
+			requests: []string{"/seed/name bytes=0-19"},
+		},
+		{
+			name:        "range ignored",
+			content:     map[string][]byte{"/file": single},
+			ignoreRange: true,
+			seedPath:    "/file",
+			files:       []File{{Length: len(single)}},
+			off:         12,
+			length:      8,
+			want:        single[12:],
+			requests:    []string{"/file bytes=12-19"},
+		},
+		{
+			name:      "piece spanning files and padding",
+			content:   multiContent,
+			seedPath:  "/",
+			files:     multiFiles,
+			multiFile: true,
+			off:       6,
+			length:    len(multiData) - 6 - 3,
+			want:      multiData[6 : len(multiData)-3],
+			requests:  []string{"/name/dir/a.txt bytes=6-9", "/name/b.txt bytes=0-11"},
+		},
+		{
+			name:      "piece within padding",
+			content:   multiContent,
+			seedPath:  "/",
+			files:     multiFiles,
+			multiFile: true,
+			off:       len(a) + 1,
+			length:    4,
+			want:      make([]byte, 4),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &server{content: tt.content, ignoreRange: tt.ignoreRange}
+			ts := httptest.NewServer(s)
+			defer ts.Close()
+			c, err := New(ts.URL+tt.seedPath, "name", tt.files, tt.multiFile)
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			buf := make([]byte, tt.length)
+			err = c.ReadAt(context.Background(), buf, tt.off)
+			if err != nil {
+				t.Fatalf("ReadAt: %v", err)
+			}
+			if !bytes.Equal(buf, tt.want) {
+				t.Errorf("ReadAt read %q, want %q", buf, tt.want)
+			}
+			if strings.Join(s.requests, ", ") != strings.Join(tt.requests, ", ") {
+				t.Errorf("requests = %q, want %q", s.requests, tt.requests)
+			}
+		})
+	}
+}
+
+func TestReadAtErrors(t *testing.T) {
+	data := []byte("0123456789")
+	// partial answers with the given Content-Range and body
+	partial := func(contentRange, body string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if contentRange != "" {
+				w.Header().Set("Content-Range", contentRange)
+			}
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write([]byte(body))
+		})
+	}
+	tests := []struct {
+		name    string
+		handler http.Handler
+		path    string
+		off     int
+		length  int
+		wantErr string
+	}{
+		{"not found", &server{}, "/missing", 0, 4, "404 Not Found"},
+		{"beyond the end", &server{content: map[string][]byte{"/file": data}}, "/file", 8, 4, "beyond the end"},
+		{"other range", partial("bytes 0-3/10", "0123"), "/file", 4, 4, "asked for 4-7"},
+		{"shorter range", partial("bytes 4-5/10", "45"), "/file", 4, 4, "asked for 4-7"},
+		{"other file size", partial("bytes 4-7/11", "4567"), "/file", 4, 4, "11 bytes"},
+		{"no content range", partial("", "4567"), "/file", 4, 4, "malformed Content-Range"},
+		{"whole file of another size", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(data[:5])
+		}), "/file", 0, 4, "sent 5 bytes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(tt.handler)
+			defer ts.Close()
+			c, err := New(ts.URL+tt.path, "name", []File{{Length: len(data)}}, false)
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			err = c.ReadAt(context.Background(), make([]byte, tt.length), tt.off)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ReadAt error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewRejectsUnsupportedSchemes(t *testing.T) {
+	for _, u := range []string{"ftp://example.com/file", "file:///tmp/file"} {
+		_, err := New(u, "name", []File{{Length: 1}}, false)
+		if err == nil {
+			t.Errorf("New(%q) succeeded, want an error", u)
+		}
+	}
+}